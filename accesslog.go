@@ -0,0 +1,58 @@
+package socks5
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/natefinch/lumberjack"
+	"github.com/sirupsen/logrus"
+)
+
+const DefaultAccessLogMaxMB = 100
+
+// accessLogger 每个会话结束时写入一行json
+type accessLogger struct {
+	mu     sync.Mutex
+	writer io.Writer
+}
+
+// newAccessLogger path为空时返回nil,不记录访问日志
+func newAccessLogger(path string, maxMB int) *accessLogger {
+	if path == "" {
+		return nil
+	}
+	if maxMB <= 0 {
+		maxMB = DefaultAccessLogMaxMB
+	}
+
+	return &accessLogger{
+		writer: &lumberjack.Logger{
+			Filename:   path,
+			MaxSize:    maxMB,
+			MaxAge:     100,
+			MaxBackups: 100,
+			LocalTime:  true,
+			Compress:   false,
+		},
+	}
+}
+
+func (p *accessLogger) log(session *Session) {
+	if p == nil {
+		return
+	}
+
+	data, err := json.Marshal(session.Info())
+	if err != nil {
+		logrus.WithError(err).Error("access log marshal")
+		return
+	}
+	data = append(data, '\n')
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.writer.Write(data); err != nil {
+		logrus.WithError(err).Error("access log write")
+	}
+}
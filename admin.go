@@ -0,0 +1,200 @@
+package socks5
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// adminServer 管理接口,提供json格式的会话查看、关闭、日志级别和重新加载配置
+type adminServer struct {
+	server *server
+	token  string
+
+	ln  net.Listener
+	srv *http.Server
+}
+
+func newAdminServer(s *server, token string) *adminServer {
+	p := &adminServer{
+		server: s,
+		token:  token,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/sessions", p.handleSessions)
+	mux.HandleFunc("/api/sessions/kill", p.handleKill)
+	mux.HandleFunc("/api/stats", p.handleStats)
+	mux.HandleFunc("/api/routes", p.handleRoutes)
+	mux.HandleFunc("/api/loglevel", p.handleLogLevel)
+	mux.HandleFunc("/api/reload", p.handleReload)
+
+	p.srv = &http.Server{
+		Handler:      p.auth(mux),
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	return p
+}
+
+func (p *adminServer) listen(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	p.ln = ln
+	return nil
+}
+
+func (p *adminServer) serve() {
+	err := p.srv.Serve(p.ln)
+	if err != nil && err != http.ErrServerClosed {
+		logrus.WithError(err).Error("admin serve")
+	}
+}
+
+func (p *adminServer) close() {
+	if p.ln != nil {
+		p.srv.Close()
+	}
+}
+
+func (p *adminServer) auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//只接受Bearer方式,没有前缀的裸token也拒绝
+		h := r.Header.Get("Authorization")
+		const prefix = "Bearer "
+		if !strings.HasPrefix(h, prefix) || subtle.ConstantTimeCompare([]byte(h[len(prefix):]), []byte(p.token)) != 1 {
+			writeAdminError(w, http.StatusUnauthorized, errors.New("invalid token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleSessions GET /api/sessions?user=xx 列出活跃的会话,user不为空时只列出此用户的会话
+func (p *adminServer) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	user := r.URL.Query().Get("user")
+	sessions := []SessionInfo{}
+	for _, s := range p.server.Sessions() {
+		if user == "" || s.User == user {
+			sessions = append(sessions, s)
+		}
+	}
+	writeAdminJSON(w, sessions)
+}
+
+// handleKill POST /api/sessions/kill?id=1 或 ?user=xx 关闭一个会话或用户的所有会话
+func (p *adminServer) handleKill(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAdminError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	q := r.URL.Query()
+	var killed int
+	switch {
+	case q.Get("id") != "":
+		id, err := strconv.ParseUint(q.Get("id"), 10, 64)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+		if !p.server.KillSession(id) {
+			writeAdminError(w, http.StatusNotFound, errors.New("session not found"))
+			return
+		}
+		killed = 1
+	case q.Get("user") != "":
+		killed = p.server.KillUserSessions(q.Get("user"))
+	default:
+		writeAdminError(w, http.StatusBadRequest, errors.New("id or user required"))
+		return
+	}
+	writeAdminJSON(w, map[string]int{"killed": killed})
+}
+
+func (p *adminServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, p.server.Stats())
+}
+
+// handleRoutes GET /api/routes 各监听路由规则的命中次数
+func (p *adminServer) handleRoutes(w http.ResponseWriter, r *http.Request) {
+	stats := p.server.RouteStats()
+	if stats == nil {
+		stats = []RouteStats{}
+	}
+	writeAdminJSON(w, stats)
+}
+
+// handleLogLevel GET查看日志级别,PUT/POST {"level":"debug"} 修改日志级别
+func (p *adminServer) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var req struct {
+			Level string `json:"level"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+		level, err := logrus.ParseLevel(req.Level)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+		logrus.SetLevel(level)
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	writeAdminJSON(w, map[string]string{"level": logrus.GetLevel().String()})
+}
+
+// handleReload POST /api/reload 通过SetReloadHandler设置的方法获取新配置并热加载
+func (p *adminServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAdminError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	if p.server.reload == nil {
+		writeAdminError(w, http.StatusNotImplemented, errors.New("reload not supported"))
+		return
+	}
+
+	cfg, err := p.server.reload()
+	if err == nil {
+		err = p.server.Reload(*cfg)
+	}
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeAdminJSON(w, map[string]string{"result": "ok"})
+}
+
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.WithError(err).Debug("admin write")
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
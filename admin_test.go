@@ -0,0 +1,141 @@
+package socks5
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func adminRequest(method, url, token, body string, v interface{}) (int, error) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+func TestServer_Admin(t *testing.T) {
+	tcpEcho, _ := startTestEchoServer(t)
+
+	cfg := ServerCfg{
+		TCPListen:   "127.0.0.1:0",
+		UDPListen:   "127.0.0.1:0",
+		UserName:    "0990",
+		Password:    "123456",
+		TCPTimeout:  10,
+		AdminListen: "127.0.0.1:0",
+		AdminToken:  "secret",
+	}
+	ss, err := newServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer ss.close()
+
+	addr := ss.listeners[0].addr().String()
+	api := "http://" + ss.admin.ln.Addr().String() + "/api"
+
+	code, err := adminRequest("GET", api+"/sessions", "wrong", "", nil)
+	if err != nil || code != http.StatusUnauthorized {
+		t.Fatalf("unauthorized request:%d %v", code, err)
+	}
+
+	//没有Bearer前缀的token被拒绝
+	req, _ := http.NewRequest("GET", api+"/sessions", nil)
+	req.Header.Set("Authorization", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("bare token:%d", resp.StatusCode)
+	}
+
+	sc := NewSocks5Client(ClientCfg{ServerAddr: addr, UserName: "0990", Password: "123456"})
+	conn, err := sc.Dial("tcp", tcpEcho)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echoTest(conn, "hello", t)
+
+	//splice转发时流量统计最多延迟spliceActivityInterval
+	var sessions []SessionInfo
+	for i := 0; i < 30; i++ {
+		code, err = adminRequest("GET", api+"/sessions?user=0990", "secret", "", &sessions)
+		if err != nil || code != http.StatusOK {
+			t.Fatalf("list sessions:%d %v", code, err)
+		}
+		if len(sessions) == 1 && sessions[0].BytesUp == 5 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if len(sessions) != 1 || sessions[0].Target != tcpEcho || sessions[0].BytesUp != 5 {
+		t.Fatalf("sessions:%+v", sessions)
+	}
+
+	var killed map[string]int
+	code, err = adminRequest("POST", api+"/sessions/kill?user=0990", "secret", "", &killed)
+	if err != nil || code != http.StatusOK || killed["killed"] != 1 {
+		t.Fatalf("kill:%d %v %v", code, err, killed)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("killed session still open")
+	}
+
+	oldLevel := logrus.GetLevel()
+	defer logrus.SetLevel(oldLevel)
+	var level map[string]string
+	code, err = adminRequest("PUT", api+"/loglevel", "secret", `{"level":"debug"}`, &level)
+	if err != nil || code != http.StatusOK || level["level"] != "debug" || logrus.GetLevel() != logrus.DebugLevel {
+		t.Fatalf("loglevel:%d %v %v", code, err, level)
+	}
+
+	newCfg := cfg
+	newCfg.Password = "654321"
+	ss.SetReloadHandler(func() (*ServerCfg, error) {
+		return &newCfg, nil
+	})
+	code, err = adminRequest("POST", api+"/reload", "secret", "", nil)
+	if err != nil || code != http.StatusOK {
+		t.Fatalf("reload:%d %v", code, err)
+	}
+
+	if _, err := sc.Dial("tcp", tcpEcho); err == nil {
+		t.Fatal("old password accepted after reload")
+	}
+	sc = NewSocks5Client(ClientCfg{ServerAddr: addr, UserName: "0990", Password: "654321"})
+	conn2, err := sc.Dial("tcp", tcpEcho)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoTest(conn2, "hello", t)
+	conn2.Close()
+
+	newCfg.TCPListen = "127.0.0.1:1"
+	code, err = adminRequest("POST", api+"/reload", "secret", "", nil)
+	if err != nil || code != http.StatusInternalServerError {
+		t.Fatalf("reload with changed listen:%d %v", code, err)
+	}
+}
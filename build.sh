@@ -1 +1,2 @@
 go build -o bin/ss5 cmd/server/main.go
+go build -o bin/ss5-local cmd/local/main.go
@@ -3,6 +3,7 @@ package socks5
 import (
 	"fmt"
 	"net"
+	"time"
 )
 
 type socks4Client struct {
@@ -16,21 +17,30 @@ func NewSocks4Client(cfg ClientCfg) *socks4Client {
 }
 
 func (p socks4Client) Dial(network string, addr string) (net.Conn, error) {
+	return p.DialTimeout(network, addr, 0)
+}
+
+func (p socks4Client) DialTimeout(network string, addr string, timeout time.Duration) (net.Conn, error) {
 	if network != "tcp" {
 		return nil, fmt.Errorf("not support network:%s", network)
 	}
 
-	conn, err := net.Dial("tcp", p.cfg.ServerAddr)
+	conn, err := net.DialTimeout("tcp", p.cfg.ServerAddr, timeout)
 	if err != nil {
 		return nil, err
 	}
 
 	tcpConn := conn.(*net.TCPConn)
+	if timeout > 0 {
+		tcpConn.SetDeadline(time.Now().Add(timeout))
+	}
 
 	_, err = p.request(tcpConn, CmdConnect, addr)
 	if err != nil {
+		tcpConn.Close()
 		return nil, err
 	}
+	tcpConn.SetDeadline(time.Time{})
 
 	return tcpConn, nil
 }
@@ -40,6 +50,10 @@ func (p socks4Client) request(conn *net.TCPConn, cmd byte, addr string) (*ReplyS
 	if err != nil {
 		return nil, err
 	}
+	//socks4没有密码,UserName作为UserId发送
+	if len(p.cfg.UserName) > 0 {
+		req.UserId = []byte(p.cfg.UserName)
+	}
 	_, err = conn.Write(req.ToBytes())
 	if err != nil {
 		return nil, err
@@ -50,8 +64,13 @@ func (p socks4Client) request(conn *net.TCPConn, cmd byte, addr string) (*ReplyS
 		return nil, err
 	}
 
-	if reply.CD != RepSocks4Granted {
-		return nil, fmt.Errorf("reply failure:%d", reply.VN)
+	switch reply.CD {
+	case RepSocks4Granted:
+	case RepSocks4Rejected:
+		return nil, &ReplyError{Ver: VerSocks4, Rep: reply.CD}
+	default:
+		//identd和userid校验失败是服务端拒绝了客户端,不是目标的失败
+		return nil, fmt.Errorf("reply failure:%d", reply.CD)
 	}
 
 	return reply, nil
@@ -1,22 +1,39 @@
 package socks5
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"time"
+
+	"github.com/0990/socks5/pkg/mux"
 )
 
 type socks5client struct {
 	cfg ClientCfg
+	mux *muxDialer //cfg.Mux为true时复用到服务端的连接
 
 	handShakeCallback func(cmd byte, reply *Reply)
 }
 
 func NewSocks5Client(cfg ClientCfg) *socks5client {
-	return &socks5client{
+	p := &socks5client{
 		cfg: cfg,
 	}
+	if cfg.Mux {
+		p.mux = &muxDialer{cfg: cfg}
+	}
+	return p
+}
+
+// Close 关闭复用的连接,已经建立的连接结束后才真正关闭,不开启Mux时不做任何事
+func (p *socks5client) Close() error {
+	if p.mux != nil {
+		p.mux.close()
+	}
+	return nil
 }
 
 func (p *socks5client) SetHandShakeCallback(callback func(cmd byte, reply *Reply)) {
@@ -43,30 +60,24 @@ func (p *socks5client) DialTimeout(network, addr string, timeout time.Duration)
 		return nil, err
 	}
 
-	var conn net.Conn
+	conn, err := p.dialServer(timeout)
+	if err != nil {
+		return nil, err
+	}
+	//超时覆盖整个握手,避免服务端接受连接后不应答时一直阻塞
 	if timeout > 0 {
-		c, err := net.DialTimeout("tcp", p.cfg.ServerAddr, timeout)
-		if err != nil {
-			return nil, err
-		}
-		conn = c
-	} else {
-		c, err := net.Dial("tcp", p.cfg.ServerAddr)
-		if err != nil {
-			return nil, err
-		}
-		conn = c
+		conn.SetDeadline(time.Now().Add(timeout))
 	}
 
-	tcpConn := conn.(*net.TCPConn)
-
-	method, err := p.selectAuthMethod(tcpConn)
+	method, err := p.selectAuthMethod(conn)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	err = p.authMethod(tcpConn, method)
+	err = p.authMethod(conn, method)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
@@ -76,31 +87,127 @@ func (p *socks5client) DialTimeout(network, addr string, timeout time.Duration)
 		dstAddr = bRemoteAddr
 	}
 
-	reply, err := p.request(tcpConn, cmd, dstAddr)
+	reply, err := p.request(conn, cmd, dstAddr)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
+	conn.SetDeadline(time.Time{})
 
 	if p.handShakeCallback != nil {
 		p.handShakeCallback(cmd, reply)
 	}
 
 	if cmd == CmdConnect {
-		return tcpConn, nil
+		return conn, nil
 	} else {
 		udpConn, err := net.Dial("udp", reply.Address())
 		if err != nil {
+			conn.Close()
 			return nil, err
 		}
 		return &SocksUDPConn{
-			UDPConn: udpConn.(*net.UDPConn),
-			dstAddr: bRemoteAddr,
-			timeout: time.Duration(p.cfg.UDPTimout) * time.Second,
+			UDPConn:  udpConn.(*net.UDPConn),
+			ctrlConn: conn,
+			dstAddr:  bRemoteAddr,
+			timeout:  time.Duration(p.cfg.UDPTimout) * time.Second,
 		}, nil
 	}
 }
 
-func (p *socks5client) selectAuthMethod(conn *net.TCPConn) (byte, error) {
+// ReplyError 服务端返回的失败应答,服务端本身可用,失败的是请求本身(如目标拒绝连接)
+type ReplyError struct {
+	Ver byte //VerSocks5或VerSocks4
+	Rep byte //服务端的应答码
+}
+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("reply failure:%d", e.Rep)
+}
+
+// dialServer 连接服务端,开启Mux时在复用的连接上打开一个流
+func (p *socks5client) dialServer(timeout time.Duration) (net.Conn, error) {
+	if p.mux != nil {
+		return p.mux.open(timeout)
+	}
+	return dialServer(p.cfg, timeout)
+}
+
+// dialServer 建立到服务端的tcp连接,开启TLS时在其上进行tls握手
+func dialServer(cfg ClientCfg, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", cfg.ServerAddr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.TLS {
+		tlsCfg, err := newClientTLSConfig(cfg)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tls.Client(conn, tlsCfg)
+	}
+	return conn, nil
+}
+
+// muxDialer 复用到服务端的一个连接,每次连接打开一个流,复用的连接断开后下次打开流时重新连接
+type muxDialer struct {
+	cfg ClientCfg
+
+	mu     sync.Mutex
+	sess   *mux.Session
+	closed bool
+}
+
+func (p *muxDialer) open(timeout time.Duration) (net.Conn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, errors.New("client closed")
+	}
+	if p.sess != nil {
+		s, err := p.sess.Open("")
+		if err == nil {
+			return s, nil
+		}
+		p.sess.Close()
+		p.sess = nil
+	}
+
+	conn, err := dialServer(p.cfg, timeout)
+	if err != nil {
+		return nil, err
+	}
+	p.sess = mux.Client(conn, nil)
+	return p.sess.Open("")
+}
+
+// close 不再打开新的流,复用的连接在所有流结束后关闭
+func (p *muxDialer) close() {
+	p.mu.Lock()
+	p.closed = true
+	sess := p.sess
+	p.sess = nil
+	p.mu.Unlock()
+	if sess == nil {
+		return
+	}
+
+	go func() {
+		for sess.NumStreams() > 0 {
+			select {
+			case <-time.After(time.Second):
+			case <-sess.Done():
+				return
+			}
+		}
+		sess.Close()
+	}()
+}
+
+func (p *socks5client) selectAuthMethod(conn net.Conn) (byte, error) {
 	methods := []byte{MethodNone}
 	if p.cfg.UserName != "" && p.cfg.Password != "" {
 		methods = append(methods, MethodUserPass)
@@ -125,7 +232,7 @@ func (p *socks5client) selectAuthMethod(conn *net.TCPConn) (byte, error) {
 	return reply.Method, nil
 }
 
-func (p *socks5client) authMethod(conn *net.TCPConn, method byte) error {
+func (p *socks5client) authMethod(conn net.Conn, method byte) error {
 	switch method {
 	case MethodNone:
 		return nil
@@ -150,7 +257,7 @@ func (p *socks5client) authMethod(conn *net.TCPConn, method byte) error {
 	}
 }
 
-func (p *socks5client) request(conn *net.TCPConn, cmd byte, addrByte AddrByte) (*Reply, error) {
+func (p *socks5client) request(conn net.Conn, cmd byte, addrByte AddrByte) (*Reply, error) {
 	_, err := conn.Write(NewRequest(cmd, addrByte).ToBytes())
 	if err != nil {
 		return nil, err
@@ -166,7 +273,7 @@ func (p *socks5client) request(conn *net.TCPConn, cmd byte, addrByte AddrByte) (
 	}
 
 	if reply.Rep != RepSuccess {
-		return nil, fmt.Errorf("reply failure:%d", reply.Rep)
+		return nil, &ReplyError{Ver: VerSocks5, Rep: reply.Rep}
 	}
 
 	return reply, nil
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/0990/socks5"
+	"github.com/0990/socks5/logconfig"
+	"github.com/sirupsen/logrus"
+)
+
+var confFile = flag.String("c", "ss5-local.json", "config file")
+
+func main() {
+	flag.Parse()
+
+	cfg, err := socks5.ReadLocalCfg(*confFile)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	if len(cfg.LogLevel) == 0 {
+		cfg.LogLevel = socks5.DefaultLogLevel
+	}
+	logLevel, err := logrus.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		logrus.WithError(err).Warn("parseLogLevel fail,set default level:error")
+		logLevel = logrus.ErrorLevel
+	}
+
+	logconfig.InitLogrus("ss5-local", 10, logLevel)
+
+	logrus.Infof("Local Config:%+v", *cfg)
+
+	local, err := socks5.NewLocal(*cfg)
+	if err != nil {
+		logrus.Fatalln(err)
+	}
+	err = local.Run()
+	if err != nil {
+		logrus.Fatalln(err)
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	s := <-c
+	fmt.Println("quit,Got signal:", s)
+	local.Close()
+}
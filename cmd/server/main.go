@@ -44,6 +44,14 @@ func main() {
 	if err != nil {
 		logrus.Fatalln(err)
 	}
+	server.SetReloadHandler(func() (*socks5.ServerCfg, error) {
+		cfg, err := socks5.ReadServerCfg(*confFile)
+		if err != nil {
+			return nil, err
+		}
+		socks5.CheckServerCfgDefault(cfg)
+		return cfg, nil
+	})
 	err = server.Run()
 	if err != nil {
 		logrus.Fatalln(err)
@@ -2,6 +2,7 @@ package socks5
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/sirupsen/logrus"
 	"io/ioutil"
 	"os"
@@ -10,6 +11,7 @@ import (
 const DefaultListenPort = 1080
 const DefaultTcpTimeout = 300
 const DefaultUdpTimeout = 90
+const DefaultConnectTimeout = 3
 const DefaultLogLevel = "error"
 
 var DefaultServerConfig = ServerCfg{
@@ -27,12 +29,254 @@ type ServerCfg struct {
 	TCPListen       string //tcp监听地址
 	UDPListen       string //udp监听地址
 	UDPAdvertisedIP string //udp的广告IP地址,告诉客户端将UDP数据发往这个ip,默认值为udp监听的本地ip地址
+	TCPDisable      bool   //不开启tcp监听,只使用UnixListen或TLSListen时设置
+
+	UDPAdvertise []UDPAdvertiseCfg //按客户端选择udp广告地址,有匹配时优先于UDPAdvertisedIP
+
+	UnixListen     string //unix socket监听路径,为空时不开启
+	UnixListenPerm string //unix socket文件权限,八进制,如"0660"
+
+	TLSListen       string //tls监听地址,为空时不开启,tls握手后与TCPListen的处理相同
+	TLSCertFile     string //服务端证书
+	TLSKeyFile      string //服务端私钥
+	TLSClientCAFile string //不为空时要求客户端出示由此CA签发的证书,证书的CommonName作为已鉴权的用户名
 
 	UserName   string
 	Password   string
 	UDPTimout  int
-	TCPTimeout int
+	TCPTimeout int //tcp空闲超时,两个方向都没有数据超过此时间后断开,秒
 	LogLevel   string
+
+	Protocols []string //允许的协议socks4,socks5,http,为空时全部允许,仅在没有配置Listeners时有效
+	Commands  []string //允许的命令connect,udp,http,为空时全部允许,仅在没有配置Listeners时有效
+	Mux       bool     //监听的连接使用mux协议,仅在没有配置Listeners时有效
+
+	Socks4Auth    string   //socks4鉴权方式,见Socks4Auth*,为空时设置了UserName和Password则禁用socks4,否则不鉴权
+	Socks4UserIds []string //允许的socks4 UserId
+
+	MaxLifetime      int //会话最长持续时间,秒,为0时不限制
+	ConnectTimeout   int //连接目标的超时,秒,默认3
+	HandshakeTimeout int //从建立连接到读取完请求(包括tls握手和鉴权)的超时,秒,为0时不限制
+
+	ListenSocket   SocketCfg //客户端连接的socket选项
+	DialSocket     SocketCfg //连接目标的socket选项
+	UDPReadBuffer  int       //udp中继socket的SO_RCVBUF,字节,为0时使用系统默认值
+	UDPWriteBuffer int       //udp中继socket的SO_SNDBUF,字节
+	UDPWorkers     int       //udp中继的工作协程数,按客户端地址分片,为0时使用CPU数
+
+	AccessLog      string //访问日志文件,每个会话结束时写入一行json,为空时不记录
+	AccessLogMaxMB int    //访问日志单个文件大小,超过后轮转,默认100
+
+	AdminListen string //管理接口http监听地址,为空时不开启
+	AdminToken  string //管理接口的访问令牌,请求头 Authorization: Bearer <token>
+
+	Upstreams      []UpstreamCfg      //路由可以选择的上游代理,所有监听共用
+	UpstreamGroups []UpstreamGroupCfg //上游代理组,路由中与上游代理一样按名称选择
+	GeoIPFile      string             //MaxMind格式的GeoIP国家数据库,路由使用GeoIP条件时需要
+	Routes         []RouteCfg         //路由规则,仅在没有配置Listeners时有效
+
+	TunnelListen string //反向隧道的监听地址,内网实例连接此地址注册,为空时不开启
+	TunnelToken  string //反向隧道的共享密钥,与内网实例的TunnelToken相同
+
+	DNS DNSCfg //内置dns代理,DNS.Listen为空时不开启
+
+	//多个监听,每个监听有独立的协议、鉴权、udp广告地址和规则,有值时忽略上面的监听相关配置
+	Listeners []ListenerCfg
+}
+
+const (
+	NetworkTCP  = "tcp"
+	NetworkUnix = "unix"
+	NetworkTLS  = "tls"
+
+	NetworkTunnel = "tunnel" //连接Listen地址的公网实例并注册,处理经反向隧道转发来的连接
+
+	NetworkRedirect = "redirect" //透明代理,iptables REDIRECT转发来的tcp连接,用SO_ORIGINAL_DST取得原始目标
+	NetworkTProxy   = "tproxy"   //透明代理,iptables TPROXY转发来的tcp连接和udp数据包,需要CAP_NET_ADMIN
+	NetworkForward  = "forward"  //端口转发,连接不经过握手直接连接ForwardTarget
+
+	ProtocolSocks4 = "socks4"
+	ProtocolSocks5 = "socks5"
+	ProtocolHTTP   = "http"
+
+	Socks4AuthNone     = "none"     //不鉴权,设置了用户名密码时也允许socks4
+	Socks4AuthDisabled = "disabled" //禁用socks4
+	Socks4AuthUserId   = "userid"   //UserId需要在Socks4UserIds中
+	Socks4AuthIdentd   = "identd"   //向客户端的identd(RFC 1413)查询连接的用户名,需要与UserId相同,Socks4UserIds不为空时还需要在其中
+)
+
+type ListenerCfg struct {
+	Name      string   //名称,用于日志和统计,默认为Network+Listen
+	Network   string   //tcp,unix,tls,tunnel,redirect,tproxy,forward,默认tcp
+	Listen    string   //监听地址,unix时为socket路径,tunnel时为公网实例的TunnelListen地址
+	Protocols []string //允许的协议socks4,socks5,http,为空时全部允许
+	Commands  []string //允许的命令connect,udp,http(http代理的普通转发),为空时全部允许
+
+	UserName string
+	Password string
+
+	Socks4Auth    string
+	Socks4UserIds []string
+
+	UDPListen       string //不为空时使用独立的udp中继,否则使用ServerCfg中的udp中继
+	UDPAdvertisedIP string
+	UDPAdvertise    []UDPAdvertiseCfg
+
+	UnixListenPerm  string
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSClientCAFile string
+
+	Rules  []RuleCfg  //按顺序匹配,第一条匹配的规则生效,都不匹配时允许
+	Routes []RouteCfg //在Rules允许后按顺序匹配,决定直连、阻止或经上游代理连接,都不匹配时直连
+
+	ListenSocket *SocketCfg //为nil时使用ServerCfg中的配置
+	DialSocket   *SocketCfg
+
+	//超时设置,秒,为0时使用ServerCfg中的配置
+	IdleTimeout      int
+	MaxLifetime      int
+	ConnectTimeout   int
+	HandshakeTimeout int
+
+	ProxyProtocol        bool     //解析负载均衡发来的PROXY协议头部(v1,v2),用其中的源地址作为客户端地址
+	ProxyProtocolTrusted []string //允许发送PROXY头部的来源ip或CIDR,开启ProxyProtocol时必须设置,不信任的来源视为直连
+	ProxyProtocolOut     string   //连接目标后先发送PROXY头部,v1或v2,为空时不发送
+
+	Mux bool //连接使用mux协议复用多个流,每个流按本监听的配置处理,客户端需要开启ClientCfg.Mux
+
+	Tunnel      string //不为空时不在本实例处理连接,而是原样转发给以此名称注册的内网实例
+	TunnelName  string //Network为tunnel时向公网实例注册的名称
+	TunnelToken string //Network为tunnel时与公网实例的共享密钥
+
+	ForwardTarget string //Network为forward时连接的固定目标,host:port
+	ForwardUDP    bool   //Network为forward时同时在Listen地址上把udp转发到ForwardTarget
+}
+
+// DNSCfg 内置dns代理,查询经Outbound转发到Servers,应答按TTL缓存
+type DNSCfg struct {
+	Listen    string   //udp和tcp的监听地址,如127.0.0.1:5353
+	Servers   []string //转发查询的dns服务器ip:port,失败时按顺序尝试下一个,默认8.8.8.8:53
+	Outbound  string   //direct(默认),或上游代理、上游代理组的名称
+	Transport string   //udp(默认)或tcp;经上游代理时udp使用UDP ASSOCIATE,tcp使用经CONNECT的DNS-over-TCP
+	Timeout   int      //每个dns服务器的查询超时,秒,默认5
+	CacheSize int      //缓存的应答数量,默认1024,小于0时不缓存
+	Allow     []string //允许查询的客户端ip或CIDR,为空时只允许本机和局域网地址,其它客户端应答REFUSED
+
+	FakeIPRange   string   //不为空时开启fake-ip,A查询应答此ipv4网段中分配给域名的地址,如198.18.0.0/15
+	FakeIPFile    string   //保存fake-ip映射的文件,重启后继续使用,为空时不保存
+	FakeIPExclude []string //不使用fake-ip正常查询的域名,格式与域名列表文件的行相同
+}
+
+// UDPAdvertiseCfg 一个udp广告地址,用于NAT,docker等不同客户端访问服务端的地址不同的环境
+type UDPAdvertiseCfg struct {
+	IP      string   //告诉客户端将udp数据发往这个ip
+	Clients []string //客户端ip或CIDR,为空时匹配所有客户端
+}
+
+// SocketCfg tcp socket选项,为0时使用系统默认值
+type SocketCfg struct {
+	KeepAlive         int   //keepalive空闲多久后开始探测,秒,为0时使用go的默认值15秒,小于0时关闭keepalive
+	KeepAliveInterval int   //keepalive探测间隔,秒,仅linux
+	KeepAliveCount    int   //keepalive探测失败多少次后断开,仅linux
+	NoDelay           *bool //TCP_NODELAY,默认开启
+	ReadBuffer        int   //SO_RCVBUF,字节
+	WriteBuffer       int   //SO_SNDBUF,字节
+	UserTimeout       int   //TCP_USER_TIMEOUT,发送的数据多久没有确认后断开,毫秒,仅linux
+	FastOpen          bool  //TCP Fast Open,仅linux
+}
+
+// UpstreamCfg 上游代理,ClientCfg中的超时设置不使用
+type UpstreamCfg struct {
+	Name string //在RouteCfg.Outbound中引用的名称
+	Type string //socks5(默认),socks4
+	ClientCfg
+}
+
+// UpstreamGroupCfg 上游代理组,按Strategy排列成员,连接失败时依次尝试下一个成员
+type UpstreamGroupCfg struct {
+	Name      string
+	Upstreams []string //成员,Upstreams中的名称
+	Strategy  string   //round-robin(默认),least-conn,latency,hash-client,hash-target
+
+	HealthCheckTarget   string //健康检查时经成员连接的目标host:port,为空时只检查能否连上成员
+	HealthCheckInterval int    //健康检查间隔,秒,为0时使用默认30秒,小于0时不检查
+}
+
+// RouteCfg 一条路由规则,Clients和Ports都满足且任意一个目标条件满足时匹配,没有目标条件时匹配所有目标
+type RouteCfg struct {
+	Outbound string   //direct,block,Upstreams或UpstreamGroups中的名称
+	Clients  []string //客户端ip或CIDR,为空时匹配所有
+	Ports    []int    //目标端口,为空时匹配所有
+
+	Domains        []string //域名后缀
+	DomainKeywords []string //域名包含的关键字
+	DomainRegexps  []string //域名正则表达式
+	DomainFiles    []string //域名列表文件,每行一个,支持full:,domain:,keyword:,regexp:前缀,没有前缀时为后缀
+	IPs            []string //目标ip或CIDR,目标为域名时解析后匹配
+	GeoIP          []string //目标ip所属国家的ISO代码,如CN,目标为域名时解析后匹配
+}
+
+type RuleCfg struct {
+	Action  string   //allow,deny
+	Clients []string //客户端ip或CIDR,为空时匹配所有
+	Targets []string //目标ip,CIDR或域名后缀,为空时匹配所有
+	Ports   []int    //目标端口,为空时匹配所有
+
+	//匹配此规则的请求使用的超时设置,秒,为0时使用监听的配置
+	IdleTimeout    int
+	MaxLifetime    int
+	ConnectTimeout int
+}
+
+// listenerCfgs 返回所有监听配置,没有配置Listeners时由旧的单监听配置生成
+func (p *ServerCfg) listenerCfgs() []ListenerCfg {
+	if len(p.Listeners) > 0 {
+		return p.Listeners
+	}
+
+	var cfgs []ListenerCfg
+	base := ListenerCfg{
+		UserName:        p.UserName,
+		Password:        p.Password,
+		UDPAdvertisedIP: p.UDPAdvertisedIP,
+		UDPAdvertise:    p.UDPAdvertise,
+		Socks4Auth:      p.Socks4Auth,
+		Socks4UserIds:   p.Socks4UserIds,
+		Protocols:       p.Protocols,
+		Commands:        p.Commands,
+		Mux:             p.Mux,
+		Routes:          p.Routes,
+	}
+
+	if !p.TCPDisable {
+		c := base
+		c.Network = NetworkTCP
+		c.Listen = p.TCPListen
+		if len(c.Listen) == 0 {
+			c.Listen = fmt.Sprintf(":%d", p.ListenPort)
+		}
+		cfgs = append(cfgs, c)
+	}
+
+	if len(p.UnixListen) > 0 {
+		c := base
+		c.Network = NetworkUnix
+		c.Listen = p.UnixListen
+		c.UnixListenPerm = p.UnixListenPerm
+		cfgs = append(cfgs, c)
+	}
+
+	if len(p.TLSListen) > 0 {
+		c := base
+		c.Network = NetworkTLS
+		c.Listen = p.TLSListen
+		c.TLSCertFile = p.TLSCertFile
+		c.TLSKeyFile = p.TLSKeyFile
+		c.TLSClientCAFile = p.TLSClientCAFile
+		cfgs = append(cfgs, c)
+	}
+	return cfgs
 }
 
 func ReadOrCreateServerCfg(path string) (*ServerCfg, error) {
@@ -95,9 +339,18 @@ type ClientCfg struct {
 	Password   string
 	UDPTimout  int
 	TCPTimeout int
+
+	TLS                   bool   //是否使用tls连接服务端
+	TLSServerName         string //校验服务端证书使用的域名,默认为ServerAddr的host
+	TLSCAFile             string //校验服务端证书的CA,默认使用系统CA
+	TLSCertFile           string //客户端证书,服务端开启客户端证书校验时需要
+	TLSKeyFile            string //客户端私钥
+	TLSInsecureSkipVerify bool   //不校验服务端证书
+
+	Mux bool //多个连接复用一个到服务端的tcp或tls连接,服务端的监听需要开启Mux
 }
 
-func ReadClientCfg(path string) (*ServerCfg, error) {
+func ReadClientCfg(path string) (*ClientCfg, error) {
 	_, err := os.Stat(path)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -116,7 +369,7 @@ func ReadClientCfg(path string) (*ServerCfg, error) {
 		return nil, err
 	}
 
-	conf := ServerCfg{}
+	conf := ClientCfg{}
 	err = json.Unmarshal(data, &conf)
 	if err != nil {
 		return nil, err
@@ -136,3 +389,65 @@ func CreateClientCfg(path string) error {
 	c, _ := json.MarshalIndent(cfg, "", "    ")
 	return ioutil.WriteFile(path, c, 0644)
 }
+
+// LocalCfg cmd/local的配置,内嵌的ClientCfg为远端ss5服务的连接配置,只有ClientCfg的配置文件也可以读取
+type LocalCfg struct {
+	ClientCfg
+	LogLevel string
+
+	SocksListen   string //本地socks5/socks4/http代理的监听地址(tcp和udp),所有请求经远端服务转发,为空时不开启
+	SocksUserName string //本地代理的鉴权,为空时不鉴权
+	SocksPassword string
+
+	Forwards []ForwardCfg //端口转发
+}
+
+// ForwardCfg 端口转发,本地监听收到的连接或数据包经远端服务转发给固定的目标
+type ForwardCfg struct {
+	Network string //tcp(默认),udp
+	Listen  string //本地监听地址
+	Target  string //目标host:port,由远端服务连接
+}
+
+// ReadLocalCfg 读取cmd/local的配置,文件不存在时创建默认配置
+func ReadLocalCfg(path string) (*LocalCfg, error) {
+	_, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err := CreateLocalCfg(path)
+			if err != nil {
+				return nil, err
+			}
+			logrus.WithField("path", path).Info("create config file")
+		} else {
+			return nil, err
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := LocalCfg{}
+	err = json.Unmarshal(data, &conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &conf, nil
+}
+
+func CreateLocalCfg(path string) error {
+	cfg := LocalCfg{
+		ClientCfg: ClientCfg{
+			ServerAddr: "127.0.0.1:1080",
+			UDPTimout:  60,
+			TCPTimeout: 60,
+		},
+		LogLevel:    DefaultLogLevel,
+		SocksListen: "127.0.0.1:1081",
+	}
+	c, _ := json.MarshalIndent(cfg, "", "    ")
+	return ioutil.WriteFile(path, c, 0644)
+}
@@ -2,7 +2,10 @@ package socks5
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"net"
+	"time"
 )
 
 const (
@@ -13,23 +16,87 @@ const (
 type ConnCfg struct {
 	UserName   string
 	Password   string
-	TCPTimeout int32
+	TCPTimeout int32 //空闲超时,秒
+
+	Socks4Auth    string //socks4鉴权方式,见Socks4Auth*
+	Socks4UserIds []string
+
+	MaxLifetime      int32 //会话最长持续时间,秒,为0时不限制
+	ConnectTimeout   int32 //连接目标的超时,秒,为0时使用DefaultConnectTimeout
+	HandshakeTimeout int32 //读取完请求前的超时,秒,为0时不限制
 
 	UDPAdvertisedIP   string
 	UDPAdvertisedPort int
+	udpAdvertise      []udpAdvertise //按客户端选择的udp广告地址,优先于UDPAdvertisedIP
+
+	Protocols []string //允许的协议,为空时全部允许
+	Commands  []string //允许的命令,为空时全部允许
+	Rules     *RuleSet //访问规则,为nil时全部允许
+	Routes    *Router  //路由规则,为nil时全部直连
+
+	ProxyProtocolOut string //连接目标后发送PROXY头部,v1或v2,为空时不发送
+
+	DialSocket SocketCfg //连接目标的socket选项
+
+	upstream upstreamDialer //checkRequest匹配的路由选择的上游代理,为nil时直连
+}
+
+// connectTimeout 连接目标和与上游代理握手的超时
+func (p *ConnCfg) connectTimeout() time.Duration {
+	if p.ConnectTimeout <= 0 {
+		return DefaultConnectTimeout * time.Second
+	}
+	return time.Duration(p.ConnectTimeout) * time.Second
+}
+
+// checkRequest 检查访问规则和OnRequest钩子，返回应用了匹配规则中超时设置的配置，
+// 调用前需要用session.setRequest记录请求
+func (p *ConnCfg) checkRequest(session *Session, client net.Addr, target string) (ConnCfg, error) {
+	cfg := *p
+	if r := p.Rules.match(client, target); r != nil {
+		if !r.allow {
+			return cfg, fmt.Errorf("%s:%w", target, ErrRuleDenied)
+		}
+		if r.idleTimeout > 0 {
+			cfg.TCPTimeout = int32(r.idleTimeout)
+		}
+		if r.maxLifetime > 0 {
+			cfg.MaxLifetime = int32(r.maxLifetime)
+			session.setLifetime(time.Duration(r.maxLifetime) * time.Second)
+		}
+		if r.connectTimeout > 0 {
+			cfg.ConnectTimeout = int32(r.connectTimeout)
+		}
+	}
+
+	if r := p.Routes.match(addrIP(client), target, lookupIPs); r != nil {
+		if r.outbound == OutboundBlock {
+			return cfg, fmt.Errorf("%s:blocked by route:%w", target, ErrRuleDenied)
+		}
+		cfg.upstream = r.upstream
+	}
+
+	if err := session.onRequest(); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
 }
 
 type Conn struct {
-	conn Stream
-	cfg  ConnCfg
+	conn     Stream
+	cfg      ConnCfg
+	authUser string
+	session  *Session
+	udpRelay *udpRelay //为nil时不统计udp关联的流量
 
 	customDialTarget func(addr string) (Stream, byte, string, error)
 }
 
 func NewConn(conn Stream, cfg ConnCfg) *Conn {
 	return &Conn{
-		conn: conn,
-		cfg:  cfg,
+		conn:    conn,
+		cfg:     cfg,
+		session: newSession("", conn),
 	}
 }
 
@@ -37,30 +104,92 @@ func (p *Conn) SetCustomDialTarget(f func(addr string) (Stream, byte, string, er
 	p.customDialTarget = f
 }
 
+// SetAuthUser 设置已经通过其它方式(如tls客户端证书)鉴权的用户，设置后不再进行用户名密码鉴权
+func (p *Conn) SetAuthUser(user string) {
+	p.authUser = user
+}
+
+// Session 返回此连接的会话信息
+func (p *Conn) Session() *Session {
+	return p.session
+}
+
 func (p *Conn) Handle() error {
 	defer p.conn.Close()
 
+	if p.authUser != "" {
+		if err := p.session.onAuth(p.authUser, true); err != nil {
+			return fmt.Errorf("%v:%w", err, ErrAuthFailed)
+		}
+		p.session.setUser(p.authUser)
+	}
+
+	//各协议读取完请求后清除
+	if p.cfg.HandshakeTimeout > 0 {
+		p.conn.SetReadDeadline(time.Now().Add(time.Duration(p.cfg.HandshakeTimeout) * time.Second))
+	}
+
 	ver := make([]byte, 1)
 	_, err := io.ReadFull(p.conn, ver)
 	if err != nil {
 		return err
 	}
 
-	switch ver[0] {
-	case VerSocks4:
+	var proto string
+	switch {
+	case ver[0] == VerSocks4:
+		proto = ProtocolSocks4
+	case ver[0] == VerSocks5:
+		proto = ProtocolSocks5
+	case isHTTPMethodStart(ver[0]):
+		proto = ProtocolHTTP
+	default:
+		return errors.New("unsupport socks version")
+	}
+
+	p.session.setProtocol(proto)
+
+	if !enabledIn(p.cfg.Protocols, proto) {
+		p.refuse(proto)
+		return fmt.Errorf("%s:%w", proto, ErrProtocolDisabled)
+	}
+
+	switch proto {
+	case ProtocolSocks4:
 		c := &Socks4Conn{
-			conn: p.conn,
-			cfg:  p.cfg,
+			conn:     p.conn,
+			cfg:      p.cfg,
+			authUser: p.authUser,
+			session:  p.session,
 		}
+		c.SetCustomDialTarget(p.customDialTarget)
 		return c.Handle()
-	case VerSocks5:
+	case ProtocolSocks5:
 		c := &Socks5Conn{
-			conn: p.conn,
-			cfg:  p.cfg,
+			conn:     p.conn,
+			cfg:      p.cfg,
+			authUser: p.authUser,
+			session:  p.session,
+			udpRelay: p.udpRelay,
 		}
 		c.SetCustomDialTarget(p.customDialTarget)
 		return c.Handle()
 	default:
-		return errors.New("unsupport socks version")
+		c := newHTTPConn(p.conn, p.cfg, ver[0])
+		c.authUser = p.authUser
+		c.session = p.session
+		c.SetCustomDialTarget(p.customDialTarget)
+		return c.Handle()
+	}
+}
+
+// refuse socks协议被禁用时按协议回复拒绝,http直接断开
+func (p *Conn) refuse(proto string) {
+	switch proto {
+	case ProtocolSocks4:
+		p.session.setReply(int(RepSocks4Rejected))
+		p.conn.Write(NewReplySocks4(RepSocks4Rejected, nil).ToBytes())
+	case ProtocolSocks5:
+		p.conn.Write(NewMethodSelectReply(MethodNoAcceptable).ToBytes())
 	}
 }
@@ -0,0 +1,319 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// HTTPConn 处理http代理请求，支持CONNECT隧道和绝对URI的普通http转发
+type HTTPConn struct {
+	conn     Stream
+	cfg      ConnCfg
+	reader   *bufio.Reader
+	authUser string
+	session  *Session
+
+	customDialTarget func(addr string) (Stream, byte, string, error)
+}
+
+// first 为Conn.Handle中已经读取的首字节
+func newHTTPConn(conn Stream, cfg ConnCfg, first byte) *HTTPConn {
+	return &HTTPConn{
+		conn:   conn,
+		cfg:    cfg,
+		reader: bufio.NewReader(io.MultiReader(bytes.NewReader([]byte{first}), conn)),
+	}
+}
+
+func (p *HTTPConn) SetCustomDialTarget(f func(addr string) (Stream, byte, string, error)) {
+	p.customDialTarget = f
+}
+
+func (p *HTTPConn) Handle() error {
+	req, err := http.ReadRequest(p.reader)
+	if err != nil {
+		return fmt.Errorf("ReadRequest:%w", err)
+	}
+	p.conn.SetReadDeadline(time.Time{})
+
+	if req.Method == http.MethodConnect {
+		if err := p.checkAuth(req); err != nil {
+			return err
+		}
+		if err := p.checkCommand(CommandConnect, httpTargetAddr(req.Host, "443")); err != nil {
+			return err
+		}
+		return p.handleConnect(req)
+	}
+
+	return p.handleForward(req)
+}
+
+func (p *HTTPConn) checkAuth(req *http.Request) error {
+	if p.cfg.UserName == "" || p.cfg.Password == "" || p.authUser != "" {
+		return nil
+	}
+
+	username, password, ok := parseProxyBasicAuth(req.Header)
+	ok = ok && username == p.cfg.UserName && password == p.cfg.Password
+	herr := p.session.onAuth(username, ok)
+	if ok && herr == nil {
+		p.session.setUser(username)
+		return nil
+	}
+
+	header := http.Header{}
+	header.Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", HTTPProxyRealm))
+	p.writeReply(http.StatusProxyAuthRequired, header)
+	if herr != nil {
+		return fmt.Errorf("%v:%w", herr, ErrAuthFailed)
+	}
+	return ErrAuthFailed
+}
+
+func (p *HTTPConn) handleConnect(req *http.Request) error {
+	addr := httpTargetAddr(req.Host, "443")
+	logrus.Debug("http connect req:", addr)
+	p.session.setRequest(CommandConnect, addr)
+
+	cfg, err := p.cfg.checkRequest(p.session, p.conn.RemoteAddr(), addr)
+	if err != nil {
+		p.writeReply(http.StatusForbidden, nil)
+		return err
+	}
+
+	s, rep, bindAddr, err := dialTarget(&cfg, p.customDialTarget, p.session, addr)
+	if err != nil {
+		p.writeReply(httpStatusFromRep(rep), nil)
+		return fmt.Errorf("failed to dialTarget(%s):%w", addr, err)
+	}
+	defer s.Close()
+	p.session.setTarget(s, bindAddr)
+
+	err = p.writeReply(http.StatusOK, nil)
+	if err != nil {
+		return fmt.Errorf("faied to write reply:%w", err)
+	}
+	p.session.onEstablished()
+
+	timeout := time.Duration(cfg.TCPTimeout) * time.Second
+	return pipe(&bufferedStream{Stream: p.conn, reader: p.reader}, s, timeout, p.session)
+}
+
+// handleForward 转发绝对URI形式的http请求，同一连接上的后续请求目标不变时复用到目标的连接
+func (p *HTTPConn) handleForward(req *http.Request) error {
+	var target Stream
+	var targetAddr string
+	var targetReader *bufio.Reader
+	defer func() {
+		if target != nil {
+			target.Close()
+		}
+	}()
+
+	for {
+		if err := p.checkAuth(req); err != nil {
+			return err
+		}
+
+		if !req.URL.IsAbs() || req.URL.Scheme != "http" {
+			p.writeReply(http.StatusBadRequest, nil)
+			return fmt.Errorf("not a proxy request:%s", req.URL)
+		}
+
+		addr := httpTargetAddr(req.URL.Host, "80")
+		if err := p.checkCommand(CommandHTTP, addr); err != nil {
+			return err
+		}
+		logrus.Debug("http req:", addr)
+		p.session.setRequest(CommandHTTP, addr)
+
+		cfg, err := p.cfg.checkRequest(p.session, p.conn.RemoteAddr(), addr)
+		if err != nil {
+			p.writeReply(http.StatusForbidden, nil)
+			return err
+		}
+
+		if target == nil || addr != targetAddr {
+			if target != nil {
+				target.Close()
+			}
+
+			s, rep, bindAddr, err := dialTarget(&cfg, p.customDialTarget, p.session, addr)
+			if err != nil {
+				target = nil
+				p.writeReply(httpStatusFromRep(rep), nil)
+				return fmt.Errorf("failed to dialTarget(%s):%w", addr, err)
+			}
+			target, targetAddr, targetReader = s, addr, bufio.NewReader(s)
+			p.session.setTarget(s, bindAddr)
+			p.session.onEstablished()
+		}
+
+		upgrade := req.Header.Get("Upgrade")
+		closeAfter := req.Close
+		removeHopHeaders(req.Header)
+		if upgrade != "" {
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", upgrade)
+		}
+
+		//Expect: 100-continue时客户端收到100后才发送body,需要在读取应答的同时写请求
+		written := make(chan error, 1)
+		writeRequest := func() {
+			up := &countWriter{Writer: target}
+			err := req.Write(up)
+			p.session.addUp(up.n)
+			written <- err
+		}
+		expectContinue := strings.EqualFold(req.Header.Get("Expect"), "100-continue")
+		if expectContinue {
+			go writeRequest()
+		} else {
+			writeRequest()
+			if err := <-written; err != nil {
+				return fmt.Errorf("write request:%w", err)
+			}
+		}
+
+		down := &countWriter{Writer: p.conn}
+		timeout := time.Duration(cfg.TCPTimeout) * time.Second
+		var resp *http.Response
+		for {
+			resp, err = readResponse(target, targetReader, req, timeout)
+			if err != nil {
+				p.writeReply(http.StatusBadGateway, nil)
+				return fmt.Errorf("ReadResponse:%w", err)
+			}
+			if resp.StatusCode < 100 || resp.StatusCode >= 200 || resp.StatusCode == http.StatusSwitchingProtocols {
+				break
+			}
+
+			//1xx中间应答转发给客户端后继续读取最终应答
+			err = writeInterimResponse(down, resp)
+			p.session.addDown(down.n)
+			down.n = 0
+			if err != nil {
+				return fmt.Errorf("write response:%w", err)
+			}
+			if expectContinue && resp.StatusCode == http.StatusContinue {
+				if err := <-written; err != nil {
+					return fmt.Errorf("write request:%w", err)
+				}
+				expectContinue = false
+			}
+		}
+		if expectContinue {
+			//没有收到100就有了最终应答,客户端可能不再发送body,请求的结束位置不确定,不再复用连接
+			select {
+			case err := <-written:
+				if err != nil {
+					return fmt.Errorf("write request:%w", err)
+				}
+			default:
+				closeAfter = true
+			}
+		}
+
+		p.session.setReply(resp.StatusCode)
+
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			err := resp.Write(down)
+			p.session.addDown(down.n)
+			if err != nil {
+				return err
+			}
+			return pipe(&bufferedStream{Stream: p.conn, reader: p.reader}, &bufferedStream{Stream: target, reader: targetReader}, timeout, p.session)
+		}
+
+		removeHopHeaders(resp.Header)
+		err = resp.Write(down)
+		p.session.addDown(down.n)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("write response:%w", err)
+		}
+
+		if closeAfter || resp.Close || (resp.ContentLength < 0 && len(resp.TransferEncoding) == 0) {
+			return nil
+		}
+
+		//等待同一连接上的下一个请求,超过空闲超时后断开
+		if cfg.TCPTimeout > 0 {
+			p.conn.SetReadDeadline(time.Now().Add(time.Duration(cfg.TCPTimeout) * time.Second))
+		}
+		req, err = http.ReadRequest(p.reader)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return ErrIdleTimeout
+			}
+			return err
+		}
+		p.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// readResponse 读取目标的应答头,timeout大于0时超过timeout没有应答则返回超时错误
+func readResponse(target Stream, r *bufio.Reader, req *http.Request, timeout time.Duration) (*http.Response, error) {
+	if timeout > 0 {
+		target.SetReadDeadline(time.Now().Add(timeout))
+		defer target.SetReadDeadline(time.Time{})
+	}
+	return http.ReadResponse(r, req)
+}
+
+// writeInterimResponse 转发1xx中间应答,中间应答没有body
+func writeInterimResponse(w io.Writer, resp *http.Response) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "HTTP/%d.%d %s\r\n", resp.ProtoMajor, resp.ProtoMinor, resp.Status)
+	resp.Header.Write(&b)
+	b.WriteString("\r\n")
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// checkCommand 命令被禁用时回复405
+func (p *HTTPConn) checkCommand(cmd string, addr string) error {
+	if enabledIn(p.cfg.Commands, cmd) {
+		return nil
+	}
+	p.session.setRequest(cmd, addr)
+	p.writeReply(http.StatusMethodNotAllowed, nil)
+	return fmt.Errorf("%s:%w", cmd, ErrProtocolDisabled)
+}
+
+func (p *HTTPConn) writeReply(code int, header http.Header) error {
+	p.session.setReply(code)
+	_, err := p.conn.Write(newHTTPReply(code, header))
+	return err
+}
+
+// countWriter 统计写入的字节数
+type countWriter struct {
+	io.Writer
+	n int64
+}
+
+func (p *countWriter) Write(b []byte) (int, error) {
+	n, err := p.Writer.Write(b)
+	p.n += int64(n)
+	return n, err
+}
+
+// bufferedStream 读取时优先读取reader中已缓冲的数据
+type bufferedStream struct {
+	Stream
+	reader *bufio.Reader
+}
+
+func (p *bufferedStream) Read(b []byte) (int, error) {
+	return p.reader.Read(b)
+}
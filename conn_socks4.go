@@ -3,13 +3,20 @@ package socks5
 import (
 	"fmt"
 	"github.com/sirupsen/logrus"
-	"net"
 	"time"
 )
 
 type Socks4Conn struct {
-	conn Stream
-	cfg  ConnCfg
+	conn     Stream
+	cfg      ConnCfg
+	authUser string //tls客户端证书鉴权的用户名,不为空时不再检查UserId
+	session  *Session
+
+	customDialTarget func(addr string) (Stream, byte, string, error)
+}
+
+func (p *Socks4Conn) SetCustomDialTarget(f func(addr string) (Stream, byte, string, error)) {
+	p.customDialTarget = f
 }
 
 func (p *Socks4Conn) Handle() error {
@@ -18,23 +25,87 @@ func (p *Socks4Conn) Handle() error {
 		return fmt.Errorf("failed to readRequest:%w", err)
 	}
 
+	if err := p.checkAuth(req); err != nil {
+		return err
+	}
 	return p.handleRequest(req)
 }
 
+// checkAuth 按Socks4Auth检查UserId,socks4不能传递密码,所以设置了用户名密码时默认禁用
+func (p *Socks4Conn) checkAuth(req *ReqSocks4) error {
+	if p.authUser != "" {
+		return nil
+	}
+
+	userId := string(req.UserId)
+	switch p.cfg.Socks4Auth {
+	case "":
+		if p.cfg.UserName == "" || p.cfg.Password == "" {
+			return nil
+		}
+		p.writeReply(RepSocks4Rejected, nil)
+		return fmt.Errorf("%s without password:%w", ProtocolSocks4, ErrProtocolDisabled)
+	case Socks4AuthDisabled:
+		p.writeReply(RepSocks4Rejected, nil)
+		return fmt.Errorf("%s:%w", ProtocolSocks4, ErrProtocolDisabled)
+	case Socks4AuthUserId:
+		return p.authResult(userId, socks4UserIdAllowed(p.cfg.Socks4UserIds, userId))
+	case Socks4AuthIdentd:
+		ident, err := queryIdentd(p.conn.RemoteAddr(), p.conn.LocalAddr(), identdTimeout)
+		if err != nil {
+			p.session.onAuth(userId, false)
+			p.writeReply(RepSocks4NoIdentd, nil)
+			return fmt.Errorf("identd %v:%w", err, ErrAuthFailed)
+		}
+		ok := ident == userId && (len(p.cfg.Socks4UserIds) == 0 || socks4UserIdAllowed(p.cfg.Socks4UserIds, userId))
+		return p.authResult(userId, ok)
+	default:
+		return nil
+	}
+}
+
+func (p *Socks4Conn) authResult(userId string, ok bool) error {
+	herr := p.session.onAuth(userId, ok)
+	if ok && herr == nil {
+		return nil
+	}
+
+	p.writeReply(RepSocks4InvalidUser, nil)
+	if herr != nil {
+		return fmt.Errorf("%v:%w", herr, ErrAuthFailed)
+	}
+	return ErrAuthFailed
+}
+
+func socks4UserIdAllowed(userIds []string, userId string) bool {
+	for _, id := range userIds {
+		if id == userId {
+			return true
+		}
+	}
+	return false
+}
+
 func (p *Socks4Conn) readRequest() (*ReqSocks4, error) {
 	req, err := NewReqSocks4From(p.conn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to NewReqSocks4From:%w", err)
 	}
+	p.conn.SetReadDeadline(time.Time{})
 	return req, nil
 }
 
 func (p *Socks4Conn) handleRequest(req *ReqSocks4) error {
 	switch req.CD {
 	case CmdConnect:
+		if !enabledIn(p.cfg.Commands, CommandConnect) {
+			p.session.setRequest(CommandConnect, req.Address())
+			p.writeReply(RepSocks4Rejected, nil)
+			return fmt.Errorf("%s:%w", CommandConnect, ErrProtocolDisabled)
+		}
 		return p.handleConnect(req)
 	default:
-		p.conn.Write(NewReplySocks4(RepSocks4Rejected, nil).ToBytes())
+		p.writeReply(RepSocks4Rejected, nil)
 		return ErrCmdNotSupport
 	}
 }
@@ -42,20 +113,37 @@ func (p *Socks4Conn) handleRequest(req *ReqSocks4) error {
 func (p *Socks4Conn) handleConnect(req *ReqSocks4) error {
 	addr := req.Address()
 	logrus.Debug("tcp req:", addr)
-	s, err := net.DialTimeout("tcp", addr, time.Second*10)
+	if len(req.UserId) > 0 && p.authUser == "" {
+		p.session.setUser(string(req.UserId))
+	}
+	p.session.setRequest(CommandConnect, addr)
+
+	cfg, err := p.cfg.checkRequest(p.session, p.conn.RemoteAddr(), addr)
 	if err != nil {
-		p.conn.Write(NewReplySocks4(RepSocks4Rejected, nil).ToBytes())
-		logrus.WithError(err).Debugf("connect to %v failed", req.Address())
-		return nil
+		p.writeReply(RepSocks4Rejected, nil)
+		return err
+	}
+
+	s, _, bindAddr, err := dialTarget(&cfg, p.customDialTarget, p.session, addr)
+	if err != nil {
+		p.writeReply(RepSocks4Rejected, nil)
+		return fmt.Errorf("connect to %v failed:%w", addr, err)
 	}
 	defer s.Close()
+	p.session.setTarget(s, bindAddr)
 
-	_, err = p.conn.Write(NewReplySocks4(RepSocks4Granted, req.PortIPBytes()).ToBytes())
+	err = p.writeReply(RepSocks4Granted, req.PortIPBytes())
 	if err != nil {
 		return fmt.Errorf("reply:%w", err)
 	}
+	p.session.onEstablished()
+
+	timeout := time.Duration(cfg.TCPTimeout) * time.Second
+	return pipe(p.conn, s, timeout, p.session)
+}
 
-	timeout := time.Duration(p.cfg.TCPTimeout) * time.Second
-	Pipe(p.conn, s, timeout)
-	return nil
+func (p *Socks4Conn) writeReply(cd byte, portIp []byte) error {
+	p.session.setReply(int(cd))
+	_, err := p.conn.Write(NewReplySocks4(cd, portIp).ToBytes())
+	return err
 }
@@ -1,11 +1,11 @@
 package socks5
 
 import (
+	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -19,8 +19,11 @@ type Stream interface {
 }
 
 type Socks5Conn struct {
-	conn Stream
-	cfg  ConnCfg
+	conn     Stream
+	cfg      ConnCfg
+	authUser string
+	session  *Session
+	udpRelay *udpRelay
 
 	customDialTarget func(addr string) (Stream, byte, string, error)
 }
@@ -44,6 +47,7 @@ func (p *Socks5Conn) Handle() error {
 	if err != nil {
 		return fmt.Errorf("failed to readRequest:%w", err)
 	}
+	p.conn.SetReadDeadline(time.Time{})
 
 	return p.handleRequest(req)
 }
@@ -59,7 +63,7 @@ func (p *Socks5Conn) selectAuthMethod() (byte, error) {
 	}
 
 	var method byte = MethodNone
-	if p.cfg.UserName != "" && p.cfg.Password != "" {
+	if p.cfg.UserName != "" && p.cfg.Password != "" && p.authUser == "" {
 		method = MethodUserPass
 	}
 
@@ -101,8 +105,11 @@ func (p *Socks5Conn) checkAuthMethod(method byte) error {
 			return ErrAuthUserPassVer
 		}
 
+		ok := string(req.UserName) == p.cfg.UserName && string(req.Password) == p.cfg.Password
+		herr := p.session.onAuth(string(req.UserName), ok)
+
 		var status byte = AuthStatusFailure
-		if string(req.UserName) == p.cfg.UserName && string(req.Password) == p.cfg.Password {
+		if ok && herr == nil {
 			status = AuthStatusSuccess
 		}
 
@@ -111,9 +118,13 @@ func (p *Socks5Conn) checkAuthMethod(method byte) error {
 			return fmt.Errorf("reply:%w", err)
 		}
 
-		if status != AuthStatusSuccess {
+		if !ok {
 			return ErrAuthFailed
 		}
+		if herr != nil {
+			return fmt.Errorf("%v:%w", herr, ErrAuthFailed)
+		}
+		p.session.setUser(string(req.UserName))
 		return nil
 	default:
 		return ErrMethod
@@ -122,28 +133,65 @@ func (p *Socks5Conn) checkAuthMethod(method byte) error {
 
 // TODO suport bind
 func (p *Socks5Conn) handleRequest(req *Request) error {
+	if cmd := socks5Command(req.Cmd); cmd != "" && !enabledIn(p.cfg.Commands, cmd) {
+		p.session.setRequest(cmd, req.Address())
+		p.writeReply(RepCmdNotSupported, nil)
+		return fmt.Errorf("%s:%w", cmd, ErrProtocolDisabled)
+	}
+
 	switch req.Cmd {
 	case CmdConnect:
 		return p.handleConnect(req)
 	case CmdUDP:
 		return p.handleUDP(req)
 	default:
-		p.conn.Write(NewReply(RepCmdNotSupported, nil).ToBytes())
+		p.writeReply(RepCmdNotSupported, nil)
 		return ErrCmdNotSupport
 	}
 }
 
+// socks5Command 返回socks5命令对应的Command*,不支持的命令返回空
+func socks5Command(cmd byte) string {
+	switch cmd {
+	case CmdConnect:
+		return CommandConnect
+	case CmdUDP:
+		return CommandUDP
+	default:
+		return ""
+	}
+}
+
 func (p *Socks5Conn) handleUDP(req *Request) error {
+	p.session.setRequest(CommandUDP, req.Address())
+
+	//udp的访问规则和路由按每个数据包的目标匹配,请求中的地址一般是0.0.0.0:0,不用于匹配
+	cfg := p.cfg
+	cfg.Rules, cfg.Routes = nil, nil
+	if _, err := cfg.checkRequest(p.session, p.conn.RemoteAddr(), req.Address()); err != nil {
+		p.writeReply(RepRuleFailure, nil)
+		return err
+	}
+
 	addrAdv := p.getUDPAdvAddr()
 	bAddr, err := NewAddrByteFromString(addrAdv)
 	if err != nil {
-		p.conn.Write(NewReply(RepServerFailure, nil).ToBytes())
+		p.writeReply(RepServerFailure, nil)
 		return err
 	}
-	_, err = p.conn.Write(NewReply(RepSuccess, bAddr).ToBytes())
+
+	//在应答之前注册关联,客户端收到应答后立即发送的数据包也能对应到会话
+	if p.udpRelay != nil {
+		port := int(binary.BigEndian.Uint16(req.DstPort))
+		a := p.udpRelay.assocs.add(p.session, &p.cfg, p.conn.RemoteAddr(), port)
+		defer p.udpRelay.assocs.del(a)
+	}
+
+	err = p.writeReply(RepSuccess, bAddr)
 	if err != nil {
 		return err
 	}
+	p.session.onEstablished()
 
 	buf := make([]byte, 32)
 	for {
@@ -153,76 +201,84 @@ func (p *Socks5Conn) handleUDP(req *Request) error {
 			return err
 		}
 	}
-
-	return nil
 }
 
+// getUDPAdvAddr 按以下顺序选择告诉客户端的udp中继地址:
+// 匹配客户端的UDPAdvertise,UDPAdvertisedIP,中继只监听一个ip时的监听ip,与客户端地址族相同的tcp本地地址
 func (p *Socks5Conn) getUDPAdvAddr() string {
-	port := p.cfg.UDPAdvertisedPort
+	port := strconv.FormatInt(int64(p.cfg.UDPAdvertisedPort), 10)
 
 	//docker等环境中获取不了本机正确ip,这时需要从事先设置的配置或环境变量中获取
+	if ip := selectUDPAdvertise(p.cfg.udpAdvertise, addrIP(p.conn.RemoteAddr())); ip != nil {
+		return net.JoinHostPort(ip.String(), port)
+	}
 	if len(p.cfg.UDPAdvertisedIP) > 0 {
-		return net.JoinHostPort(p.cfg.UDPAdvertisedIP, strconv.FormatInt(int64(port), 10))
+		return net.JoinHostPort(p.cfg.UDPAdvertisedIP, port)
 	}
 
-	localAddr := p.conn.LocalAddr().(*net.TCPAddr)
-	addr := net.UDPAddr{
-		IP:   localAddr.IP,
-		Zone: localAddr.Zone,
-		Port: port,
+	if p.udpRelay != nil {
+		if ip := p.udpRelay.listenIP(); ip != nil {
+			return net.JoinHostPort(ip.String(), port)
+		}
+	}
+
+	localAddr, ok := p.conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		//unix socket等非tcp连接没有本地ip,客户端一般在本机
+		return net.JoinHostPort("127.0.0.1", port)
 	}
 
+	//双栈监听时ipv4客户端的本地地址是ipv4映射的ipv6地址
+	addr := net.UDPAddr{
+		IP:   normalizeIP(localAddr.IP),
+		Port: p.cfg.UDPAdvertisedPort,
+	}
+	if addr.IP.To4() == nil {
+		addr.Zone = localAddr.Zone
+	}
 	return addr.String()
 }
 
 func (p *Socks5Conn) handleConnect(req *Request) error {
 	addr := req.Address()
 	logrus.Debug("tcp req:", addr)
+	p.session.setRequest(CommandConnect, addr)
+
+	cfg, err := p.cfg.checkRequest(p.session, p.conn.RemoteAddr(), addr)
+	if err != nil {
+		p.writeReply(RepRuleFailure, nil)
+		return err
+	}
 
-	s, rep, bindAddr, err := p.dialTarget(addr)
+	s, rep, bindAddr, err := dialTarget(&cfg, p.customDialTarget, p.session, addr)
 	if err != nil {
-		p.conn.Write(NewReply(rep, nil).ToBytes())
+		p.writeReply(rep, nil)
 		return fmt.Errorf("failed to dialTarget(%s):%w", addr, err)
 	}
 	defer s.Close()
 
 	bAddr, err := NewAddrByteFromString(bindAddr)
 	if err != nil {
-		p.conn.Write(NewReply(RepServerFailure, nil).ToBytes())
+		p.writeReply(RepServerFailure, nil)
 		return fmt.Errorf("NewAddrByteFromString:%w", err)
 	}
 
-	_, err = p.conn.Write(NewReply(RepSuccess, bAddr).ToBytes())
+	p.session.setTarget(s, bindAddr)
+
+	err = p.writeReply(RepSuccess, bAddr)
 	if err != nil {
 		return fmt.Errorf("faied to write reply:%w", err)
 	}
+	p.session.onEstablished()
 
-	timeout := time.Duration(p.cfg.TCPTimeout) * time.Second
-	return Pipe(p.conn, s, timeout)
-}
-
-func (p *Socks5Conn) dialTarget(addr string) (Stream, byte, string, error) {
-	if p.customDialTarget != nil {
-		return p.customDialTarget(addr)
-	}
-
-	return p.defaultDialTarget(addr)
+	timeout := time.Duration(cfg.TCPTimeout) * time.Second
+	return pipe(p.conn, s, timeout, p.session)
 }
 
-func (p *Socks5Conn) defaultDialTarget(addr string) (Stream, byte, string, error) {
-	s, err := net.DialTimeout("tcp", addr, time.Second*3)
-	if err != nil {
-		msg := err.Error()
-		var rep byte = RepHostUnreachable
-		if strings.Contains(msg, "refused") {
-			rep = RepConnectionRefused
-		} else if strings.Contains(msg, "network is unreachable") {
-			rep = RepNetworkUnreachable
-		}
-		return nil, rep, "", err
-	}
-
-	return s, RepSuccess, s.LocalAddr().(*net.TCPAddr).String(), nil
+func (p *Socks5Conn) writeReply(rep byte, addr AddrByte) error {
+	p.session.setReply(int(rep))
+	_, err := p.conn.Write(NewReply(rep, addr).ToBytes())
+	return err
 }
 
 func (p *Socks5Conn) readRequest() (*Request, error) {
@@ -0,0 +1,89 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dialTarget 各协议共用的连接目标流程，custom不为nil时使用custom连接
+func dialTarget(cfg *ConnCfg, custom func(addr string) (Stream, byte, string, error), session *Session, addr string) (Stream, byte, string, error) {
+	var s Stream
+	var rep byte
+	var bindAddr string
+	var err error
+	if custom != nil {
+		s, rep, bindAddr, err = custom(addr)
+	} else {
+		timeout := cfg.connectTimeout()
+		if cfg.upstream != nil {
+			s, rep, bindAddr, err = cfg.upstream.dial(session.client, addr, timeout)
+		} else {
+			s, rep, bindAddr, err = defaultDialTarget(addr, timeout, &cfg.DialSocket)
+		}
+	}
+	if herr := session.onDial(addr, err); herr != nil && err == nil {
+		s.Close()
+		return nil, RepRuleFailure, "", herr
+	}
+	if err != nil {
+		return nil, rep, "", err
+	}
+
+	if cfg.ProxyProtocolOut != "" {
+		h := &ProxyProtoHeader{
+			Version:  cfg.ProxyProtocolOut,
+			SrcAddr:  session.client,
+			DestAddr: s.RemoteAddr(),
+		}
+		if cfg.upstream != nil {
+			h.DestAddr = proxyProtoDest(session.client, addr)
+		}
+		b, err := h.ToBytes()
+		if err == nil {
+			_, err = s.Write(b)
+		}
+		if err != nil {
+			s.Close()
+			return nil, RepServerFailure, "", fmt.Errorf("write proxy protocol header:%w", err)
+		}
+	}
+	return s, RepSuccess, bindAddr, nil
+}
+
+// proxyProtoDest 经上游代理时连接的远端是上游,PROXY头部的目标使用请求的目标地址;
+// 目标是域名时不知道上游解析的ip,使用与客户端地址族相同的未指定地址
+func proxyProtoDest(client net.Addr, addr string) net.Addr {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	port, _ := strconv.Atoi(portStr)
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ip = net.IPv4zero
+		if c := addrIP(client); c != nil && c.To4() == nil {
+			ip = net.IPv6unspecified
+		}
+	}
+	return &net.TCPAddr{IP: ip, Port: port}
+}
+
+// defaultDialTarget 直连目标地址，返回socks5的应答码和本地绑定地址
+func defaultDialTarget(addr string, timeout time.Duration, sock *SocketCfg) (Stream, byte, string, error) {
+	s, err := sock.dial(addr, timeout)
+	if err != nil {
+		msg := err.Error()
+		var rep byte = RepHostUnreachable
+		if strings.Contains(msg, "refused") {
+			rep = RepConnectionRefused
+		} else if strings.Contains(msg, "network is unreachable") {
+			rep = RepNetworkUnreachable
+		}
+		return nil, rep, "", err
+	}
+
+	return s, RepSuccess, s.LocalAddr().(*net.TCPAddr).String(), nil
+}
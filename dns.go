@@ -0,0 +1,487 @@
+package socks5
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DNSTransportUDP = "udp"
+	DNSTransportTCP = "tcp"
+
+	DefaultDNSServer    = "8.8.8.8:53"
+	DefaultDNSTimeout   = 5
+	DefaultDNSCacheSize = 1024
+)
+
+// defaultDNSAllow DNS.Allow为空时允许查询的客户端:本机和局域网地址,避免成为开放的dns解析器
+var defaultDNSAllow = []string{
+	"127.0.0.0/8", "::1/128",
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "169.254.0.0/16",
+	"fc00::/7", "fe80::/10",
+}
+
+// dnsProxy 内置dns代理,udp和tcp监听同一地址,查询经配置的出口转发
+type dnsProxy struct {
+	server *server
+	pc     net.PacketConn
+	ln     net.Listener
+	fakeIP *fakeIPPool //为nil时不使用fake-ip
+
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu   sync.RWMutex
+	conf *dnsConf
+}
+
+// dnsConf 由DNSCfg解析得到的配置,重新加载时整体替换,缓存随之清空
+type dnsConf struct {
+	cfg        DNSCfg
+	servers    []string
+	upstream   upstreamDialer //为nil时直连
+	timeout    time.Duration
+	dialSocket SocketCfg
+	cache      *dnsCache  //为nil时不缓存
+	fakeIPSkip *domainSet //不使用fake-ip的域名
+	allow      []*net.IPNet
+}
+
+func newDNSConf(cfg DNSCfg, scfg *ServerCfg, ups *upstreamSet) (*dnsConf, error) {
+	conf := &dnsConf{
+		cfg:        cfg,
+		servers:    cfg.Servers,
+		timeout:    time.Duration(firstPositive(cfg.Timeout, DefaultDNSTimeout)) * time.Second,
+		dialSocket: scfg.DialSocket,
+	}
+	if len(conf.servers) == 0 {
+		conf.servers = []string{DefaultDNSServer}
+	}
+	for _, s := range conf.servers {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			return nil, fmt.Errorf("dns server %s:%w", s, err)
+		}
+	}
+
+	switch cfg.Transport {
+	case "", DNSTransportUDP, DNSTransportTCP:
+	default:
+		return nil, fmt.Errorf("unknown dns transport %s", cfg.Transport)
+	}
+
+	switch cfg.Outbound {
+	case "", OutboundDirect:
+	default:
+		up, ok := ups.dialers[cfg.Outbound]
+		if !ok {
+			return nil, fmt.Errorf("unknown dns outbound %s", cfg.Outbound)
+		}
+		conf.upstream = up
+	}
+
+	allow := cfg.Allow
+	if len(allow) == 0 {
+		allow = defaultDNSAllow
+	}
+	for _, a := range allow {
+		n, err := parseIPNet(a)
+		if err != nil {
+			return nil, fmt.Errorf("dns Allow %w", err)
+		}
+		conf.allow = append(conf.allow, n)
+	}
+
+	if cfg.CacheSize >= 0 {
+		conf.cache = newDNSCache(firstPositive(cfg.CacheSize, DefaultDNSCacheSize))
+	}
+
+	conf.fakeIPSkip = newDomainSet()
+	for _, d := range cfg.FakeIPExclude {
+		if err := conf.fakeIPSkip.add(d); err != nil {
+			return nil, fmt.Errorf("FakeIPExclude %s:%w", d, err)
+		}
+	}
+	return conf, nil
+}
+
+func newDNSProxy(s *server) (*dnsProxy, error) {
+	conf, err := newDNSConf(s.cfg.DNS, &s.cfg, s.upstreams)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &dnsProxy{server: s, conf: conf, done: make(chan struct{})}
+	if len(s.cfg.DNS.FakeIPRange) > 0 {
+		p.fakeIP, err = newFakeIPPool(s.cfg.DNS.FakeIPRange, s.cfg.DNS.FakeIPFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (p *dnsProxy) setConf(conf *dnsConf) {
+	p.mu.Lock()
+	p.conf = conf
+	p.mu.Unlock()
+}
+
+func (p *dnsProxy) getConf() *dnsConf {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.conf
+}
+
+func (p *dnsProxy) listen() error {
+	var err error
+	p.pc, err = net.ListenPacket("udp", p.conf.cfg.Listen)
+	if err != nil {
+		return err
+	}
+	//udp监听端口为0时tcp使用相同的端口
+	p.ln, err = net.Listen("tcp", p.pc.LocalAddr().String())
+	if err != nil {
+		p.pc.Close()
+		return err
+	}
+	return nil
+}
+
+func (p *dnsProxy) serve() {
+	go (&dns.Server{PacketConn: p.pc, Handler: p}).ActivateAndServe()
+	go (&dns.Server{Listener: p.ln, Handler: p}).ActivateAndServe()
+	if p.fakeIP != nil {
+		go p.fakeIP.run(p.done)
+	}
+}
+
+func (p *dnsProxy) addr() net.Addr {
+	return p.pc.LocalAddr()
+}
+
+func (p *dnsProxy) close() {
+	if p.pc != nil {
+		p.pc.Close()
+	}
+	if p.ln != nil {
+		p.ln.Close()
+	}
+	p.closeOnce.Do(func() {
+		close(p.done)
+		if p.fakeIP != nil {
+			if err := p.fakeIP.save(); err != nil {
+				logrus.WithError(err).Error("save fake ip")
+			}
+		}
+	})
+}
+
+func (p *dnsProxy) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	resp := p.resolve(w.RemoteAddr(), req)
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		size := dns.MinMsgSize
+		if opt := req.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+		resp.Truncate(size)
+	}
+	if err := w.WriteMsg(resp); err != nil {
+		logrus.WithError(err).Debug("dns reply")
+	}
+}
+
+// resolve 返回缓存的应答,没有时经出口查询,失败时返回SERVFAIL,不在Allow中的客户端返回REFUSED
+func (p *dnsProxy) resolve(client net.Addr, req *dns.Msg) *dns.Msg {
+	conf := p.getConf()
+	if !ipNetsContain(conf.allow, addrIP(client)) {
+		logrus.WithField("client", client).Debug("dns query refused")
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeRefused)
+		return m
+	}
+
+	if len(req.Question) != 1 {
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeFormatError)
+		return m
+	}
+
+	if resp := p.fakeIPReply(conf, req); resp != nil {
+		return resp
+	}
+
+	key := dnsCacheKey(req.Question[0])
+	if resp := conf.cache.get(key); resp != nil {
+		resp.Id = req.Id
+		return resp
+	}
+
+	resp, err := conf.exchange(client, req)
+	if err != nil {
+		logrus.WithError(err).Debug("dns query:", req.Question[0].Name)
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeServerFailure)
+		return m
+	}
+	conf.cache.put(key, resp)
+	return resp
+}
+
+// fakeIPReply 开启fake-ip时A查询应答分配给域名的地址,AAAA查询应答为空以便客户端使用ipv4,
+// 其它查询和排除的域名返回nil
+func (p *dnsProxy) fakeIPReply(conf *dnsConf, req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	if p.fakeIP == nil || q.Qclass != dns.ClassINET || q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+		return nil
+	}
+	domain := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+	if len(domain) == 0 || conf.fakeIPSkip.match(domain) {
+		return nil
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.RecursionAvailable = true
+	if q.Qtype == dns.TypeA {
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: fakeIPTTL},
+			A:   p.fakeIP.lookup(domain),
+		})
+	}
+	return m
+}
+
+// exchange 按顺序向dns服务器查询,返回第一个成功的应答。udp应答被截断时用tcp重新查询
+func (p *dnsConf) exchange(client net.Addr, req *dns.Msg) (*dns.Msg, error) {
+	var err error
+	for _, server := range p.servers {
+		var resp *dns.Msg
+		if p.cfg.Transport == DNSTransportTCP {
+			resp, err = p.exchangeTCP(client, server, req)
+		} else {
+			resp, err = p.exchangeUDP(client, server, req)
+			if err == nil && resp.Truncated {
+				resp, err = p.exchangeTCP(client, server, req)
+			}
+		}
+		if err == nil {
+			return resp, nil
+		}
+		err = fmt.Errorf("dns server %s:%w", server, err)
+	}
+	return nil, err
+}
+
+// exchangeUDP 直连或经上游代理的udp关联查询,每次查询使用新的socket
+func (p *dnsConf) exchangeUDP(client net.Addr, server string, req *dns.Msg) (*dns.Msg, error) {
+	b, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	if p.upstream != nil {
+		addr, err := NewAddrByteFromString(server)
+		if err != nil {
+			return nil, err
+		}
+		ctrl, uc, err := p.upstream.associate(client, server, p.timeout)
+		if err != nil {
+			return nil, err
+		}
+		defer ctrl.Close()
+		conn = uc
+		b = NewUDPDatagram(addr, b).ToBytes()
+	} else {
+		conn, err = net.DialTimeout("udp", server, p.timeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(p.timeout))
+	if _, err := conn.Write(b); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, MaxSegmentSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		data := buf[:n]
+		if p.upstream != nil {
+			d, err := NewUDPDatagramFromBytes(data)
+			if err != nil || d.Frag != 0 {
+				continue
+			}
+			data = d.Data
+		}
+		resp := new(dns.Msg)
+		if err := resp.Unpack(data); err != nil || resp.Id != req.Id {
+			continue
+		}
+		return resp, nil
+	}
+}
+
+// exchangeTCP 直连或经上游代理的CONNECT隧道进行DNS-over-TCP查询
+func (p *dnsConf) exchangeTCP(client net.Addr, server string, req *dns.Msg) (*dns.Msg, error) {
+	b, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var s Stream
+	if p.upstream != nil {
+		s, _, _, err = p.upstream.dial(client, server, p.timeout)
+	} else {
+		s, err = p.dialSocket.dial(server, p.timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	//tcp上的dns消息前有2字节的长度
+	msg := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(msg, uint16(len(b)))
+	copy(msg[2:], b)
+	s.SetReadDeadline(time.Now().Add(p.timeout))
+	if _, err := s.Write(msg); err != nil {
+		return nil, err
+	}
+
+	var l [2]byte
+	if _, err := io.ReadFull(s, l[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(s, buf); err != nil {
+		return nil, err
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(buf); err != nil {
+		return nil, err
+	}
+	if resp.Id != req.Id {
+		return nil, errors.New("dns id mismatch")
+	}
+	return resp, nil
+}
+
+func dnsCacheKey(q dns.Question) string {
+	return fmt.Sprintf("%s/%d/%d", strings.ToLower(q.Name), q.Qtype, q.Qclass)
+}
+
+// dnsCache 按问题缓存dns应答,到期后删除,超过容量时淘汰最久未使用的
+type dnsCache struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type dnsCacheEntry struct {
+	key    string
+	msg    *dns.Msg
+	stored time.Time
+	expire time.Time
+}
+
+func newDNSCache(size int) *dnsCache {
+	return &dnsCache{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// get 返回应答的副本,TTL减去已缓存的时间,没有或已过期时返回nil
+func (p *dnsCache) get(key string) *dns.Msg {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	el := p.items[key]
+	if el == nil {
+		return nil
+	}
+	e := el.Value.(*dnsCacheEntry)
+	now := time.Now()
+	if !now.Before(e.expire) {
+		p.ll.Remove(el)
+		delete(p.items, key)
+		return nil
+	}
+	p.ll.MoveToFront(el)
+
+	msg := e.msg.Copy()
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrs {
+			if h := rr.Header(); h.Rrtype != dns.TypeOPT {
+				h.Ttl -= elapsed
+			}
+		}
+	}
+	return msg
+}
+
+// put 缓存成功或NXDOMAIN的应答的副本,有效期为记录中最小的TTL
+func (p *dnsCache) put(key string, msg *dns.Msg) {
+	if p == nil {
+		return
+	}
+	ttl := dnsMsgTTL(msg)
+	if ttl == 0 {
+		return
+	}
+
+	now := time.Now()
+	e := &dnsCacheEntry{key: key, msg: msg.Copy(), stored: now, expire: now.Add(time.Duration(ttl) * time.Second)}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if el := p.items[key]; el != nil {
+		el.Value = e
+		p.ll.MoveToFront(el)
+		return
+	}
+	p.items[key] = p.ll.PushFront(e)
+	for p.ll.Len() > p.size {
+		el := p.ll.Back()
+		p.ll.Remove(el)
+		delete(p.items, el.Value.(*dnsCacheEntry).key)
+	}
+}
+
+// dnsMsgTTL 返回应答可缓存的秒数,为0时不缓存
+func dnsMsgTTL(msg *dns.Msg) uint32 {
+	if msg.Truncated || msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+		return 0
+	}
+	var ttl uint32
+	found := false
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns} {
+		for _, rr := range rrs {
+			if t := rr.Header().Ttl; !found || t < ttl {
+				ttl, found = t, true
+			}
+		}
+	}
+	return ttl
+}
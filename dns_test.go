@@ -0,0 +1,160 @@
+package socks5
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// startTestDNSServer 启动udp和tcp上的dns服务器,所有A查询应答1.2.3.4,
+// tc.example.的udp应答被截断,返回地址和查询次数
+func startTestDNSServer(t *testing.T) (string, *int64) {
+	var queries int64
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt64(&queries, 1)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		q := req.Question[0]
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok && q.Name == "tc.example." {
+			m.Truncated = true
+		} else {
+			rr, _ := dns.NewRR(q.Name + " 60 IN A 1.2.3.4")
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go (&dns.Server{PacketConn: pc, Handler: handler}).ActivateAndServe()
+	go (&dns.Server{Listener: ln, Handler: handler}).ActivateAndServe()
+	return pc.LocalAddr().String(), &queries
+}
+
+func dnsQuery(t *testing.T, network, addr, name string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeA)
+	resp, _, err := (&dns.Client{Net: network}).Exchange(m, addr)
+	if err != nil {
+		t.Fatal(network, name, err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "1.2.3.4" {
+		t.Fatalf("%s %s:%v", network, name, resp)
+	}
+	return resp
+}
+
+func TestServer_DNS(t *testing.T) {
+	dnsAddr, queries := startTestDNSServer(t)
+
+	upstream, err := newServer(ServerCfg{
+		UDPListen: "127.0.0.1:0",
+		UDPTimout: 5,
+		Listeners: []ListenerCfg{{Listen: "127.0.0.1:0"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := upstream.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.close()
+
+	cfg := ServerCfg{
+		UDPListen: "127.0.0.1:0",
+		Upstreams: []UpstreamCfg{{Name: "up", ClientCfg: ClientCfg{ServerAddr: upstream.listeners[0].addr().String()}}},
+		Listeners: []ListenerCfg{{Listen: "127.0.0.1:0"}},
+		DNS:       DNSCfg{Listen: "127.0.0.1:0", Servers: []string{"127.0.0.1:1", dnsAddr}, Timeout: 1},
+	}
+	s, err := newServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	addr := s.dns.addr().String()
+
+	//第一个服务器不可用时查询下一个,第二次查询使用缓存
+	dnsQuery(t, "udp", addr, "a.example.")
+	dnsQuery(t, "tcp", addr, "A.example.")
+	if n := atomic.LoadInt64(queries); n != 1 {
+		t.Fatalf("queries:%d", n)
+	}
+
+	//udp应答被截断时用tcp重新查询
+	dnsQuery(t, "udp", addr, "tc.example.")
+
+	cfg.DNS.Outbound = "up"
+	cfg.DNS.Servers = []string{dnsAddr}
+	for i, transport := range []string{DNSTransportUDP, DNSTransportTCP} {
+		cfg.DNS.Transport = transport
+		if err := s.Reload(cfg); err != nil {
+			t.Fatal(err)
+		}
+		dnsQuery(t, "udp", addr, transport+".example.")
+		if n := upstream.Stats()[0].Accepted; n != int64(i+1) {
+			t.Fatalf("%s upstream accepted:%d", transport, n)
+		}
+	}
+
+	//不在Allow中的客户端被拒绝
+	cfg.DNS.Allow = []string{"10.0.0.0/8"}
+	if err := s.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	m := new(dns.Msg)
+	m.SetQuestion("refused.example.", dns.TypeA)
+	resp, _, err := (&dns.Client{Net: "udp"}).Exchange(m, addr)
+	if err != nil || resp.Rcode != dns.RcodeRefused {
+		t.Fatalf("expect refused:%v %v", resp, err)
+	}
+
+	cfg.DNS.Allow = []string{"bad"}
+	if err := s.Reload(cfg); err == nil {
+		t.Fatal("expect invalid Allow error")
+	}
+	cfg.DNS.Allow = nil
+
+	cfg.DNS.Outbound = "missing"
+	if err := s.Reload(cfg); err == nil {
+		t.Fatal("expect unknown outbound error")
+	}
+}
+
+func TestDNSCache(t *testing.T) {
+	c := newDNSCache(2)
+	for _, name := range []string{"a.", "b.", "c."} {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		rr, _ := dns.NewRR(name + " 60 IN A 1.2.3.4")
+		m.Answer = append(m.Answer, rr)
+		c.put(name, m)
+	}
+	if c.get("a.") != nil || c.get("c.") == nil {
+		t.Fatal("expect a. evicted")
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("d.", dns.TypeA)
+	m.Rcode = dns.RcodeServerFailure
+	c.put("d.", m)
+	if c.get("d.") != nil {
+		t.Fatal("expect SERVFAIL not cached")
+	}
+
+	var nilCache *dnsCache
+	nilCache.put("a.", m)
+	if nilCache.get("a.") != nil {
+		t.Fatal("expect nil cache")
+	}
+}
@@ -0,0 +1,242 @@
+package socks5
+
+import (
+	"container/list"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var errFakeIPNotMapped = errors.New("fake ip not mapped")
+
+// fakeIPTTL fake-ip应答的TTL,秒,较短以便映射被淘汰后客户端重新查询
+const fakeIPTTL = 1
+
+// fakeIPSaveInterval 映射有变化时保存到文件的间隔
+const fakeIPSaveInterval = time.Minute
+
+// fakeIPPool 从保留网段分配给域名的地址,按最近使用排序,地址用完时把最久未使用的地址分配给新的域名
+type fakeIPPool struct {
+	file string //为空时不保存
+	base uint32 //网段中第一个可分配的地址
+	size uint32 //可分配的地址数
+
+	saveMu sync.Mutex //定时保存和关闭时的保存不同时写文件
+
+	mu       sync.Mutex
+	next     uint32     //还未分配过的下一个地址的偏移
+	ll       *list.List //*fakeIPEntry,最近使用的在前
+	byDomain map[string]*list.Element
+	byIP     map[uint32]*list.Element
+	dirty    bool
+}
+
+type fakeIPEntry struct {
+	domain string
+	ip     uint32
+}
+
+// fakeIPRecord 保存到文件的一条映射,文件中按最近使用排序
+type fakeIPRecord struct {
+	Domain string
+	IP     string
+}
+
+func newFakeIPPool(cidr string, file string) (*fakeIPPool, error) {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := n.Mask.Size()
+	if bits != 8*net.IPv4len || ones > 30 {
+		return nil, fmt.Errorf("FakeIPRange %s:must be an ipv4 network of at least 4 addresses", cidr)
+	}
+
+	p := &fakeIPPool{
+		file:     file,
+		base:     binary.BigEndian.Uint32(n.IP.To4()) + 1,
+		size:     1<<uint(bits-ones) - 2, //不使用网络地址和广播地址
+		ll:       list.New(),
+		byDomain: make(map[string]*list.Element),
+		byIP:     make(map[uint32]*list.Element),
+	}
+	if len(file) > 0 {
+		if err := p.load(); err != nil {
+			return nil, fmt.Errorf("FakeIPFile %s:%w", file, err)
+		}
+	}
+	return p, nil
+}
+
+// load 读取保存的映射,跳过不在网段中的地址,文件不存在时不报错
+func (p *fakeIPPool) load() error {
+	b, err := ioutil.ReadFile(p.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var records []fakeIPRecord
+	if err := json.Unmarshal(b, &records); err != nil {
+		return err
+	}
+
+	for _, r := range records {
+		off, ok := p.offset(net.ParseIP(r.IP))
+		if !ok || len(r.Domain) == 0 || p.byDomain[r.Domain] != nil || p.byIP[p.base+off] != nil {
+			continue
+		}
+		el := p.ll.PushBack(&fakeIPEntry{domain: r.Domain, ip: p.base + off})
+		p.byDomain[r.Domain] = el
+		p.byIP[p.base+off] = el
+		if off >= p.next {
+			p.next = off + 1
+		}
+	}
+	return nil
+}
+
+// save 有变化时把映射写入文件,先写临时文件再改名
+func (p *fakeIPPool) save() error {
+	if len(p.file) == 0 {
+		return nil
+	}
+	p.saveMu.Lock()
+	defer p.saveMu.Unlock()
+
+	p.mu.Lock()
+	if !p.dirty {
+		p.mu.Unlock()
+		return nil
+	}
+	records := make([]fakeIPRecord, 0, p.ll.Len())
+	for el := p.ll.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*fakeIPEntry)
+		records = append(records, fakeIPRecord{Domain: e.domain, IP: uint32ToIP(e.ip).String()})
+	}
+	p.dirty = false
+	p.mu.Unlock()
+
+	b, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	tmp := p.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.file)
+}
+
+// run 定时保存映射,直到done关闭
+func (p *fakeIPPool) run(done chan struct{}) {
+	t := time.NewTicker(fakeIPSaveInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := p.save(); err != nil {
+				logrus.WithError(err).Error("save fake ip")
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// lookup 返回分配给域名的地址,没有时分配新的地址
+func (p *fakeIPPool) lookup(domain string) net.IP {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.dirty = true
+	if el := p.byDomain[domain]; el != nil {
+		p.ll.MoveToFront(el)
+		return uint32ToIP(el.Value.(*fakeIPEntry).ip)
+	}
+
+	var el *list.Element
+	if p.next < p.size {
+		e := &fakeIPEntry{ip: p.base + p.next}
+		p.next++
+		el = p.ll.PushFront(e)
+		p.byIP[e.ip] = el
+	} else {
+		el = p.ll.Back()
+		delete(p.byDomain, el.Value.(*fakeIPEntry).domain)
+		p.ll.MoveToFront(el)
+	}
+	e := el.Value.(*fakeIPEntry)
+	e.domain = domain
+	p.byDomain[domain] = el
+	return uint32ToIP(e.ip)
+}
+
+// domain 返回地址映射的域名,不在网段中时ok为false,在网段中但没有映射时domain为空
+func (p *fakeIPPool) domain(ip net.IP) (domain string, ok bool) {
+	off, ok := p.offset(ip)
+	if !ok {
+		return "", false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	el := p.byIP[p.base+off]
+	if el == nil {
+		return "", true
+	}
+	p.ll.MoveToFront(el)
+	p.dirty = true
+	return el.Value.(*fakeIPEntry).domain, true
+}
+
+// offset 返回ip在可分配地址中的偏移
+func (p *fakeIPPool) offset(ip net.IP) (uint32, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint32(ip4)
+	if v < p.base || v-p.base >= p.size {
+		return 0, false
+	}
+	return v - p.base, true
+}
+
+func uint32ToIP(v uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, v)
+	return ip
+}
+
+// resolveFakeIP 目标为fake-ip时换成映射的域名,以便按域名路由和连接,映射已被淘汰时返回错误
+func (p *server) resolveFakeIP(target string) (string, error) {
+	if p.dns == nil || p.dns.fakeIP == nil {
+		return target, nil
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return target, nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return target, nil
+	}
+	domain, ok := p.dns.fakeIP.domain(ip)
+	if !ok {
+		return target, nil
+	}
+	if len(domain) == 0 {
+		return "", fmt.Errorf("%s:%w", target, errFakeIPNotMapped)
+	}
+	return net.JoinHostPort(domain, port), nil
+}
@@ -0,0 +1,165 @@
+package socks5
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestFakeIPPool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ss5fakeip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "fakeip.json")
+
+	//两个可分配的地址198.18.0.1和198.18.0.2
+	pool, err := newFakeIPPool("198.18.0.0/30", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := pool.lookup("a.com"), pool.lookup("b.com")
+	if a.String() != "198.18.0.1" || b.String() != "198.18.0.2" || !pool.lookup("a.com").Equal(a) {
+		t.Fatal(a, b)
+	}
+
+	//a.com最近使用过,c.com分配到最久未使用的b.com的地址
+	if d, _ := pool.domain(a); d != "a.com" {
+		t.Fatal(d)
+	}
+	if c := pool.lookup("c.com"); !c.Equal(b) {
+		t.Fatal(c)
+	}
+	if d, ok := pool.domain(net.ParseIP("198.18.0.3")); ok || d != "" {
+		t.Fatal("broadcast address allocated")
+	}
+
+	if err := pool.save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := newFakeIPPool("198.18.0.0/30", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := loaded.domain(b); d != "c.com" {
+		t.Fatal(d)
+	}
+	if ip := loaded.lookup("d.com"); !ip.Equal(a) {
+		t.Fatalf("expect a.com evicted:%v", ip)
+	}
+
+	//网段改变后不在网段中的映射被丢弃
+	moved, err := newFakeIPPool("198.19.0.0/24", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.ll.Len() != 0 || moved.lookup("a.com").String() != "198.19.0.1" {
+		t.Fatal("expect mappings dropped")
+	}
+
+	if _, err := newFakeIPPool("fd00::/64", ""); err == nil {
+		t.Fatal("expect ipv6 range error")
+	}
+}
+
+func TestServer_FakeIP(t *testing.T) {
+	tcpEcho, _ := startTestEchoServer(t)
+	dnsAddr, _ := startTestDNSServer(t)
+	_, port, _ := net.SplitHostPort(tcpEcho)
+
+	dir, err := ioutil.TempDir("", "ss5fakeip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "fakeip.json")
+
+	//REDIRECT的原始目标为本地地址的端口对应的fake-ip
+	fakeIP := make(chan net.IP, 1)
+	lookupOriginalDst = func(conn net.Conn) (*net.TCPAddr, error) {
+		p, _ := net.LookupPort("tcp", port)
+		return &net.TCPAddr{IP: <-fakeIP, Port: p}, nil
+	}
+	defer func() {
+		lookupOriginalDst = originalDst
+	}()
+
+	s, err := newServer(ServerCfg{
+		UDPListen: "127.0.0.1:0",
+		Listeners: []ListenerCfg{{Network: NetworkRedirect, Listen: "127.0.0.1:0"}},
+		DNS: DNSCfg{
+			Listen:        "127.0.0.1:0",
+			Servers:       []string{dnsAddr},
+			FakeIPRange:   "198.18.0.0/15",
+			FakeIPFile:    file,
+			FakeIPExclude: []string{"example.org"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	addr := s.dns.addr().String()
+
+	//排除的域名正常查询
+	dnsQuery(t, "udp", addr, "www.example.org.")
+
+	m := new(dns.Msg)
+	m.SetQuestion("localhost.", dns.TypeA)
+	resp, _, err := new(dns.Client).Exchange(m, addr)
+	if err != nil || len(resp.Answer) != 1 {
+		t.Fatal(resp, err)
+	}
+	ip := resp.Answer[0].(*dns.A).A
+	if ip.String() != "198.18.0.1" || resp.Answer[0].Header().Ttl != fakeIPTTL {
+		t.Fatal(resp)
+	}
+
+	m.SetQuestion("localhost.", dns.TypeAAAA)
+	resp, _, err = new(dns.Client).Exchange(m, addr)
+	if err != nil || resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+		t.Fatal("expect empty AAAA", resp, err)
+	}
+
+	//连接fake-ip时按域名连接
+	fakeIP <- ip
+	conn, err := net.Dial("tcp", s.listeners[0].addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echoTest(conn, "fake ip", t)
+	sessions := s.Sessions()
+	if len(sessions) != 1 || sessions[0].Target != "localhost:"+port {
+		t.Fatalf("sessions:%+v", sessions)
+	}
+
+	//没有映射的fake-ip不能连接
+	fakeIP <- net.ParseIP("198.18.0.2")
+	c, err := net.Dial("tcp", s.listeners[0].addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expect unmapped fake ip closed")
+	}
+
+	//关闭时保存映射
+	s.close()
+	b, err := ioutil.ReadFile(file)
+	if err != nil || !strings.Contains(string(b), "localhost") {
+		t.Fatal(string(b), err)
+	}
+}
@@ -0,0 +1,416 @@
+package socks5
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// udpFlowQueueLen 每个udp流等待发往目标的数据包数量,满时丢弃
+const udpFlowQueueLen = 64
+
+// udpFlowFailedSize 记住的建立失败的流数量,超过后清空
+const udpFlowFailedSize = 1024
+
+// isForward 是否为不经过握手直接连接目标的监听,包括透明代理和端口转发
+func isForward(network string) bool {
+	return network == NetworkForward || isTransparent(network)
+}
+
+// forwardConn 透明代理或端口转发的一个tcp连接,target为原始目标或固定的转发目标
+type forwardConn struct {
+	conn    net.Conn
+	cfg     ConnCfg
+	session *Session
+	proto   string
+	target  string
+}
+
+func (p *forwardConn) Handle() error {
+	defer p.conn.Close()
+
+	p.session.setProtocol(p.proto)
+	p.session.setRequest(CommandConnect, p.target)
+	logrus.Debug(p.proto, " req:", p.target)
+	if !enabledIn(p.cfg.Commands, CommandConnect) {
+		return fmt.Errorf("%s:%w", CommandConnect, ErrProtocolDisabled)
+	}
+
+	cfg, err := p.cfg.checkRequest(p.session, p.conn.RemoteAddr(), p.target)
+	if err != nil {
+		return err
+	}
+
+	s, rep, bindAddr, err := dialTarget(&cfg, nil, p.session, p.target)
+	p.session.setReply(int(rep))
+	if err != nil {
+		return fmt.Errorf("connect to %v failed:%w", p.target, err)
+	}
+	defer s.Close()
+	p.session.setTarget(s, bindAddr)
+	p.session.onEstablished()
+
+	timeout := time.Duration(cfg.TCPTimeout) * time.Second
+	return pipe(p.conn, s, timeout, p.session)
+}
+
+// serveForward 处理透明代理和端口转发的连接,不经过握手直接连接目标
+func (p *listener) serveForward(conn net.Conn, conf *listenerConf) {
+	target := conf.cfg.ForwardTarget
+	if isTransparent(p.cfg.Network) {
+		var err error
+		if target, err = p.transparentTarget(conn); err == nil {
+			target, err = p.server.resolveFakeIP(target)
+		}
+		if err != nil {
+			conn.Close()
+			logrus.WithError(err).WithField("listener", p.name).Debug("transparent conn")
+			return
+		}
+	}
+
+	c := &forwardConn{
+		conn:    conn,
+		cfg:     p.connCfg(conf),
+		session: p.newSession(newSession(p.name, conn), conf),
+		proto:   p.cfg.Network,
+		target:  target,
+	}
+	p.runSession(c.session, conn, c.Handle)
+}
+
+// udpFlowRelay 按客户端地址和目标区分udp流的中继,每个流作为一个会话统计。
+// tproxy时目标为数据包的原始目标(fake-ip换成域名),端口转发时为固定的转发目标
+type udpFlowRelay struct {
+	listener    *listener
+	conn        *net.UDPConn
+	transparent bool
+	timeout     time.Duration
+
+	mu     sync.Mutex
+	flows  map[udpFlowKey]*udpFlow
+	failed map[udpFlowKey]time.Time //被拒绝或连接失败的流,到期前丢弃其数据包,不再创建会话
+	closed bool
+}
+
+type udpFlowKey struct {
+	client string
+	target string
+}
+
+func listenUDPFlowRelay(l *listener, addr string) (*udpFlowRelay, error) {
+	p := &udpFlowRelay{
+		listener:    l,
+		transparent: l.cfg.Network == NetworkTProxy,
+		flows:       make(map[udpFlowKey]*udpFlow),
+		failed:      make(map[udpFlowKey]time.Time),
+	}
+
+	var err error
+	if p.transparent {
+		p.conn, err = listenTransparentUDP(addr)
+	} else {
+		var uaddr *net.UDPAddr
+		if uaddr, err = net.ResolveUDPAddr("udp", addr); err == nil {
+			p.conn, err = net.ListenUDP("udp", uaddr)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	p.timeout = time.Duration(l.server.cfg.UDPTimout) * time.Second
+	if p.timeout <= 0 {
+		p.timeout = DefaultUdpTimeout * time.Second
+	}
+	return p, nil
+}
+
+func (p *udpFlowRelay) close() {
+	p.mu.Lock()
+	p.closed = true
+	flows := p.flows
+	p.flows = nil
+	p.mu.Unlock()
+
+	p.conn.Close()
+	for _, f := range flows {
+		f.Close()
+	}
+}
+
+func (p *udpFlowRelay) run() {
+	buf := make([]byte, MaxSegmentSize)
+	oob := make([]byte, 128)
+	for {
+		n, oobn, _, client, err := p.conn.ReadMsgUDP(buf, oob)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+
+		var origDst *net.UDPAddr
+		var target string
+		if p.transparent {
+			origDst, err = readOrigDst(oob[:oobn])
+			if err != nil {
+				logrus.WithError(err).WithField("listener", p.listener.name).Debug("tproxy udp")
+				continue
+			}
+			if isListenAddr(origDst, p.conn.LocalAddr()) {
+				continue
+			}
+			target, err = p.listener.server.resolveFakeIP(origDst.String())
+			if err != nil {
+				logrus.WithError(err).WithField("listener", p.listener.name).Debug("tproxy udp")
+				continue
+			}
+		}
+
+		f, ok := p.flow(client, target, origDst)
+		if !ok {
+			return
+		}
+		if f == nil {
+			continue
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		select {
+		case f.packets <- data:
+		default:
+		}
+	}
+}
+
+// flow 返回客户端到目标的流,没有时创建并在新的协程中处理,中继已关闭时返回false。
+// 同一流最近建立失败时返回nil,丢弃数据包。target为空时使用当前配置的转发目标
+func (p *udpFlowRelay) flow(client *net.UDPAddr, target string, origDst *net.UDPAddr) (*udpFlow, bool) {
+	l := p.listener
+	conf := l.getConf()
+	if len(target) == 0 {
+		target = conf.cfg.ForwardTarget
+	}
+
+	key := udpFlowKey{client: client.String(), target: target}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, false
+	}
+	if f := p.flows[key]; f != nil {
+		return f, true
+	}
+	if until, ok := p.failed[key]; ok {
+		if time.Now().Before(until) {
+			return nil, true
+		}
+		delete(p.failed, key)
+	}
+
+	f := &udpFlow{
+		relay:   p,
+		key:     key,
+		cfg:     l.connCfg(conf),
+		client:  client,
+		origDst: origDst,
+		packets: make(chan []byte, udpFlowQueueLen),
+		done:    make(chan struct{}),
+	}
+	f.session = l.newSession(newClientSession(l.name, client, f), conf)
+	p.flows[key] = f
+
+	go func() {
+		l.runSession(f.session, f, f.handle)
+		p.mu.Lock()
+		if p.flows[key] == f {
+			delete(p.flows, key)
+		}
+		//没有建立就结束的流(被拒绝或连接失败)在udpRetryInterval内不再重试,避免每个数据包都产生会话和访问日志
+		if atomic.LoadInt32(&f.established) == 0 && !p.closed {
+			if len(p.failed) >= udpFlowFailedSize {
+				p.failed = make(map[udpFlowKey]time.Time)
+			}
+			p.failed[key] = time.Now().Add(udpRetryInterval)
+		}
+		p.mu.Unlock()
+	}()
+	return f, true
+}
+
+// udpFlow 一个客户端发往一个目标的udp流,直连或经上游代理的udp关联转发
+type udpFlow struct {
+	relay   *udpFlowRelay
+	key     udpFlowKey
+	cfg     ConnCfg
+	session *Session
+	client  *net.UDPAddr
+	origDst *net.UDPAddr //tproxy时数据包的原始目标
+	packets chan []byte
+
+	reply  io.WriteCloser //发往客户端,tproxy时以原始目标为源地址
+	remote net.Conn       //连接目标或上游中继的udp socket
+	ctrl   net.Conn       //与上游代理的控制连接,直连时为nil
+	active int64          //最后收发数据包的时间
+
+	established int32 //连接目标后置1,没有建立就结束的流记为失败
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Close 结束此流,用于Kill和超过最长持续时间
+func (p *udpFlow) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.done)
+	})
+	return nil
+}
+
+func (p *udpFlow) handle() error {
+	defer p.cleanup()
+
+	target := p.key.target
+	p.session.setProtocol(p.relay.listener.cfg.Network)
+	p.session.setRequest(CommandUDP, target)
+	if !enabledIn(p.cfg.Commands, CommandUDP) {
+		return fmt.Errorf("%s:%w", CommandUDP, ErrProtocolDisabled)
+	}
+
+	cfg, err := p.cfg.checkRequest(p.session, p.client, target)
+	if err != nil {
+		return err
+	}
+
+	if cfg.upstream != nil {
+		var uc *net.UDPConn
+		p.ctrl, uc, err = cfg.upstream.associate(p.client, target, cfg.connectTimeout())
+		if err == nil {
+			p.remote = uc
+		}
+	} else {
+		p.remote, err = net.DialTimeout("udp", target, cfg.connectTimeout())
+	}
+	if err != nil {
+		return fmt.Errorf("udp %s:%w", target, err)
+	}
+
+	if p.origDst != nil {
+		uc, err := dialTransparentUDP(p.origDst, p.client)
+		if err != nil {
+			return fmt.Errorf("udp reply %s:%w", p.client, err)
+		}
+		p.reply = uc
+	} else {
+		p.reply = &udpReplyWriter{conn: p.relay.conn, addr: p.client}
+	}
+	p.session.onEstablished()
+	atomic.StoreInt32(&p.established, 1)
+
+	atomic.StoreInt64(&p.active, time.Now().UnixNano())
+	go p.relayToClient(cfg.upstream != nil)
+	return p.relayToTarget(cfg.upstream != nil)
+}
+
+// relayToTarget 转发客户端的数据包,两个方向都超过timeout没有数据时结束
+func (p *udpFlow) relayToTarget(viaUpstream bool) error {
+	var addr AddrByte
+	if viaUpstream {
+		var err error
+		if addr, err = NewAddrByteFromString(p.key.target); err != nil {
+			return err
+		}
+	}
+
+	timeout := p.relay.timeout
+	idle := time.NewTimer(timeout)
+	defer idle.Stop()
+	for {
+		select {
+		case data := <-p.packets:
+			if p.session.hasHooks() && p.session.onUDPPacket(true, p.key.target, len(data)) != nil {
+				continue
+			}
+			b := data
+			if viaUpstream {
+				b = NewUDPDatagram(addr, data).ToBytes()
+			}
+			if _, err := p.remote.Write(b); err != nil {
+				return err
+			}
+			p.session.addPacketUp(len(data))
+			atomic.StoreInt64(&p.active, time.Now().UnixNano())
+		case <-idle.C:
+			d := time.Since(time.Unix(0, atomic.LoadInt64(&p.active)))
+			if d >= timeout {
+				return ErrIdleTimeout
+			}
+			idle.Reset(timeout - d)
+		case <-p.done:
+			return nil
+		}
+	}
+}
+
+// relayToClient 把目标的应答发回客户端,经上游时去掉socks5头部
+func (p *udpFlow) relayToClient(viaUpstream bool) {
+	defer p.Close()
+
+	buf := make([]byte, MaxSegmentSize)
+	for {
+		n, err := p.remote.Read(buf)
+		if err != nil {
+			return
+		}
+		data := buf[:n]
+		if viaUpstream {
+			d, err := NewUDPDatagramFromBytes(data)
+			if err != nil || d.Frag != 0 {
+				continue
+			}
+			data = d.Data
+		}
+		if p.session.hasHooks() && p.session.onUDPPacket(false, p.key.target, len(data)) != nil {
+			continue
+		}
+		if _, err := p.reply.Write(data); err != nil {
+			return
+		}
+		p.session.addPacketDown(len(data))
+		atomic.StoreInt64(&p.active, time.Now().UnixNano())
+	}
+}
+
+func (p *udpFlow) cleanup() {
+	p.Close()
+	if p.remote != nil {
+		p.remote.Close()
+	}
+	if p.ctrl != nil {
+		p.ctrl.Close()
+	}
+	if p.reply != nil {
+		p.reply.Close()
+	}
+}
+
+// udpReplyWriter 经中继的监听socket发往客户端,关闭时不关闭共用的socket
+type udpReplyWriter struct {
+	conn *net.UDPConn
+	addr *net.UDPAddr
+}
+
+func (p *udpReplyWriter) Write(b []byte) (int, error) {
+	return p.conn.WriteToUDP(b, p.addr)
+}
+
+func (p *udpReplyWriter) Close() error {
+	return nil
+}
@@ -0,0 +1,155 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServer_Forward(t *testing.T) {
+	tcpEcho, udpEcho := startTestEchoServer(t)
+
+	upstream, err := newServer(ServerCfg{
+		UDPListen: "127.0.0.1:0",
+		UDPTimout: 5,
+		Listeners: []ListenerCfg{{Listen: "127.0.0.1:0", UserName: "user", Password: "pass"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := upstream.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.close()
+	upAddr := upstream.listeners[0].addr().String()
+
+	s, err := newServer(ServerCfg{
+		UDPListen: "127.0.0.1:0",
+		UDPTimout: 5,
+		Upstreams: []UpstreamCfg{{Name: "up", ClientCfg: ClientCfg{ServerAddr: upAddr, UserName: "user", Password: "pass"}}},
+		Listeners: []ListenerCfg{
+			{Name: "direct", Network: NetworkForward, Listen: "127.0.0.1:0", ForwardTarget: tcpEcho},
+			{Name: "udp", Network: NetworkForward, Listen: "127.0.0.1:0", ForwardTarget: udpEcho, ForwardUDP: true},
+			{Name: "via-upstream", Network: NetworkForward, Listen: "127.0.0.1:0", ForwardTarget: udpEcho, ForwardUDP: true,
+				Routes: []RouteCfg{{Outbound: "up"}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	conn, err := net.Dial("tcp", s.listeners[0].addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echoTest(conn, "tcp forward", t)
+
+	for _, l := range s.listeners[1:] {
+		uc, err := net.Dial("udp", l.addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer uc.Close()
+		echoTest(uc, l.name, t)
+		echoTest(uc, l.name+" again", t)
+	}
+
+	var udpSessions int
+	for _, info := range s.Sessions() {
+		if info.Protocol != NetworkForward {
+			t.Fatalf("protocol:%s", info.Protocol)
+		}
+		if info.Command == CommandUDP {
+			udpSessions++
+			//第二个应答到达时第一个数据包已经统计
+			if info.PacketsUp < 1 || info.PacketsDown < 1 {
+				t.Fatalf("udp session:%+v", info)
+			}
+		}
+	}
+	if udpSessions != 2 {
+		t.Fatalf("udp sessions:%d", udpSessions)
+	}
+	if n := upstream.Stats()[0].Accepted; n != 1 {
+		t.Fatalf("upstream accepted:%d", n)
+	}
+
+	if _, err := newServer(ServerCfg{Listeners: []ListenerCfg{{Network: NetworkForward, Listen: "127.0.0.1:0"}}}); err == nil {
+		t.Fatal("expect ForwardTarget error")
+	}
+}
+
+func TestServer_ForwardUDPConnectTimeout(t *testing.T) {
+	s, err := newServer(ServerCfg{
+		UDPListen: "127.0.0.1:0",
+		Upstreams: []UpstreamCfg{{Name: "silent", ClientCfg: ClientCfg{ServerAddr: startTestSilentServer(t)}}},
+		Listeners: []ListenerCfg{{Network: NetworkForward, Listen: "127.0.0.1:0", ForwardTarget: "127.0.0.1:53", ForwardUDP: true,
+			ConnectTimeout: 1, Routes: []RouteCfg{{Outbound: "silent"}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	uc, err := net.Dial("udp", s.listeners[0].addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	uc.Write([]byte("ping"))
+
+	//与上游的握手受监听的ConnectTimeout限制,而不是默认的3秒
+	deadline := time.Now().Add(2 * time.Second)
+	for len(s.Sessions()) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("udp session not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for len(s.Sessions()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("upstream associate not bounded by ConnectTimeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServer_ForwardUDPFailed(t *testing.T) {
+	_, udpEcho := startTestEchoServer(t)
+
+	s, err := newServer(ServerCfg{
+		UDPListen: "127.0.0.1:0",
+		Listeners: []ListenerCfg{{Network: NetworkForward, Listen: "127.0.0.1:0", ForwardTarget: udpEcho, ForwardUDP: true,
+			Rules: []RuleCfg{{Action: RuleActionDeny}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	uc, err := net.Dial("udp", s.listeners[0].addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+
+	//被拒绝的流在重试间隔内不再为每个数据包创建会话
+	for i := 0; i < 20; i++ {
+		uc.Write([]byte("denied"))
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := s.Stats()[0].Denied; n != 1 {
+		t.Fatalf("denied sessions:%d", n)
+	}
+}
@@ -0,0 +1,75 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geoIP MaxMind格式(mmdb)的国家数据库,如GeoLite2-Country
+type geoIP struct {
+	db *maxminddb.Reader
+}
+
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// openGeoIP 把数据库读入内存,重新加载配置时旧的数据库随配置一起释放
+func openGeoIP(path string) (*geoIP, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := maxminddb.FromBytes(b)
+	if err != nil {
+		return nil, err
+	}
+	return &geoIP{db: db}, nil
+}
+
+// geoIPSource 一份配置中各监听共用的GeoIP数据库,第一条使用GeoIP的路由打开,重新加载配置时重新创建
+type geoIPSource struct {
+	file string
+	db   *geoIP
+}
+
+func newGeoIPSource(file string) *geoIPSource {
+	return &geoIPSource{file: file}
+}
+
+// open 返回已打开的数据库,还没有时打开
+func (p *geoIPSource) open() (*geoIP, error) {
+	if p == nil || len(p.file) == 0 {
+		return nil, errors.New("GeoIPFile is required for GeoIP")
+	}
+	if p.db == nil {
+		db, err := openGeoIP(p.file)
+		if err != nil {
+			return nil, fmt.Errorf("GeoIPFile:%w", err)
+		}
+		p.db = db
+	}
+	return p.db, nil
+}
+
+// country 返回ip所属国家的大写ISO代码,查不到时为空
+func (p *geoIP) country(ip net.IP) string {
+	var r geoIPRecord
+	if err := p.db.Lookup(ip, &r); err != nil {
+		return ""
+	}
+	if r.Country.ISOCode != "" {
+		return strings.ToUpper(r.Country.ISOCode)
+	}
+	return strings.ToUpper(r.RegisteredCountry.ISOCode)
+}
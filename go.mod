@@ -6,7 +6,10 @@ require (
 	github.com/BurntSushi/toml v0.3.1 // indirect
 	github.com/miekg/dns v1.1.33
 	github.com/natefinch/lumberjack v2.0.0+incompatible
+	github.com/oschwald/maxminddb-golang v1.6.0
 	github.com/sirupsen/logrus v1.6.0
+	golang.org/x/net v0.0.0-20190923162816-aa69164e4478
+	golang.org/x/sys v0.0.0-20191224085550-c709ea063b76
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0 // indirect
 	gopkg.in/yaml.v2 v2.3.0 // indirect
 )
@@ -0,0 +1,90 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrHookRejected = errors.New("rejected by hook")
+
+// Hooks 会话生命周期的事件回调，返回error的回调可以否决当前操作，
+// 回调在处理连接的goroutine中同步执行，不应长时间阻塞。嵌入NopHooks后只需实现关心的方法
+type Hooks interface {
+	// OnAccept 接受连接后，开始读取协议前
+	OnAccept(s *Session) error
+	// OnAuth 用户名密码或tls客户端证书鉴权后，ok为鉴权结果，ok为true时返回error会使鉴权失败
+	OnAuth(s *Session, user string, ok bool) error
+	// OnRequest 读取到请求并通过访问规则后，cmd为CommandConnect,CommandUDP或CommandHTTP
+	OnRequest(s *Session, cmd string, target string) error
+	// OnDial 连接目标后，err为连接的结果，err为nil时返回error会关闭到目标的连接
+	OnDial(s *Session, target string, err error) error
+	// OnEstablished 已应答客户端，开始转发数据
+	OnEstablished(s *Session)
+	// OnClose 会话结束，s.Info()中有流量统计和关闭原因
+	OnClose(s *Session)
+	// OnUDPPacket udp关联的每个数据包，upstream为true时为客户端发往target的数据包，返回error时丢弃此数据包
+	OnUDPPacket(s *Session, upstream bool, target string, size int) error
+}
+
+// NopHooks 所有回调都不做任何事
+type NopHooks struct{}
+
+func (NopHooks) OnAccept(s *Session) error                                            { return nil }
+func (NopHooks) OnAuth(s *Session, user string, ok bool) error                        { return nil }
+func (NopHooks) OnRequest(s *Session, cmd string, target string) error                { return nil }
+func (NopHooks) OnDial(s *Session, target string, err error) error                    { return nil }
+func (NopHooks) OnEstablished(s *Session)                                             {}
+func (NopHooks) OnClose(s *Session)                                                   {}
+func (NopHooks) OnUDPPacket(s *Session, upstream bool, target string, size int) error { return nil }
+
+// hookError 把回调返回的错误包装为ErrHookRejected
+func hookError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%w:%v", ErrHookRejected, err)
+}
+
+func (p *Session) hooks() Hooks {
+	if p.hook == nil {
+		return NopHooks{}
+	}
+	return p.hook
+}
+
+// hasHooks 没有设置回调时可以省去构造回调参数
+func (p *Session) hasHooks() bool {
+	return p.hook != nil
+}
+
+func (p *Session) onAccept() error {
+	return hookError(p.hooks().OnAccept(p))
+}
+
+func (p *Session) onAuth(user string, ok bool) error {
+	return hookError(p.hooks().OnAuth(p, user, ok))
+}
+
+// onRequest 使用setRequest记录的命令和目标
+func (p *Session) onRequest() error {
+	p.mu.Lock()
+	cmd, target := p.command, p.target
+	p.mu.Unlock()
+	return hookError(p.hooks().OnRequest(p, cmd, target))
+}
+
+func (p *Session) onDial(target string, err error) error {
+	return hookError(p.hooks().OnDial(p, target, err))
+}
+
+func (p *Session) onEstablished() {
+	p.hooks().OnEstablished(p)
+}
+
+func (p *Session) onClose() {
+	p.hooks().OnClose(p)
+}
+
+func (p *Session) onUDPPacket(upstream bool, target string, size int) error {
+	return p.hooks().OnUDPPacket(p, upstream, target, size)
+}
@@ -0,0 +1,140 @@
+package socks5
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testHooks struct {
+	NopHooks
+	blocked string
+
+	mu      sync.Mutex
+	events  map[uint64][]string
+	closed  chan SessionInfo
+	packets int
+}
+
+func (p *testHooks) event(s *Session, e string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.events == nil {
+		p.events = make(map[uint64][]string)
+	}
+	p.events[s.ID()] = append(p.events[s.ID()], e)
+}
+
+func (p *testHooks) OnAccept(s *Session) error {
+	p.event(s, "accept")
+	s.SetTag("tenant", "t1")
+	return nil
+}
+
+func (p *testHooks) OnAuth(s *Session, user string, ok bool) error {
+	p.event(s, "auth")
+	return nil
+}
+
+func (p *testHooks) OnRequest(s *Session, cmd string, target string) error {
+	p.event(s, "request")
+	if target == p.blocked {
+		return errors.New("blocked")
+	}
+	return nil
+}
+
+func (p *testHooks) OnDial(s *Session, target string, err error) error {
+	p.event(s, "dial")
+	return nil
+}
+
+func (p *testHooks) OnEstablished(s *Session) {
+	p.event(s, "established")
+}
+
+func (p *testHooks) OnClose(s *Session) {
+	p.event(s, "close")
+	p.closed <- s.Info()
+}
+
+func (p *testHooks) OnUDPPacket(s *Session, upstream bool, target string, size int) error {
+	p.mu.Lock()
+	p.packets++
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *testHooks) waitClose(t *testing.T) SessionInfo {
+	select {
+	case info := <-p.closed:
+		return info
+	case <-time.After(3 * time.Second):
+		t.Fatal("OnClose not called")
+		return SessionInfo{}
+	}
+}
+
+func TestServer_Hooks(t *testing.T) {
+	tcpEcho, udpEcho := startTestEchoServer(t)
+
+	ss, err := newServer(ServerCfg{
+		TCPListen: "127.0.0.1:0",
+		UDPListen: "127.0.0.1:0",
+		UserName:  "0990",
+		Password:  "123456",
+		UDPTimout: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hooks := &testHooks{blocked: "127.0.0.1:1", closed: make(chan SessionInfo, 3)}
+	ss.SetHooks(hooks)
+	if err := ss.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer ss.close()
+
+	sc := NewSocks5Client(ClientCfg{ServerAddr: ss.listeners[0].addr().String(), UserName: "0990", Password: "123456", UDPTimout: 3})
+	conn, err := sc.Dial("tcp", tcpEcho)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoTest(conn, "hello", t)
+	conn.Close()
+
+	info := hooks.waitClose(t)
+	hooks.mu.Lock()
+	events := strings.Join(hooks.events[info.ID], ",")
+	hooks.mu.Unlock()
+	if events != "accept,auth,request,dial,established,close" {
+		t.Fatalf("events:%s", events)
+	}
+	if info.Tags["tenant"] != "t1" || info.BytesUp != 5 || info.BytesDown != 5 {
+		t.Fatalf("close info:%+v", info)
+	}
+
+	if _, err := sc.Dial("tcp", hooks.blocked); err == nil {
+		t.Fatal("blocked target connected")
+	}
+	info = hooks.waitClose(t)
+	if info.CloseReason != CloseReasonHookReject || info.Reply != RepRuleFailure {
+		t.Fatalf("blocked info:%+v", info)
+	}
+
+	uconn, err := sc.Dial("udp", udpEcho)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoTest(uconn, "ping", t)
+	uconn.Close()
+	hooks.waitClose(t)
+
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+	if hooks.packets != 2 {
+		t.Fatalf("udp packets:%d", hooks.packets)
+	}
+}
@@ -0,0 +1,77 @@
+package socks5
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// identdPort identd服务的端口
+var identdPort = 113
+
+// identdTimeout 查询identd的超时,包括连接和读取应答
+const identdTimeout = 5 * time.Second
+
+// queryIdentd 按RFC 1413向客户端的identd查询client到server这个连接的用户名
+func queryIdentd(client net.Addr, server net.Addr, timeout time.Duration) (string, error) {
+	c, ok := client.(*net.TCPAddr)
+	if !ok {
+		return "", fmt.Errorf("client %v is not tcp", client)
+	}
+	s, ok := server.(*net.TCPAddr)
+	if !ok {
+		return "", fmt.Errorf("server %v is not tcp", server)
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(c.IP.String(), strconv.Itoa(identdPort)), timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := fmt.Fprintf(conn, "%d , %d\r\n", c.Port, s.Port); err != nil {
+		return "", err
+	}
+
+	// 应答最长1000字节,超过时ReadSlice返回错误
+	line, err := bufio.NewReaderSize(conn, 1024).ReadSlice('\n')
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return "", err
+	}
+	return parseIdentdReply(string(line), c.Port, s.Port)
+}
+
+// parseIdentdReply 解析 "<client-port> , <server-port> : USERID : <opsys> : <user-id>" 形式的应答
+func parseIdentdReply(line string, clientPort, serverPort int) (string, error) {
+	fields := strings.SplitN(strings.TrimRight(line, "\r\n"), ":", 4)
+	if len(fields) < 3 {
+		return "", fmt.Errorf("invalid identd reply:%q", line)
+	}
+
+	ports := strings.Split(fields[0], ",")
+	if len(ports) != 2 || strings.TrimSpace(ports[0]) != strconv.Itoa(clientPort) || strings.TrimSpace(ports[1]) != strconv.Itoa(serverPort) {
+		return "", fmt.Errorf("identd reply port mismatch:%q", line)
+	}
+
+	switch strings.TrimSpace(fields[1]) {
+	case "USERID":
+		if len(fields) < 4 {
+			return "", fmt.Errorf("invalid identd reply:%q", line)
+		}
+		user := strings.TrimSpace(fields[3])
+		if user == "" {
+			return "", errors.New("identd reply empty user")
+		}
+		return user, nil
+	case "ERROR":
+		return "", fmt.Errorf("identd error:%s", strings.TrimSpace(fields[2]))
+	default:
+		return "", fmt.Errorf("invalid identd reply:%q", line)
+	}
+}
@@ -0,0 +1,55 @@
+package socks5
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseIdentdReply(t *testing.T) {
+	cases := []struct {
+		line string
+		user string
+	}{
+		{"6193, 23 : USERID : UNIX : stjohns\r\n", "stjohns"},
+		{"6193 , 23 : USERID : OTHER,US-ASCII :a:b\r\n", "a:b"},
+		{"6193, 23 : ERROR : NO-USER\r\n", ""},
+		{"6195, 23 : USERID : UNIX : stjohns\r\n", ""},
+		{"garbage\r\n", ""},
+	}
+	for _, c := range cases {
+		user, err := parseIdentdReply(c.line, 6193, 23)
+		if user != c.user || (c.user == "") != (err != nil) {
+			t.Fatalf("%q:%s %v", c.line, user, err)
+		}
+	}
+}
+
+// startTestIdentd 启动回答固定用户名的identd,并修改identdPort,测试结束后恢复
+func startTestIdentd(t *testing.T, user string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			fmt.Fprintf(conn, "%s : USERID : UNIX : %s\r\n", strings.TrimSpace(line), user)
+			conn.Close()
+		}
+	}()
+
+	old := identdPort
+	identdPort = l.Addr().(*net.TCPAddr).Port
+	t.Cleanup(func() {
+		identdPort = old
+		l.Close()
+	})
+	return l
+}
@@ -0,0 +1,603 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/0990/socks5/pkg/mux"
+	"github.com/sirupsen/logrus"
+)
+
+var ErrRuleDenied = errors.New("denied by rule")
+var ErrProtocolDisabled = errors.New("protocol disabled")
+
+type listener struct {
+	server *server
+	cfg    ListenerCfg //启动时的配置,监听地址相关的字段不能热加载
+	name   string
+
+	ln net.Listener
+
+	mu   sync.RWMutex
+	conf *listenerConf //可热加载的配置
+
+	udpListenAddr *net.UDPAddr //独立udp中继的监听地址,为nil时使用server的udp中继
+	udpRelay      *udpRelay
+	udpFlows      *udpFlowRelay //tproxy和forward在同一地址上的udp转发
+
+	stats listenerStats
+}
+
+// listenerConf 由ListenerCfg解析得到的配置,重新加载时整体替换
+type listenerConf struct {
+	cfg ListenerCfg
+
+	//超时设置,秒,已合并ServerCfg中的配置
+	idleTimeout      int
+	maxLifetime      int
+	connectTimeout   int
+	handshakeTimeout int
+
+	tlsConfig *tls.Config
+	rules     *RuleSet
+	router    *Router
+
+	proxyProtoTrusted []*net.IPNet
+	udpAdvertise      []udpAdvertise
+
+	listenSocket SocketCfg
+	dialSocket   SocketCfg
+}
+
+func newListener(s *server, cfg ListenerCfg, geo *geoIPSource) (*listener, error) {
+	if len(cfg.Network) == 0 {
+		cfg.Network = NetworkTCP
+	}
+
+	p := &listener{
+		server: s,
+		cfg:    cfg,
+		name:   listenerName(cfg),
+	}
+
+	var err error
+	p.conf, err = newListenerConf(cfg, &s.cfg, s.upstreams, geo)
+	if err != nil {
+		return nil, fmt.Errorf("listener %s:%w", p.name, err)
+	}
+
+	if len(cfg.UDPListen) > 0 {
+		p.udpListenAddr, err = net.ResolveUDPAddr("udp", cfg.UDPListen)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s:%w", p.name, err)
+		}
+	}
+	return p, nil
+}
+
+func listenerName(cfg ListenerCfg) string {
+	if len(cfg.Name) > 0 {
+		return cfg.Name
+	}
+	return cfg.Network + "://" + cfg.Listen
+}
+
+func newListenerConf(cfg ListenerCfg, scfg *ServerCfg, ups *upstreamSet, geo *geoIPSource) (*listenerConf, error) {
+	for _, proto := range cfg.Protocols {
+		switch proto {
+		case ProtocolSocks4, ProtocolSocks5, ProtocolHTTP:
+		default:
+			return nil, fmt.Errorf("unknown protocol:%s", proto)
+		}
+	}
+	for _, cmd := range cfg.Commands {
+		switch cmd {
+		case CommandConnect, CommandUDP, CommandHTTP:
+		default:
+			return nil, fmt.Errorf("unknown command:%s", cmd)
+		}
+	}
+
+	conf := &listenerConf{
+		cfg:              cfg,
+		idleTimeout:      firstPositive(cfg.IdleTimeout, scfg.TCPTimeout),
+		maxLifetime:      firstPositive(cfg.MaxLifetime, scfg.MaxLifetime),
+		connectTimeout:   firstPositive(cfg.ConnectTimeout, scfg.ConnectTimeout),
+		handshakeTimeout: firstPositive(cfg.HandshakeTimeout, scfg.HandshakeTimeout),
+		listenSocket:     scfg.ListenSocket,
+		dialSocket:       scfg.DialSocket,
+	}
+	if cfg.ListenSocket != nil {
+		conf.listenSocket = *cfg.ListenSocket
+	}
+	if cfg.DialSocket != nil {
+		conf.dialSocket = *cfg.DialSocket
+	}
+
+	var err error
+	conf.rules, err = NewRuleSet(cfg.Rules)
+	if err != nil {
+		return nil, err
+	}
+
+	conf.router, err = newRouter(cfg.Routes, ups.dialers, geo)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cfg.Network {
+	case NetworkTCP, NetworkUnix:
+	case NetworkTunnel:
+		if len(cfg.TunnelName) == 0 || len(cfg.TunnelToken) == 0 {
+			return nil, errors.New("TunnelName and TunnelToken are required for tunnel")
+		}
+		if len(cfg.TunnelName) > 255 {
+			return nil, errors.New("TunnelName too long")
+		}
+	case NetworkTLS:
+		conf.tlsConfig, err = newServerTLSConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+	case NetworkForward:
+		if _, _, err := net.SplitHostPort(cfg.ForwardTarget); err != nil {
+			return nil, fmt.Errorf("ForwardTarget:%w", err)
+		}
+		fallthrough
+	case NetworkRedirect, NetworkTProxy:
+		if cfg.Mux || len(cfg.Tunnel) > 0 || cfg.ProxyProtocol {
+			return nil, fmt.Errorf("Mux, Tunnel and ProxyProtocol are not supported for %s", cfg.Network)
+		}
+	default:
+		return nil, fmt.Errorf("unknown network %s", cfg.Network)
+	}
+
+	if len(cfg.Tunnel) > 0 && len(scfg.TunnelListen) == 0 {
+		return nil, errors.New("TunnelListen is required for Tunnel")
+	}
+
+	switch cfg.ProxyProtocolOut {
+	case "", ProxyProtoV1, ProxyProtoV2:
+	default:
+		return nil, fmt.Errorf("unknown ProxyProtocolOut %s", cfg.ProxyProtocolOut)
+	}
+
+	for _, s := range cfg.ProxyProtocolTrusted {
+		n, err := parseIPNet(s)
+		if err != nil {
+			return nil, fmt.Errorf("ProxyProtocolTrusted %w", err)
+		}
+		conf.proxyProtoTrusted = append(conf.proxyProtoTrusted, n)
+	}
+	//信任所有来源时任何客户端都可以伪造源地址
+	if cfg.ProxyProtocol && len(conf.proxyProtoTrusted) == 0 {
+		return nil, errors.New("ProxyProtocolTrusted is required for ProxyProtocol")
+	}
+
+	conf.udpAdvertise, err = newUDPAdvertise(cfg.UDPAdvertise)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cfg.Socks4Auth {
+	case "", Socks4AuthNone, Socks4AuthDisabled, Socks4AuthIdentd:
+	case Socks4AuthUserId:
+		if len(cfg.Socks4UserIds) == 0 {
+			return nil, errors.New("Socks4UserIds is required when Socks4Auth is userid")
+		}
+	default:
+		return nil, fmt.Errorf("unknown Socks4Auth %s", cfg.Socks4Auth)
+	}
+	return conf, nil
+}
+
+// checkReload 检查新配置能否热加载,监听地址和udp中继的变化需要重启
+func (p *listener) checkReload(cfg ListenerCfg, scfg *ServerCfg, ups *upstreamSet, geo *geoIPSource) (*listenerConf, error) {
+	if len(cfg.Network) == 0 {
+		cfg.Network = NetworkTCP
+	}
+	if listenerName(cfg) != p.name || cfg.Network != p.cfg.Network || cfg.Listen != p.cfg.Listen ||
+		cfg.UDPListen != p.cfg.UDPListen || cfg.UnixListenPerm != p.cfg.UnixListenPerm ||
+		cfg.TunnelName != p.cfg.TunnelName || cfg.TunnelToken != p.cfg.TunnelToken || cfg.ForwardUDP != p.cfg.ForwardUDP {
+		return nil, fmt.Errorf("listener %s:listen address changed, restart required", p.name)
+	}
+
+	conf, err := newListenerConf(cfg, scfg, ups, geo)
+	if err != nil {
+		return nil, fmt.Errorf("listener %s:%w", p.name, err)
+	}
+	return conf, nil
+}
+
+func (p *listener) setConf(conf *listenerConf) {
+	p.mu.Lock()
+	p.conf = conf
+	p.mu.Unlock()
+}
+
+func (p *listener) getConf() *listenerConf {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.conf
+}
+
+func (p *listener) listen() error {
+	var err error
+	switch p.cfg.Network {
+	case NetworkUnix:
+		p.ln, err = listenUnix(p.cfg.Listen, p.cfg.UnixListenPerm)
+	case NetworkTunnel:
+		p.ln = listenTunnel(p.cfg.Listen, p.cfg.TunnelName, p.cfg.TunnelToken)
+	case NetworkTProxy:
+		p.ln, err = listenTransparent(p.cfg.Listen)
+	default:
+		//tls在PROXY头部之后握手,所以这里只监听tcp
+		p.ln, err = p.getConf().listenSocket.listen(p.cfg.Listen)
+	}
+	if err != nil {
+		return err
+	}
+
+	if p.cfg.Network == NetworkTProxy || p.cfg.Network == NetworkForward && p.cfg.ForwardUDP {
+		//tcp监听端口为0时udp使用相同的端口
+		if p.udpFlows, err = listenUDPFlowRelay(p, p.ln.Addr().String()); err != nil {
+			p.ln.Close()
+			return err
+		}
+	}
+
+	if p.udpListenAddr != nil {
+		p.udpRelay, err = listenUDPRelay(p.udpListenAddr, &p.server.cfg)
+		if err != nil {
+			p.close()
+			return err
+		}
+		p.udpRelay.requireAssoc = p.requireUDPAssoc
+	}
+	return nil
+}
+
+func (p *listener) close() {
+	if p.ln != nil {
+		p.ln.Close()
+	}
+	if p.udpRelay != nil {
+		p.udpRelay.close()
+	}
+	if p.udpFlows != nil {
+		p.udpFlows.close()
+	}
+}
+
+func (p *listener) run() {
+	if p.udpRelay != nil {
+		go p.udpRelay.run()
+	}
+	if p.udpFlows != nil {
+		go p.udpFlows.run()
+	}
+	p.serve()
+}
+
+func (p *listener) serve() {
+	var tempDelay time.Duration
+
+	for {
+		conn, err := p.ln.Accept()
+		if err != nil {
+			logrus.WithError(err).Error("HandleListener Accept")
+			if ne, ok := err.(*net.OpError); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				logrus.Errorf("http: Accept error: %v; retrying in %v", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			return
+		}
+
+		go p.handleConn(conn)
+	}
+}
+
+func (p *listener) handleConn(conn net.Conn) {
+	atomic.AddInt64(&p.stats.accepted, 1)
+	atomic.AddInt64(&p.stats.active, 1)
+	defer atomic.AddInt64(&p.stats.active, -1)
+
+	conf := p.getConf()
+
+	if tc, ok := conn.(*net.TCPConn); ok {
+		if err := conf.listenSocket.apply(tc); err != nil {
+			logrus.WithError(err).WithField("listener", p.name).Warn("set socket options")
+		}
+	}
+
+	if isForward(p.cfg.Network) {
+		p.serveForward(conn, conf)
+		return
+	}
+
+	if conf.cfg.ProxyProtocol && conf.proxyProtoTrustedFrom(conn.RemoteAddr()) {
+		c, err := readProxyProtoConn(conn)
+		if err != nil {
+			conn.Close()
+			logrus.WithError(err).WithField("listener", p.name).Debug("proxy protocol")
+			return
+		}
+		conn = c
+	}
+
+	if conf.tlsConfig != nil {
+		conn = tls.Server(conn, conf.tlsConfig)
+	}
+
+	if len(conf.cfg.Tunnel) > 0 {
+		p.forwardTunnel(conn, conf)
+		return
+	}
+
+	if p.server.customConnHandler != nil {
+		p.server.customConnHandler(conn)
+		return
+	}
+
+	if tc, ok := conn.(*net.TCPConn); ok && p.server.customTcpConnHandler != nil {
+		p.server.customTcpConnHandler(tc)
+		return
+	}
+
+	var authUser string
+	if tc, ok := conn.(*tls.Conn); ok {
+		user, err := tlsHandshake(tc, time.Duration(conf.handshakeTimeout)*time.Second)
+		if err != nil {
+			conn.Close()
+			logrus.WithError(err).WithField("listener", p.name).Debug("tls conn")
+			return
+		}
+		authUser = user
+	}
+
+	if conf.cfg.Mux {
+		p.serveMux(conn, authUser)
+		return
+	}
+	p.serveConn(conn, conf, authUser)
+}
+
+// serveMux 处理mux连接上客户端打开的每个流,流与普通连接一样处理并统计,使用打开流时的配置
+func (p *listener) serveMux(conn net.Conn, authUser string) {
+	sess := mux.Server(conn, nil)
+	defer sess.Close()
+
+	for {
+		s, err := sess.Accept()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, mux.ErrSessionClosed) {
+				logrus.WithError(err).WithField("listener", p.name).Debug("mux conn")
+			}
+			return
+		}
+
+		atomic.AddInt64(&p.stats.accepted, 1)
+		atomic.AddInt64(&p.stats.active, 1)
+		go func() {
+			defer atomic.AddInt64(&p.stats.active, -1)
+			p.serveConn(s, p.getConf(), authUser)
+		}()
+	}
+}
+
+// serveConn 在已完成tls握手的连接上处理一个会话
+func (p *listener) serveConn(conn net.Conn, conf *listenerConf, authUser string) {
+	c := NewConn(conn, p.connCfg(conf))
+	c.SetAuthUser(authUser)
+	c.session = p.newSession(newSession(p.name, conn), conf)
+	c.udpRelay = p.relay()
+	p.runSession(c.session, conn, c.Handle)
+}
+
+// newSession 设置会话的钩子和最长持续时间
+func (p *listener) newSession(s *Session, conf *listenerConf) *Session {
+	s.hook = p.server.hooks
+	s.setLifetime(time.Duration(conf.maxLifetime) * time.Second)
+	return s
+}
+
+// runSession 登记会话并执行handle,结束后记录访问日志和统计,OnAccept拒绝时关闭closer
+func (p *listener) runSession(session *Session, closer io.Closer, handle func() error) {
+	p.server.addSession(session)
+	err := session.onAccept()
+	if err == nil {
+		err = handle()
+	} else {
+		closer.Close()
+	}
+	session.finish(err)
+	p.server.delSession(session)
+	session.onClose()
+	p.server.accessLog.log(session)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrAuthFailed):
+			atomic.AddInt64(&p.stats.authFailed, 1)
+		case errors.Is(err, ErrRuleDenied), errors.Is(err, ErrProtocolDisabled):
+			atomic.AddInt64(&p.stats.denied, 1)
+		}
+		if !errors.Is(err, io.EOF) {
+			logrus.WithError(err).WithField("listener", p.name).Debug("conn handle")
+		}
+	}
+}
+
+// forwardTunnel 把连接原样转发给注册的内网实例,鉴权、规则等都由内网实例处理
+func (p *listener) forwardTunnel(conn net.Conn, conf *listenerConf) {
+	defer conn.Close()
+
+	s, err := p.server.tunnels.open(conf.cfg.Tunnel, conn.RemoteAddr())
+	if err != nil {
+		logrus.WithError(err).WithField("listener", p.name).Debug("tunnel forward")
+		return
+	}
+	defer s.Close()
+
+	if err := Pipe(conn, s, time.Duration(conf.idleTimeout)*time.Second); err != nil && !errors.Is(err, io.EOF) {
+		logrus.WithError(err).WithField("listener", p.name).Debug("tunnel forward")
+	}
+}
+
+func (p *listener) connCfg(conf *listenerConf) ConnCfg {
+	return ConnCfg{
+		UserName:          conf.cfg.UserName,
+		Password:          conf.cfg.Password,
+		Socks4Auth:        conf.cfg.Socks4Auth,
+		Socks4UserIds:     conf.cfg.Socks4UserIds,
+		TCPTimeout:        int32(conf.idleTimeout),
+		MaxLifetime:       int32(conf.maxLifetime),
+		ConnectTimeout:    int32(conf.connectTimeout),
+		HandshakeTimeout:  int32(conf.handshakeTimeout),
+		UDPAdvertisedIP:   conf.cfg.UDPAdvertisedIP,
+		UDPAdvertisedPort: p.udpAdvertisedPort(),
+		udpAdvertise:      conf.udpAdvertise,
+		Protocols:         conf.cfg.Protocols,
+		Commands:          conf.cfg.Commands,
+		Rules:             conf.rules,
+		Routes:            conf.router,
+		ProxyProtocolOut:  conf.cfg.ProxyProtocolOut,
+		DialSocket:        conf.dialSocket,
+	}
+}
+
+func (p *listenerConf) proxyProtoTrustedFrom(addr net.Addr) bool {
+	return ipNetsContain(p.proxyProtoTrusted, addrIP(addr))
+}
+
+// requireUDPAssoc 配置了规则、路由或认证时,udp中继只转发有UDP ASSOCIATE关联的客户端的数据包,
+// 否则能访问中继端口的主机都可以绕过这些限制
+func (p *listener) requireUDPAssoc() bool {
+	if isForward(p.cfg.Network) {
+		return false
+	}
+	conf := p.getConf()
+	if len(conf.rules.rules) > 0 || conf.router != nil && len(conf.router.routes) > 0 {
+		return true
+	}
+	cfg := conf.cfg
+	return len(cfg.UserName) > 0 && len(cfg.Password) > 0 || len(cfg.TLSClientCAFile) > 0 ||
+		cfg.Socks4Auth == Socks4AuthUserId || cfg.Socks4Auth == Socks4AuthIdentd
+}
+
+func (p *listener) udpAdvertisedPort() int {
+	if p.udpRelay != nil {
+		return p.udpRelay.port()
+	}
+	return p.server.udpRelayPort()
+}
+
+// relay 返回此监听使用的udp中继
+func (p *listener) relay() *udpRelay {
+	if p.udpRelay != nil {
+		return p.udpRelay
+	}
+	return p.server.udpRelay
+}
+
+func (p *listener) addr() net.Addr {
+	return p.ln.Addr()
+}
+
+// listenUnix 监听unix socket,会先删除残留的socket文件,perm为八进制的文件权限,如"0660"
+func listenUnix(path string, perm string) (net.Listener, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	if perm == "" {
+		return net.Listen("unix", path)
+	}
+	mode, err := strconv.ParseUint(perm, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("UnixListenPerm:%s %w", perm, err)
+	}
+
+	//先在同一目录下只有本用户可以访问的临时目录中创建socket并设置权限,再移动到path,
+	//socket不会以umask决定的更宽松的权限出现在path上
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".ss5-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, filepath.Base(path))
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	ul := l.(*net.UnixListener)
+	ul.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, os.FileMode(mode)); err != nil {
+		ul.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		ul.Close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: ul, path: path}, nil
+}
+
+// unixListener 移动过位置的unix socket,Addr返回最终的路径,关闭时删除socket文件
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (p *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: p.path, Net: "unix"}
+}
+
+func (p *unixListener) Close() error {
+	err := p.UnixListener.Close()
+	os.Remove(p.path)
+	return err
+}
+
+// firstPositive 返回第一个大于0的值,都不大于0时返回0
+func firstPositive(values ...int) int {
+	for _, v := range values {
+		if v > 0 {
+			return v
+		}
+	}
+	return 0
+}
+
+// enabledIn 判断协议或命令是否允许,list为空时全部允许
+func enabledIn(list []string, name string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, v := range list {
+		if strings.EqualFold(v, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,302 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// localUpstream 本地代理中远端服务作为上游的名称
+const localUpstream = "remote"
+
+// Local cmd/local的本地服务,本地代理和端口转发都经远端ss5服务连接目标
+type Local struct {
+	cfg      LocalCfg
+	server   *server //本地代理,SocksListen为空时为nil
+	forwards []*forwarder
+}
+
+func NewLocal(cfg LocalCfg) (*Local, error) {
+	if len(cfg.ServerAddr) == 0 {
+		return nil, errors.New("ServerAddr is required")
+	}
+	if len(cfg.SocksListen) == 0 && len(cfg.Forwards) == 0 {
+		return nil, errors.New("no SocksListen or Forwards")
+	}
+	if cfg.TCPTimeout <= 0 {
+		cfg.TCPTimeout = DefaultTcpTimeout
+	}
+	if cfg.UDPTimout <= 0 {
+		cfg.UDPTimout = DefaultUdpTimeout
+	}
+
+	p := &Local{cfg: cfg}
+	if len(cfg.SocksListen) > 0 {
+		var err error
+		p.server, err = newServer(ServerCfg{
+			TCPListen:  cfg.SocksListen,
+			UDPListen:  cfg.SocksListen,
+			UserName:   cfg.SocksUserName,
+			Password:   cfg.SocksPassword,
+			TCPTimeout: cfg.TCPTimeout,
+			UDPTimout:  cfg.UDPTimout,
+			Upstreams:  []UpstreamCfg{{Name: localUpstream, ClientCfg: cfg.ClientCfg}},
+			Routes:     []RouteCfg{{Outbound: localUpstream}},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	client := NewSocks5Client(cfg.ClientCfg)
+	for i, f := range cfg.Forwards {
+		switch f.Network {
+		case "":
+			f.Network = NetworkTCP
+		case NetworkTCP, "udp":
+		default:
+			return nil, fmt.Errorf("forward %d:unknown network %s", i, f.Network)
+		}
+		if len(f.Listen) == 0 || len(f.Target) == 0 {
+			return nil, fmt.Errorf("forward %d:Listen and Target are required", i)
+		}
+		p.forwards = append(p.forwards, &forwarder{
+			cfg:    f,
+			client: client,
+			idle:   time.Duration(cfg.TCPTimeout) * time.Second,
+			peers:  make(map[string]*udpPeer),
+		})
+	}
+	return p, nil
+}
+
+func (p *Local) Run() error {
+	for _, f := range p.forwards {
+		if err := f.listen(); err != nil {
+			p.Close()
+			return fmt.Errorf("forward %s:%w", f.cfg.Listen, err)
+		}
+	}
+	if p.server != nil {
+		if err := p.server.Run(); err != nil {
+			p.Close()
+			return err
+		}
+	}
+
+	for _, f := range p.forwards {
+		go f.serve()
+	}
+	return nil
+}
+
+func (p *Local) Close() {
+	if p.server != nil {
+		p.server.close()
+	}
+	for _, f := range p.forwards {
+		f.close()
+	}
+}
+
+// forwarder 一个端口转发,tcp的每个连接、udp的每个本地客户端地址在远端服务上建立一个连接或udp关联
+type forwarder struct {
+	cfg    ForwardCfg
+	client *socks5client
+	idle   time.Duration
+
+	ln   net.Listener
+	conn *net.UDPConn
+
+	mu    sync.Mutex
+	peers map[string]*udpPeer //udp本地客户端地址->经远端服务的udp关联
+}
+
+// udpPeer 一个本地客户端经远端服务的udp关联,关联在单独的goroutine中建立,
+// 建立前收到的数据包排队等待,超过udpPendingLen时丢弃
+type udpPeer struct {
+	mu      sync.Mutex
+	conn    net.Conn //建立关联前为nil
+	pending [][]byte
+	closed  bool
+}
+
+func (p *forwarder) listen() error {
+	if p.cfg.Network == NetworkTCP {
+		var err error
+		p.ln, err = net.Listen("tcp", p.cfg.Listen)
+		return err
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", p.cfg.Listen)
+	if err != nil {
+		return err
+	}
+	p.conn, err = net.ListenUDP("udp", addr)
+	return err
+}
+
+func (p *forwarder) addr() net.Addr {
+	if p.ln != nil {
+		return p.ln.Addr()
+	}
+	return p.conn.LocalAddr()
+}
+
+func (p *forwarder) close() {
+	if p.ln != nil {
+		p.ln.Close()
+	}
+	if p.conn != nil {
+		p.conn.Close()
+	}
+	p.mu.Lock()
+	for _, peer := range p.peers {
+		peer.close()
+	}
+	p.mu.Unlock()
+}
+
+func (p *forwarder) serve() {
+	if p.conn != nil {
+		p.serveUDP()
+		return
+	}
+
+	for {
+		conn, err := p.ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return
+		}
+		go p.handleConn(conn)
+	}
+}
+
+func (p *forwarder) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	remote, err := p.client.DialTimeout("tcp", p.cfg.Target, DefaultConnectTimeout*time.Second)
+	if err != nil {
+		logrus.WithError(err).WithField("forward", p.cfg.Listen).Warn("dial " + p.cfg.Target)
+		return
+	}
+	defer remote.Close()
+
+	if err := Pipe(conn, remote, p.idle); err != nil {
+		logrus.WithError(err).WithField("forward", p.cfg.Listen).Debug("pipe")
+	}
+}
+
+func (p *forwarder) serveUDP() {
+	buf := make([]byte, MaxSegmentSize)
+	for {
+		n, addr, err := p.conn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		p.udpPeer(addr).write(buf[:n])
+	}
+}
+
+// udpPeer 返回本地客户端对应的udp关联,没有时创建并在后台经远端服务建立,不阻塞读循环
+func (p *forwarder) udpPeer(addr *net.UDPAddr) *udpPeer {
+	key := addr.String()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	peer := p.peers[key]
+	if peer == nil {
+		peer = &udpPeer{}
+		p.peers[key] = peer
+		go p.associate(addr, peer)
+	}
+	return peer
+}
+
+// associate 建立udp关联后发出排队的数据包并转发应答,失败时移除peer,之后的数据包重新建立关联
+func (p *forwarder) associate(addr *net.UDPAddr, peer *udpPeer) {
+	remote, err := p.client.DialTimeout("udp", p.cfg.Target, DefaultConnectTimeout*time.Second)
+	if err != nil {
+		logrus.WithError(err).WithField("forward", p.cfg.Listen).Warn("udp associate " + p.cfg.Target)
+		p.removePeer(addr, peer)
+		peer.close()
+		return
+	}
+
+	peer.mu.Lock()
+	if peer.closed {
+		peer.mu.Unlock()
+		remote.Close()
+		return
+	}
+	peer.conn = remote
+	for _, b := range peer.pending {
+		remote.Write(b)
+	}
+	peer.pending = nil
+	peer.mu.Unlock()
+
+	p.relayUDP(addr, peer)
+}
+
+func (p *forwarder) removePeer(addr *net.UDPAddr, peer *udpPeer) {
+	p.mu.Lock()
+	if p.peers[addr.String()] == peer {
+		delete(p.peers, addr.String())
+	}
+	p.mu.Unlock()
+}
+
+// relayUDP 把目标的应答发回本地客户端,超过UDPTimout没有应答时关闭udp关联
+func (p *forwarder) relayUDP(addr *net.UDPAddr, peer *udpPeer) {
+	defer func() {
+		peer.close()
+		p.removePeer(addr, peer)
+	}()
+
+	buf := make([]byte, MaxSegmentSize)
+	for {
+		n, err := peer.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := p.conn.WriteToUDP(buf[:n], addr); err != nil {
+			return
+		}
+	}
+}
+
+func (p *udpPeer) write(b []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	if p.conn != nil {
+		p.conn.Write(b)
+		return
+	}
+	if len(p.pending) < udpPendingLen {
+		p.pending = append(p.pending, append([]byte(nil), b...))
+	}
+}
+
+func (p *udpPeer) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.pending = nil
+	if p.conn != nil {
+		p.conn.Close()
+	}
+}
@@ -0,0 +1,125 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLocal(t *testing.T) {
+	tcpEcho, udpEcho := startTestEchoServer(t)
+
+	remote, err := newServer(ServerCfg{
+		UDPListen: "127.0.0.1:0",
+		UDPTimout: 5,
+		Listeners: []ListenerCfg{{Listen: "127.0.0.1:0", UserName: "user", Password: "pass", Mux: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer remote.close()
+
+	local, err := NewLocal(LocalCfg{
+		ClientCfg:     ClientCfg{ServerAddr: remote.listeners[0].addr().String(), UserName: "user", Password: "pass", Mux: true},
+		SocksListen:   "127.0.0.1:0",
+		SocksUserName: "local",
+		SocksPassword: "secret",
+		Forwards: []ForwardCfg{
+			{Listen: "127.0.0.1:0", Target: tcpEcho},
+			{Network: "udp", Listen: "127.0.0.1:0", Target: udpEcho},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := local.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+
+	conn, err := net.Dial("tcp", local.forwards[0].addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echoTest(conn, "tcp forward", t)
+
+	uc, err := net.Dial("udp", local.forwards[1].addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	echoTest(uc, "udp forward", t)
+
+	//本地代理使用本地的鉴权,经远端服务连接目标
+	localAddr := local.server.listeners[0].addr().String()
+	if _, err := NewSocks5Client(ClientCfg{ServerAddr: localAddr}).Dial("tcp", tcpEcho); err == nil {
+		t.Fatal("expect local auth failure")
+	}
+	client := NewSocks5Client(ClientCfg{ServerAddr: localAddr, UserName: "local", Password: "secret", UDPTimout: 3})
+	sc, err := client.Dial("tcp", tcpEcho)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	echoTest(sc, "local socks", t)
+
+	su, err := client.Dial("udp", udpEcho)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer su.Close()
+	echoTest(su, "local socks udp", t)
+
+	if n := remote.Stats()[0].Accepted; n < 4 {
+		t.Fatalf("remote accepted:%d", n)
+	}
+
+	if _, err := NewLocal(LocalCfg{ClientCfg: ClientCfg{ServerAddr: "127.0.0.1:1"}}); err == nil {
+		t.Fatal("expect no SocksListen or Forwards error")
+	}
+}
+
+func TestLocal_UDPAssociateAsync(t *testing.T) {
+	local, err := NewLocal(LocalCfg{
+		ClientCfg: ClientCfg{ServerAddr: startTestSilentServer(t)},
+		Forwards:  []ForwardCfg{{Network: "udp", Listen: "127.0.0.1:0", Target: "127.0.0.1:53"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := local.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+
+	//远端服务不应答时关联一直在建立,读循环仍然接收其它客户端的数据包
+	f := local.forwards[0]
+	for i := 0; i < 2; i++ {
+		uc, err := net.Dial("udp", f.addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer uc.Close()
+		if _, err := uc.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		f.mu.Lock()
+		n := len(f.peers)
+		f.mu.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("peers:%d", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,29 @@
+package socks5
+
+import "sync/atomic"
+
+// ListenerStats 监听的连接统计
+type ListenerStats struct {
+	Name       string
+	Accepted   int64 //累计接受的连接数
+	Active     int64 //当前活跃的连接数
+	AuthFailed int64 //鉴权失败的连接数
+	Denied     int64 //被规则或协议限制拒绝的连接数
+}
+
+type listenerStats struct {
+	accepted   int64
+	active     int64
+	authFailed int64
+	denied     int64
+}
+
+func (p *listenerStats) snapshot(name string) ListenerStats {
+	return ListenerStats{
+		Name:       name,
+		Accepted:   atomic.LoadInt64(&p.accepted),
+		Active:     atomic.LoadInt64(&p.active),
+		AuthFailed: atomic.LoadInt64(&p.authFailed),
+		Denied:     atomic.LoadInt64(&p.denied),
+	}
+}
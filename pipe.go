@@ -4,6 +4,7 @@ import (
 	"errors"
 	"github.com/0990/socks5/pkg/pool"
 	"io"
+	"net"
 	"sync/atomic"
 	"time"
 )
@@ -12,67 +13,227 @@ import (
 const SocketBufSize = 20480
 const MaxSegmentSize = 65535
 
+var ErrIdleTimeout = errors.New("idle timeout")
+
+// idleConfirmDelay 空闲时唤醒读之后等待确认的时间
+const idleConfirmDelay = 100 * time.Millisecond
+
+// Pipe timeout为空闲超时,两个方向都没有数据超过timeout时结束,为0时不限制
 func Pipe(left Stream, right Stream, timeout time.Duration) error {
-	// 使用一个原子变量记录最近一次数据活动的时间（UnixNano格式）
-	var lastActivity int64 = time.Now().UnixNano()
+	return pipe(left, right, timeout, nil)
+}
 
-	// 辅助函数：更新活动时间
-	updateActivity := func() {
-		atomic.StoreInt64(&lastActivity, time.Now().UnixNano())
+// pipe left为客户端,right为目标,session不为nil时统计上下行字节数
+func pipe(left Stream, right Stream, timeout time.Duration, session *Session) error {
+	p := &pipeState{
+		left:         left,
+		right:        right,
+		idle:         timeout,
+		session:      session,
+		lastActivity: time.Now().UnixNano(),
 	}
 
-	// 启动全局监控协程
-	stopMonitor := make(chan struct{})
-	go func() {
-		ticker := time.NewTicker(time.Second)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ticker.C:
-				last := atomic.LoadInt64(&lastActivity)
-				if time.Since(time.Unix(0, last)) > timeout {
-					// 当全局无活动超过timeout，关闭连接
-					left.SetReadDeadline(time.Now())
-					right.SetReadDeadline(time.Now())
-					return
-				}
-			case <-stopMonitor:
-				return
-			}
-		}
-	}()
+	// 空闲检查使用运行时的定时器,不为每个连接启动监控协程
+	if p.idle > 0 {
+		p.timer = time.AfterFunc(p.idle, p.checkIdle)
+	}
 
-	// 启动双向转发
+	// 启动双向转发,一个方向读到EOF时向对端发送FIN,另一方向继续转发直到结束或超时
 	results := make(chan error, 2)
 	go func() {
-		_, err := unidirectionalStream(left, right, updateActivity)
-		left.SetReadDeadline(time.Now())
+		_, err := p.relay(left, right, false)
+		if err != nil || closeWrite(left) != nil {
+			p.stop()
+		}
 		results <- err
 	}()
-	_, err := unidirectionalStream(right, left, updateActivity)
-	right.SetReadDeadline(time.Now())
+	_, err := p.relay(right, left, true)
+	if err != nil || closeWrite(right) != nil {
+		p.stop()
+	}
 	results <- err
 
-	// 停止监控
-	close(stopMonitor)
-
 	// 只返回第一个出错的结果
 	first := <-results
-	<-results
+	if second := <-results; first == nil {
+		first = second
+	}
+
+	atomic.StoreInt32(&p.done, 1)
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	if atomic.LoadInt32(&p.timedOut) == 1 {
+		return ErrIdleTimeout
+	}
 	return first
 }
 
-// unidirectionalStream 将数据从 src 拷贝到 dst, 每次拷贝数据时调用 activityCallback 通知活动
-func unidirectionalStream(dst Stream, src Stream, activityCallback func()) (written int64, err error) {
+// pipeState 一次双向转发的状态
+type pipeState struct {
+	left    Stream
+	right   Stream
+	idle    time.Duration
+	session *Session
+	timer   *time.Timer
+
+	lastActivity int64 //最近一次数据活动的时间(UnixNano)
+	woken        int64 //checkIdle唤醒读时的lastActivity,只在定时器回调中访问
+	done         int32 //任一方向出错或超时后置1
+	timedOut     int32
+}
+
+func (p *pipeState) activity(n int, up bool) {
+	atomic.StoreInt64(&p.lastActivity, time.Now().UnixNano())
+	if p.session == nil {
+		return
+	}
+	if up {
+		p.session.addUp(int64(n))
+	} else {
+		p.session.addDown(int64(n))
+	}
+}
+
+// checkIdle 定时器回调,没有活动超过idle时先唤醒两个方向阻塞的读,使splice转发中还未计入的流量
+// 计入活动时间(ReadFrom返回前无法得知已转发的字节数),idleConfirmDelay后活动时间仍没有变化才确认空闲并结束转发
+func (p *pipeState) checkIdle() {
+	if atomic.LoadInt32(&p.done) == 1 {
+		return
+	}
+
+	last := atomic.LoadInt64(&p.lastActivity)
+	since := time.Since(time.Unix(0, last))
+	if since < p.idle {
+		p.timer.Reset(p.idle - since)
+		return
+	}
+
+	if p.woken == last {
+		atomic.StoreInt32(&p.timedOut, 1)
+		p.stop()
+		return
+	}
+	p.woken = last
+	p.left.SetReadDeadline(time.Now())
+	p.right.SetReadDeadline(time.Now())
+	p.timer.Reset(idleConfirmDelay)
+}
+
+// stop 结束两个方向的转发
+func (p *pipeState) stop() {
+	atomic.StoreInt32(&p.done, 1)
+	p.left.SetReadDeadline(time.Now())
+	p.right.SetReadDeadline(time.Now())
+}
+
+// afterTimeout 读超时后判断是否继续转发,空闲超时由checkIdle确认后结束
+func (p *pipeState) afterTimeout() bool {
+	return atomic.LoadInt32(&p.done) == 0
+}
+
+// setReadDeadline 设置src下一次读的超时,设置后任一方向已经结束时返回false。
+// 先设置再检查done,保证不会覆盖stop设置的超时后一直阻塞
+func (p *pipeState) setReadDeadline(src Stream, t time.Time) bool {
+	src.SetReadDeadline(t)
+	return atomic.LoadInt32(&p.done) == 0
+}
+
+// relay 两端都是tcp连接时使用splice转发,否则使用用户态缓冲区拷贝
+func (p *pipeState) relay(dst Stream, src Stream, up bool) (int64, error) {
+	d, s := tcpConnOf(dst), tcpConnOf(src)
+	if d != nil && s != nil {
+		return p.spliceStream(d, s, up)
+	}
+	return p.unidirectionalStream(dst, src, up)
+}
+
+// closeWrite 关闭s的写方向,s不支持半关闭时返回错误
+func closeWrite(s Stream) error {
+	switch c := s.(type) {
+	case *proxyProtoConn:
+		return closeWrite(c.Conn)
+	case *bufferedStream:
+		return closeWrite(c.Stream)
+	case *trackedConn:
+		return closeWrite(c.Stream)
+	case interface{ CloseWrite() error }:
+		return c.CloseWrite()
+	default:
+		return errors.New("half close not supported")
+	}
+}
+
+// tcpConnOf 返回s底层的*net.TCPConn,有未读完的缓冲数据或不是tcp连接时返回nil
+func tcpConnOf(s Stream) *net.TCPConn {
+	switch c := s.(type) {
+	case *net.TCPConn:
+		return c
+	case *proxyProtoConn:
+		return tcpConnOf(c.Conn)
+	case *bufferedStream:
+		if c.reader.Buffered() > 0 {
+			return nil
+		}
+		return tcpConnOf(c.Stream)
+	case *trackedConn:
+		return tcpConnOf(c.Stream)
+	default:
+		return nil
+	}
+}
+
+// spliceChunkSize 每次ReadFrom最多转发的字节数
+const spliceChunkSize = 1 << 20
+
+// spliceActivityInterval 有数据时splice转发汇报流量的最长间隔
+const spliceActivityInterval = time.Second
+
+// spliceStream 使用TCPConn.ReadFrom转发,linux下会使用splice(2)在内核中拷贝数据。
+// ReadFrom返回前无法得知已转发的字节数,所以每次最多转发spliceChunkSize字节,
+// 有数据时用读超时使其至少每spliceActivityInterval返回一次,以更新活动时间和流量统计,
+// 没有数据时不设置超时,空闲的连接不会被定期唤醒
+func (p *pipeState) spliceStream(dst *net.TCPConn, src *net.TCPConn, up bool) (written int64, err error) {
+	active := true
+	for {
+		var deadline time.Time
+		if active {
+			deadline = time.Now().Add(spliceActivityInterval)
+		}
+		if !p.setReadDeadline(src, deadline) {
+			return written, nil
+		}
+
+		lr := &io.LimitedReader{R: src, N: spliceChunkSize}
+		n, er := dst.ReadFrom(lr)
+		if n > 0 {
+			written += n
+			p.activity(int(n), up)
+		}
+		active = n > 0
+
+		if er != nil {
+			if ne, ok := er.(net.Error); ok && ne.Timeout() && p.afterTimeout() {
+				continue
+			}
+			return written, er
+		}
+		if lr.N > 0 {
+			//未读满且没有错误,src已经EOF
+			return written, nil
+		}
+	}
+}
+
+// unidirectionalStream 将数据从 src 拷贝到 dst, 每次拷贝数据时更新活动时间
+func (p *pipeState) unidirectionalStream(dst Stream, src Stream, up bool) (written int64, err error) {
 	buf := pool.GetBuf(SocketBufSize)
 	defer pool.PutBuf(buf)
 
 	for {
-		// 这里不设置独立的超时，转而依靠全局监控
+		// 这里不设置独立的超时，转而依靠空闲检查唤醒
 		nr, er := src.Read(buf)
 		if nr > 0 {
-			// 数据到达，更新活动时间
-			activityCallback()
 			nw, ew := dst.Write(buf[0:nr])
 			if nw < 0 || nr < nw {
 				nw = 0
@@ -81,6 +242,8 @@ func unidirectionalStream(dst Stream, src Stream, activityCallback func()) (writ
 				}
 			}
 			written += int64(nw)
+			// 数据到达，更新活动时间
+			p.activity(nw, up)
 			if ew != nil {
 				err = ew
 				break
@@ -91,6 +254,12 @@ func unidirectionalStream(dst Stream, src Stream, activityCallback func()) (writ
 			}
 		}
 		if er != nil {
+			if ne, ok := er.(net.Error); ok && ne.Timeout() && p.afterTimeout() {
+				if p.setReadDeadline(src, time.Time{}) {
+					continue
+				}
+				break
+			}
 			if er != io.EOF {
 				err = er
 			}
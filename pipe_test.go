@@ -0,0 +1,195 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// noSpliceConn 隐藏*net.TCPConn类型,使pipe使用用户态拷贝,仍然支持CloseWrite
+type noSpliceConn struct {
+	*net.TCPConn
+}
+
+// tcpPair 返回loopback上一对相连的tcp连接
+func tcpPair(t testing.TB) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := <-accepted
+	if s == nil {
+		t.Fatal("accept failed")
+	}
+	return c.(*net.TCPConn), s.(*net.TCPConn)
+}
+
+// startTestPipe client<->left pipe right<->target
+func startTestPipe(t testing.TB, splice bool, timeout time.Duration, session *Session) (client, target net.Conn, result chan error) {
+	client, left := tcpPair(t)
+	right, target := tcpPair(t)
+
+	var l, r Stream = left, right
+	if !splice {
+		l, r = noSpliceConn{left}, noSpliceConn{right}
+	}
+
+	result = make(chan error, 1)
+	go func() {
+		err := pipe(l, r, timeout, session)
+		left.Close()
+		right.Close()
+		result <- err
+	}()
+	return client, target, result
+}
+
+func TestPipe_Splice(t *testing.T) {
+	if tcpConnOf(noSpliceConn{}) != nil {
+		t.Fatal("noSpliceConn should not splice")
+	}
+
+	for _, splice := range []bool{true, false} {
+		session := newSession("", &net.TCPConn{})
+		client, target, result := startTestPipe(t, splice, 10*time.Second, session)
+
+		target.Write([]byte("down"))
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "down" {
+			t.Fatalf("splice:%v down:%s %v", splice, buf, err)
+		}
+
+		up := bytes.Repeat([]byte("u"), 3*spliceChunkSize+123)
+		go client.Write(up)
+		got, err := ioutil.ReadAll(io.LimitReader(target, int64(len(up))))
+		if err != nil || !bytes.Equal(got, up) {
+			t.Fatalf("splice:%v up:%d %v", splice, len(got), err)
+		}
+		client.Close()
+		target.Close()
+
+		select {
+		case err := <-result:
+			if err != nil {
+				t.Fatalf("splice:%v pipe:%v", splice, err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("splice:%v pipe not finished", splice)
+		}
+		client.Close()
+
+		info := session.Info()
+		if info.BytesUp != int64(len(up)) || info.BytesDown != 4 {
+			t.Fatalf("splice:%v bytes:%d %d", splice, info.BytesUp, info.BytesDown)
+		}
+	}
+}
+
+func TestPipe_HalfClose(t *testing.T) {
+	for _, splice := range []bool{true, false} {
+		client, target, result := startTestPipe(t, splice, 10*time.Second, nil)
+
+		client.Write([]byte("request"))
+		client.(*net.TCPConn).CloseWrite()
+
+		got, err := ioutil.ReadAll(target)
+		if err != nil || string(got) != "request" {
+			t.Fatalf("splice:%v target read:%s %v", splice, got, err)
+		}
+
+		//客户端半关闭后,目标仍然可以发送应答
+		target.Write([]byte("response"))
+		target.Close()
+
+		got, err = ioutil.ReadAll(client)
+		if err != nil || string(got) != "response" {
+			t.Fatalf("splice:%v client read:%s %v", splice, got, err)
+		}
+		client.Close()
+
+		select {
+		case err := <-result:
+			if err != nil {
+				t.Fatalf("splice:%v pipe:%v", splice, err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("splice:%v pipe not finished", splice)
+		}
+	}
+}
+
+func TestPipe_IdleTimeout(t *testing.T) {
+	for _, splice := range []bool{true, false} {
+		client, target, result := startTestPipe(t, splice, time.Second, nil)
+
+		//只有一个方向有数据时不算空闲
+		go func() {
+			buf := make([]byte, 16)
+			for {
+				if _, err := client.Read(buf); err != nil {
+					return
+				}
+			}
+		}()
+		for i := 0; i < 6; i++ {
+			target.Write([]byte("tick"))
+			time.Sleep(300 * time.Millisecond)
+		}
+		select {
+		case err := <-result:
+			t.Fatalf("splice:%v pipe finished while active:%v", splice, err)
+		default:
+		}
+
+		select {
+		case err := <-result:
+			if err != ErrIdleTimeout {
+				t.Fatalf("splice:%v pipe:%v", splice, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("splice:%v idle timeout not triggered", splice)
+		}
+		client.Close()
+		target.Close()
+	}
+}
+
+func benchmarkPipe(b *testing.B, splice bool) {
+	client, target, _ := startTestPipe(b, splice, time.Minute, nil)
+	defer client.Close()
+	defer target.Close()
+
+	go io.Copy(ioutil.Discard, target)
+
+	buf := make([]byte, 128*1024)
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPipe_Splice(b *testing.B) {
+	benchmarkPipe(b, true)
+}
+
+func BenchmarkPipe_Copy(b *testing.B) {
+	benchmarkPipe(b, false)
+}
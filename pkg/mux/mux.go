@@ -0,0 +1,374 @@
+// Package mux 在一个可靠的连接上复用多个双向流,每个流有独立的流量控制,支持半关闭。
+//
+// 帧格式: type(1) | stream id(4) | length(2) | payload,多字节整数为大端序。
+// 发起会话的一方(Client)使用奇数流id,另一方(Server)使用偶数流id,双方都可以打开流。
+package mux
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	typeOpen   byte = iota + 1 //打开流,payload为流的对端地址,可以为空
+	typeData                   //数据
+	typeClose                  //发送方不再写入
+	typeReset                  //中止流,双方都不再写入
+	typeWindow                 //接收方已读取的字节数,payload为uint32,发送方可以继续发送这么多字节
+	typePing                   //保活,不需要应答
+)
+
+const headerSize = 7
+const maxPayload = 65535
+
+// Window 每个流的接收窗口,字节,对端最多发送这么多未被读取的数据
+const Window = 256 * 1024
+
+// DefaultKeepAlive 默认的保活间隔
+const DefaultKeepAlive = 30 * time.Second
+
+// DefaultAcceptBacklog 默认的未Accept的流的最大数量
+const DefaultAcceptBacklog = 256
+
+var (
+	ErrSessionClosed = errors.New("mux: session closed")
+	ErrStreamClosed  = errors.New("mux: stream closed")
+	ErrStreamReset   = errors.New("mux: stream reset by peer")
+	ErrTooManyStream = errors.New("mux: stream id exhausted")
+)
+
+type Config struct {
+	KeepAlive     time.Duration //发送保活帧的间隔,超过3倍间隔没有收到任何帧或写入阻塞时关闭会话,为0时使用DefaultKeepAlive,小于0时不检测
+	AcceptBacklog int           //未Accept的流的最大数量,超过时拒绝对端打开的流,为0时使用DefaultAcceptBacklog
+	TrustRemote   bool          //使用对端打开流时指定的地址作为流的RemoteAddr,只在对端可信时开启,否则总是使用会话连接的地址
+}
+
+// Session 一个复用的连接
+type Session struct {
+	conn      net.Conn
+	keepAlive time.Duration
+	trust     bool //信任对端打开流时指定的地址
+
+	wmu  sync.Mutex //写帧的锁,保证帧完整写入
+	wbuf []byte
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32 //本端打开的下一个流id
+	parity  uint32 //本端流id的奇偶性
+	accepts chan *Stream
+
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+// Client 在主动发起的连接上创建会话
+func Client(conn net.Conn, cfg *Config) *Session {
+	return newSession(conn, cfg, 1)
+}
+
+// Server 在接受的连接上创建会话
+func Server(conn net.Conn, cfg *Config) *Session {
+	return newSession(conn, cfg, 2)
+}
+
+func newSession(conn net.Conn, cfg *Config, firstID uint32) *Session {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	backlog := cfg.AcceptBacklog
+	if backlog <= 0 {
+		backlog = DefaultAcceptBacklog
+	}
+
+	p := &Session{
+		conn:      conn,
+		keepAlive: cfg.KeepAlive,
+		trust:     cfg.TrustRemote,
+		wbuf:      make([]byte, headerSize+maxPayload),
+		streams:   make(map[uint32]*Stream),
+		nextID:    firstID,
+		parity:    firstID % 2,
+		accepts:   make(chan *Stream, backlog),
+		done:      make(chan struct{}),
+	}
+	if p.keepAlive == 0 {
+		p.keepAlive = DefaultKeepAlive
+	}
+
+	go p.recvLoop()
+	if p.keepAlive > 0 {
+		go p.keepAliveLoop()
+	}
+	return p
+}
+
+// Open 打开一个流,对端开启TrustRemote时remote作为对端Accept得到的流的RemoteAddr,为空时对端使用会话连接的地址
+func (p *Session) Open(remote string) (*Stream, error) {
+	if len(remote) > maxPayload {
+		return nil, errors.New("mux: remote address too long")
+	}
+
+	p.mu.Lock()
+	if p.err != nil {
+		p.mu.Unlock()
+		return nil, p.err
+	}
+	id := p.nextID
+	if id > id+2 {
+		p.mu.Unlock()
+		return nil, ErrTooManyStream
+	}
+	p.nextID += 2
+	s := newStream(p, id, p.conn.RemoteAddr())
+	p.streams[id] = s
+	p.mu.Unlock()
+
+	if err := p.writeFrame(typeOpen, id, []byte(remote)); err != nil {
+		p.remove(id)
+		return nil, err
+	}
+	return s, nil
+}
+
+// Accept 返回对端打开的流,会话关闭后返回错误
+func (p *Session) Accept() (*Stream, error) {
+	select {
+	case s := <-p.accepts:
+		return s, nil
+	case <-p.done:
+		return nil, p.Err()
+	}
+}
+
+// Close 关闭会话和所有的流
+func (p *Session) Close() error {
+	p.closeWithErr(ErrSessionClosed)
+	return nil
+}
+
+// Done 会话关闭时关闭返回的chan
+func (p *Session) Done() <-chan struct{} {
+	return p.done
+}
+
+// Err 返回会话关闭的原因,未关闭时返回nil
+func (p *Session) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// NumStreams 返回当前打开的流的数量
+func (p *Session) NumStreams() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.streams)
+}
+
+func (p *Session) LocalAddr() net.Addr {
+	return p.conn.LocalAddr()
+}
+
+func (p *Session) RemoteAddr() net.Addr {
+	return p.conn.RemoteAddr()
+}
+
+func (p *Session) closeWithErr(err error) {
+	p.once.Do(func() {
+		p.mu.Lock()
+		p.err = err
+		streams := p.streams
+		p.streams = make(map[uint32]*Stream)
+		p.mu.Unlock()
+
+		close(p.done)
+		p.conn.Close()
+		for _, s := range streams {
+			s.abort(ErrSessionClosed)
+		}
+	})
+}
+
+func (p *Session) remove(id uint32) {
+	p.mu.Lock()
+	delete(p.streams, id)
+	p.mu.Unlock()
+}
+
+func (p *Session) stream(id uint32) *Stream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.streams[id]
+}
+
+func (p *Session) writeFrame(typ byte, id uint32, payload []byte) error {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+
+	select {
+	case <-p.done:
+		return p.Err()
+	default:
+	}
+
+	p.wbuf[0] = typ
+	binary.BigEndian.PutUint32(p.wbuf[1:], id)
+	binary.BigEndian.PutUint16(p.wbuf[5:], uint16(len(payload)))
+	n := copy(p.wbuf[headerSize:], payload)
+
+	if p.keepAlive > 0 {
+		p.conn.SetWriteDeadline(time.Now().Add(3 * p.keepAlive))
+	}
+	if _, err := p.conn.Write(p.wbuf[:headerSize+n]); err != nil {
+		p.closeWithErr(err)
+		return err
+	}
+	return nil
+}
+
+func (p *Session) writeWindow(id uint32, n uint32) error {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], n)
+	return p.writeFrame(typeWindow, id, b[:])
+}
+
+func (p *Session) keepAliveLoop() {
+	ticker := time.NewTicker(p.keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if p.writeFrame(typePing, 0, nil) != nil {
+				return
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *Session) recvLoop() {
+	r := bufio.NewReaderSize(p.conn, headerSize+maxPayload)
+	var hdr [headerSize]byte
+	payload := make([]byte, maxPayload)
+	for {
+		if p.keepAlive > 0 {
+			p.conn.SetReadDeadline(time.Now().Add(3 * p.keepAlive))
+		}
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			p.closeWithErr(err)
+			return
+		}
+		typ := hdr[0]
+		id := binary.BigEndian.Uint32(hdr[1:])
+		data := payload[:binary.BigEndian.Uint16(hdr[5:])]
+		if _, err := io.ReadFull(r, data); err != nil {
+			p.closeWithErr(err)
+			return
+		}
+
+		if err := p.handleFrame(typ, id, data); err != nil {
+			p.closeWithErr(err)
+			return
+		}
+	}
+}
+
+func (p *Session) handleFrame(typ byte, id uint32, data []byte) error {
+	switch typ {
+	case typePing:
+		return nil
+	case typeOpen:
+		return p.handleOpen(id, string(data))
+	}
+
+	//流已经关闭时忽略,本端关闭时已经通知对端
+	s := p.stream(id)
+	if s == nil {
+		return nil
+	}
+	switch typ {
+	case typeData:
+		if !s.push(data) {
+			p.remove(id)
+			go p.writeFrame(typeReset, id, nil)
+		}
+	case typeClose:
+		if s.remoteClose() {
+			p.remove(id)
+		}
+	case typeReset:
+		p.remove(id)
+		s.abort(ErrStreamReset)
+	case typeWindow:
+		if len(data) != 4 {
+			return errors.New("mux: invalid window frame")
+		}
+		s.grow(binary.BigEndian.Uint32(data))
+	default:
+		return errors.New("mux: unknown frame type " + strconv.Itoa(int(typ)))
+	}
+	return nil
+}
+
+func (p *Session) handleOpen(id uint32, remote string) error {
+	//对端打开的流id的奇偶性与本端相反
+	if id%2 == p.parity {
+		return errors.New("mux: invalid stream id " + strconv.FormatUint(uint64(id), 10))
+	}
+
+	var addr net.Addr = p.conn.RemoteAddr()
+	if p.trust && len(remote) > 0 {
+		addr = parseAddr(remote)
+	}
+
+	p.mu.Lock()
+	if _, ok := p.streams[id]; ok {
+		p.mu.Unlock()
+		return errors.New("mux: duplicate stream id " + strconv.FormatUint(uint64(id), 10))
+	}
+	s := newStream(p, id, addr)
+	p.streams[id] = s
+	p.mu.Unlock()
+
+	select {
+	case p.accepts <- s:
+	default:
+		p.remove(id)
+		go p.writeFrame(typeReset, id, nil)
+	}
+	return nil
+}
+
+// Addr 打开流时指定的不是ip:port格式的对端地址
+type Addr string
+
+func (a Addr) Network() string {
+	return "mux"
+}
+
+func (a Addr) String() string {
+	return string(a)
+}
+
+// parseAddr ip:port格式的地址解析为*net.TCPAddr,其它格式原样保留
+func parseAddr(s string) net.Addr {
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return Addr(s)
+	}
+	ip := net.ParseIP(host)
+	port, err := strconv.Atoi(portStr)
+	if ip == nil || err != nil {
+		return Addr(s)
+	}
+	return &net.TCPAddr{IP: ip, Port: port}
+}
@@ -0,0 +1,187 @@
+package mux
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestPair(t *testing.T) (*Session, *Session) {
+	c1, c2 := net.Pipe()
+	client := Client(c1, nil)
+	server := Server(c2, nil)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestStream_Echo(t *testing.T) {
+	client, server := newTestPair(t)
+
+	go func() {
+		for {
+			s, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(s, s)
+				s.CloseWrite()
+			}()
+		}
+	}()
+
+	s, err := client.Open("10.0.0.1:1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//超过接收窗口的数据需要等待窗口更新
+	data := bytes.Repeat([]byte("0123456789"), Window/5)
+	go func() {
+		s.Write(data)
+		s.CloseWrite()
+	}()
+	got, err := ioutil.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("echo %d bytes, want %d", len(got), len(data))
+	}
+	s.Close()
+
+	//对端打开的流,RemoteAddr为打开时指定的地址
+	s2, err := server.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	accepted, err := client.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accepted.RemoteAddr().String() != client.RemoteAddr().String() {
+		t.Fatalf("remote addr:%s", accepted.RemoteAddr())
+	}
+}
+
+func TestStream_RemoteAddr(t *testing.T) {
+	//不信任对端时忽略打开流时指定的地址
+	client, server := newTestPair(t)
+	if _, err := client.Open("10.0.0.1:1234"); err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accepted.RemoteAddr().String() != server.RemoteAddr().String() {
+		t.Fatalf("untrusted remote addr:%s", accepted.RemoteAddr())
+	}
+
+	c1, c2 := net.Pipe()
+	client = Client(c1, nil)
+	server = Server(c2, &Config{TrustRemote: true})
+	defer client.Close()
+	defer server.Close()
+	for _, addr := range []string{"10.0.0.1:1234", "[::1]:80", "/tmp/ss5.sock"} {
+		s, err := client.Open(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepted, err := server.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accepted.RemoteAddr().String() != addr {
+			t.Fatalf("remote addr:%s want %s", accepted.RemoteAddr(), addr)
+		}
+		if _, ok := accepted.RemoteAddr().(*net.TCPAddr); ok == (addr[0] == '/') {
+			t.Fatalf("%s parsed as %T", addr, accepted.RemoteAddr())
+		}
+		s.Close()
+	}
+}
+
+func TestStream_CloseAndReset(t *testing.T) {
+	client, server := newTestPair(t)
+
+	s, err := client.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//关闭前写入的数据仍然可以读取
+	s.Write([]byte("bye"))
+	s.Close()
+	buf := make([]byte, 16)
+	n, err := accepted.Read(buf)
+	if err != nil || string(buf[:n]) != "bye" {
+		t.Fatalf("read:%q %v", buf[:n], err)
+	}
+	if _, err := accepted.Read(buf); err != io.EOF {
+		t.Fatalf("read after close:%v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := accepted.Write([]byte("x")); err == ErrStreamReset {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("write after peer close not reset")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := server.NumStreams(); n != 0 {
+		t.Fatalf("server streams:%d", n)
+	}
+}
+
+func TestStream_Deadline(t *testing.T) {
+	client, server := newTestPair(t)
+
+	s, err := client.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Accept(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = s.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("expect timeout:%v", err)
+	}
+
+	//关闭会话时阻塞的读返回
+	s.SetReadDeadline(time.Time{})
+	errs := make(chan error, 1)
+	go func() {
+		_, err := s.Read(make([]byte, 1))
+		errs <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	server.Close()
+	select {
+	case err := <-errs:
+		if err != ErrSessionClosed {
+			t.Fatalf("read after session close:%v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("read not unblocked")
+	}
+	if _, err := client.Open(""); err == nil {
+		t.Fatal("open on closed session")
+	}
+}
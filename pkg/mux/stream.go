@@ -0,0 +1,278 @@
+package mux
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Stream 会话中的一个流,实现net.Conn,CloseWrite只关闭写方向
+type Stream struct {
+	id     uint32
+	sess   *Session
+	remote net.Addr
+
+	mu          sync.Mutex
+	buf         bytes.Buffer
+	unacked     uint32 //已读取还未通知对端的字节数
+	sendWindow  uint32 //还可以发送的字节数
+	readClosed  bool   //收到对端的关闭
+	writeClosed bool   //已发送关闭
+	closed      bool   //已调用Close
+	err         error  //流被中止的原因
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readCh        chan struct{}
+	writeCh       chan struct{}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "mux: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func newStream(sess *Session, id uint32, remote net.Addr) *Stream {
+	return &Stream{
+		id:         id,
+		sess:       sess,
+		remote:     remote,
+		sendWindow: Window,
+		readCh:     make(chan struct{}, 1),
+		writeCh:    make(chan struct{}, 1),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// wait 等待ch的通知,超过deadline时返回超时错误
+func wait(ch chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return timeoutError{}
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return nil
+	case <-timer.C:
+		return timeoutError{}
+	}
+}
+
+// Read 对端关闭后读完缓冲的数据返回io.EOF
+func (p *Stream) Read(b []byte) (int, error) {
+	for {
+		p.mu.Lock()
+		if p.buf.Len() > 0 {
+			n, _ := p.buf.Read(b)
+			var update uint32
+			if !p.readClosed && p.err == nil {
+				p.unacked += uint32(n)
+				if p.unacked >= Window/2 {
+					update, p.unacked = p.unacked, 0
+				}
+			}
+			p.mu.Unlock()
+
+			if update > 0 {
+				p.sess.writeWindow(p.id, update)
+			}
+			return n, nil
+		}
+		switch {
+		case p.closed:
+			p.mu.Unlock()
+			return 0, ErrStreamClosed
+		case p.readClosed:
+			p.mu.Unlock()
+			return 0, io.EOF
+		case p.err != nil:
+			err := p.err
+			p.mu.Unlock()
+			return 0, err
+		}
+		deadline := p.readDeadline
+		p.mu.Unlock()
+
+		if err := wait(p.readCh, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write 超过对端的接收窗口时阻塞直到对端读取
+func (p *Stream) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		p.mu.Lock()
+		switch {
+		case p.err != nil:
+			err := p.err
+			p.mu.Unlock()
+			return written, err
+		case p.closed || p.writeClosed:
+			p.mu.Unlock()
+			return written, ErrStreamClosed
+		}
+		if p.sendWindow == 0 {
+			deadline := p.writeDeadline
+			p.mu.Unlock()
+			if err := wait(p.writeCh, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+
+		n := len(b)
+		if n > maxPayload {
+			n = maxPayload
+		}
+		if uint32(n) > p.sendWindow {
+			n = int(p.sendWindow)
+		}
+		p.sendWindow -= uint32(n)
+		p.mu.Unlock()
+
+		if err := p.sess.writeFrame(typeData, p.id, b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// CloseWrite 通知对端不再写入,仍然可以读取对端发来的数据
+func (p *Stream) CloseWrite() error {
+	p.mu.Lock()
+	if p.writeClosed || p.closed || p.err != nil {
+		p.mu.Unlock()
+		return nil
+	}
+	p.writeClosed = true
+	done := p.readClosed
+	p.mu.Unlock()
+	notify(p.writeCh)
+
+	err := p.sess.writeFrame(typeClose, p.id, nil)
+	if done {
+		p.sess.remove(p.id)
+	}
+	return err
+}
+
+// Close 关闭流,对端还在发送数据时中止流
+func (p *Stream) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	sendClose := !p.writeClosed && p.err == nil
+	sendReset := !p.readClosed && p.err == nil
+	p.writeClosed = true
+	p.buf.Reset()
+	p.mu.Unlock()
+	notify(p.readCh)
+	notify(p.writeCh)
+
+	p.sess.remove(p.id)
+	var err error
+	if sendClose {
+		err = p.sess.writeFrame(typeClose, p.id, nil)
+	}
+	if sendReset && err == nil {
+		err = p.sess.writeFrame(typeReset, p.id, nil)
+	}
+	return err
+}
+
+func (p *Stream) LocalAddr() net.Addr {
+	return p.sess.conn.LocalAddr()
+}
+
+func (p *Stream) RemoteAddr() net.Addr {
+	return p.remote
+}
+
+func (p *Stream) SetDeadline(t time.Time) error {
+	p.SetReadDeadline(t)
+	return p.SetWriteDeadline(t)
+}
+
+func (p *Stream) SetReadDeadline(t time.Time) error {
+	p.mu.Lock()
+	p.readDeadline = t
+	p.mu.Unlock()
+	notify(p.readCh)
+	return nil
+}
+
+func (p *Stream) SetWriteDeadline(t time.Time) error {
+	p.mu.Lock()
+	p.writeDeadline = t
+	p.mu.Unlock()
+	notify(p.writeCh)
+	return nil
+}
+
+// push 收到数据,超过接收窗口时返回false
+func (p *Stream) push(data []byte) bool {
+	p.mu.Lock()
+	if p.closed || p.readClosed {
+		p.mu.Unlock()
+		return true
+	}
+	if p.buf.Len()+len(data) > Window {
+		p.mu.Unlock()
+		p.abort(ErrStreamReset)
+		return false
+	}
+	p.buf.Write(data)
+	p.mu.Unlock()
+	notify(p.readCh)
+	return true
+}
+
+// remoteClose 收到对端的关闭,两个方向都关闭时返回true
+func (p *Stream) remoteClose() bool {
+	p.mu.Lock()
+	p.readClosed = true
+	done := p.writeClosed
+	p.mu.Unlock()
+	notify(p.readCh)
+	return done
+}
+
+func (p *Stream) grow(n uint32) {
+	p.mu.Lock()
+	p.sendWindow += n
+	p.mu.Unlock()
+	notify(p.writeCh)
+}
+
+// abort 中止流,缓冲的数据仍然可以读取
+func (p *Stream) abort(err error) {
+	p.mu.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.mu.Unlock()
+	notify(p.readCh)
+	notify(p.writeCh)
+}
@@ -0,0 +1,102 @@
+package socks5
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const HTTPProxyRealm = "ss5"
+
+// hop-by-hop头部，转发时需要去掉
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// isHTTPMethodStart 判断首字节是否可能是http请求方法(GET,POST,CONNECT...)的首字母
+func isHTTPMethodStart(b byte) bool {
+	return b >= 'A' && b <= 'Z'
+}
+
+// parseProxyBasicAuth 解析 Proxy-Authorization: Basic xxx
+func parseProxyBasicAuth(h http.Header) (username, password string, ok bool) {
+	auth := h.Get("Proxy-Authorization")
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	c, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	cs := string(c)
+	s := strings.IndexByte(cs, ':')
+	if s < 0 {
+		return "", "", false
+	}
+	return cs[:s], cs[s+1:], true
+}
+
+func NewProxyBasicAuth(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+// removeHopHeaders 去掉hop-by-hop头部，包括Connection中列出的头部
+func removeHopHeaders(h http.Header) {
+	for _, f := range h["Connection"] {
+		for _, sf := range strings.Split(f, ",") {
+			if sf = strings.TrimSpace(sf); sf != "" {
+				h.Del(sf)
+			}
+		}
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
+
+// httpTargetAddr 从请求中取得目标地址，没有端口时补上默认端口
+func httpTargetAddr(host string, defaultPort string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return net.JoinHostPort(host, defaultPort)
+}
+
+// httpStatusFromRep 将socks5的应答码转换为http状态码
+func httpStatusFromRep(rep byte) int {
+	switch rep {
+	case RepRuleFailure:
+		return http.StatusForbidden
+	case RepTTLExpired:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+func newHTTPReply(code int, header http.Header) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "HTTP/1.1 %d %s\r\n", code, http.StatusText(code))
+	for k, vs := range header {
+		for _, v := range vs {
+			fmt.Fprintf(&b, "%s: %s\r\n", k, v)
+		}
+	}
+	if code != http.StatusOK {
+		b.WriteString("Connection: close\r\nContent-Length: 0\r\n")
+	}
+	b.WriteString("\r\n")
+	return []byte(b.String())
+}
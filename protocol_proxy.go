@@ -0,0 +1,230 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HAProxy PROXY protocol
+// https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+
+const (
+	ProxyProtoV1 = "v1"
+	ProxyProtoV2 = "v2"
+
+	proxyProtoV1MaxLen = 107
+
+	proxyProtoV2CmdLocal = 0x00
+	proxyProtoV2CmdProxy = 0x01
+
+	proxyProtoV2FamTCP4 = 0x11
+	proxyProtoV2FamTCP6 = 0x21
+	proxyProtoV2FamUDP4 = 0x12
+	proxyProtoV2FamUDP6 = 0x22
+)
+
+var proxyProtoV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var ErrProxyProtoHeader = errors.New("invalid proxy protocol header")
+
+// ProxyProtoHeader PROXY头部中的源地址和目标地址，LOCAL命令或UNKNOWN协议时地址为nil
+type ProxyProtoHeader struct {
+	Version  string
+	SrcAddr  net.Addr
+	DestAddr net.Addr
+}
+
+// NewProxyProtoHeaderFrom 从r中读取一个v1或v2的PROXY头部，不会多读头部之后的数据
+func NewProxyProtoHeaderFrom(r io.Reader) (*ProxyProtoHeader, error) {
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case string(b) == "PROXY":
+		return readProxyProtoV1(r)
+	case bytes.Equal(b, proxyProtoV2Sig[:5]):
+		return readProxyProtoV2(r)
+	default:
+		return nil, ErrProxyProtoHeader
+	}
+}
+
+func readProxyProtoV1(r io.Reader) (*ProxyProtoHeader, error) {
+	line := []byte("PROXY")
+	var c [1]byte
+	for {
+		if _, err := io.ReadFull(r, c[:]); err != nil {
+			return nil, err
+		}
+		line = append(line, c[0])
+		if c[0] == '\n' {
+			break
+		}
+		if len(line) >= proxyProtoV1MaxLen {
+			return nil, ErrProxyProtoHeader
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrProxyProtoHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	h := &ProxyProtoHeader{Version: ProxyProtoV1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrProxyProtoHeader
+	}
+
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil {
+		return nil, ErrProxyProtoHeader
+	}
+
+	h.SrcAddr = &net.TCPAddr{IP: srcIP, Port: int(srcPort)}
+	h.DestAddr = &net.TCPAddr{IP: dstIP, Port: int(dstPort)}
+	return h, nil
+}
+
+func readProxyProtoV2(r io.Reader) (*ProxyProtoHeader, error) {
+	b := make([]byte, len(proxyProtoV2Sig)-5+4)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(b[:len(proxyProtoV2Sig)-5], proxyProtoV2Sig[5:]) {
+		return nil, ErrProxyProtoHeader
+	}
+
+	b = b[len(proxyProtoV2Sig)-5:]
+	verCmd, fam := b[0], b[1]
+	if verCmd>>4 != 0x02 {
+		return nil, ErrProxyProtoHeader
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(b[2:4]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	h := &ProxyProtoHeader{Version: ProxyProtoV2}
+	switch verCmd & 0x0f {
+	case proxyProtoV2CmdLocal:
+		return h, nil
+	case proxyProtoV2CmdProxy:
+	default:
+		return nil, ErrProxyProtoHeader
+	}
+
+	var ipLen int
+	switch fam {
+	case proxyProtoV2FamTCP4, proxyProtoV2FamUDP4:
+		ipLen = net.IPv4len
+	case proxyProtoV2FamTCP6, proxyProtoV2FamUDP6:
+		ipLen = net.IPv6len
+	default:
+		//unix socket等不支持的地址族，视为没有地址
+		return h, nil
+	}
+
+	if len(payload) < ipLen*2+4 {
+		return nil, ErrProxyProtoHeader
+	}
+
+	srcIP := net.IP(payload[:ipLen])
+	dstIP := net.IP(payload[ipLen : ipLen*2])
+	srcPort := int(binary.BigEndian.Uint16(payload[ipLen*2:]))
+	dstPort := int(binary.BigEndian.Uint16(payload[ipLen*2+2:]))
+
+	if fam == proxyProtoV2FamUDP4 || fam == proxyProtoV2FamUDP6 {
+		h.SrcAddr = &net.UDPAddr{IP: srcIP, Port: srcPort}
+		h.DestAddr = &net.UDPAddr{IP: dstIP, Port: dstPort}
+	} else {
+		h.SrcAddr = &net.TCPAddr{IP: srcIP, Port: srcPort}
+		h.DestAddr = &net.TCPAddr{IP: dstIP, Port: dstPort}
+	}
+	return h, nil
+}
+
+// ToBytes 编码PROXY头部，源或目标地址不是tcp地址时编码为UNKNOWN/LOCAL
+func (p *ProxyProtoHeader) ToBytes() ([]byte, error) {
+	src, _ := p.SrcAddr.(*net.TCPAddr)
+	dst, _ := p.DestAddr.(*net.TCPAddr)
+
+	var srcIP, dstIP net.IP
+	if src != nil && dst != nil {
+		srcIP, dstIP = src.IP.To4(), dst.IP.To4()
+		if srcIP == nil || dstIP == nil {
+			srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+		}
+	}
+
+	switch p.Version {
+	case ProxyProtoV1:
+		if srcIP == nil || dstIP == nil {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		proto := "TCP4"
+		if len(srcIP) == net.IPv6len {
+			proto = "TCP6"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, srcIP, dstIP, src.Port, dst.Port)), nil
+	case ProxyProtoV2:
+		b := append([]byte{}, proxyProtoV2Sig...)
+		if srcIP == nil || dstIP == nil {
+			return append(b, 0x20|proxyProtoV2CmdLocal, 0x00, 0x00, 0x00), nil
+		}
+
+		fam := byte(proxyProtoV2FamTCP4)
+		if len(srcIP) == net.IPv6len {
+			fam = proxyProtoV2FamTCP6
+		}
+		b = append(b, 0x20|proxyProtoV2CmdProxy, fam, 0, 0)
+		binary.BigEndian.PutUint16(b[len(b)-2:], uint16(len(srcIP)*2+4))
+		b = append(b, srcIP...)
+		b = append(b, dstIP...)
+		b = append(b, byte(src.Port>>8), byte(src.Port), byte(dst.Port>>8), byte(dst.Port))
+		return b, nil
+	default:
+		return nil, fmt.Errorf("unknown proxy protocol version:%s", p.Version)
+	}
+}
+
+const proxyProtoReadTimeout = 5 * time.Second
+
+// proxyProtoConn RemoteAddr返回PROXY头部中的源地址
+type proxyProtoConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (p *proxyProtoConn) RemoteAddr() net.Addr {
+	return p.remoteAddr
+}
+
+// readProxyProtoConn 读取conn开头的PROXY头部，LOCAL命令(如负载均衡的健康检查)时保留原地址
+func readProxyProtoConn(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyProtoReadTimeout))
+	h, err := NewProxyProtoHeaderFrom(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	if h.SrcAddr == nil {
+		return conn, nil
+	}
+	return &proxyProtoConn{Conn: conn, remoteAddr: h.SrcAddr}, nil
+}
@@ -0,0 +1,49 @@
+package socks5
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestProxyProtoHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 1080}
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 1080}
+
+	for _, version := range []string{ProxyProtoV1, ProxyProtoV2} {
+		for _, addrs := range [][2]*net.TCPAddr{{src, dst}, {src6, dst6}} {
+			h := &ProxyProtoHeader{Version: version, SrcAddr: addrs[0], DestAddr: addrs[1]}
+			b, err := h.ToBytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := bytes.NewReader(append(b, "payload"...))
+			got, err := NewProxyProtoHeaderFrom(r)
+			if err != nil {
+				t.Fatalf("%s:%v", version, err)
+			}
+			if got.Version != version || got.SrcAddr.String() != addrs[0].String() || got.DestAddr.String() != addrs[1].String() {
+				t.Fatalf("%s:got %+v", version, got)
+			}
+			if r.Len() != len("payload") {
+				t.Fatalf("%s:read past header", version)
+			}
+		}
+	}
+
+	for _, raw := range []string{"PROXY UNKNOWN\r\n", "PROXY TCP4 1.1.1.1 2.2.2.2 1 2\n", "GET / HTTP/1.1\r\n"} {
+		h, err := NewProxyProtoHeaderFrom(bytes.NewReader([]byte(raw)))
+		if raw == "PROXY UNKNOWN\r\n" {
+			if err != nil || h.SrcAddr != nil {
+				t.Fatalf("%q:%v", raw, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Fatalf("%q:expect error", raw)
+		}
+	}
+}
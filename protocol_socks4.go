@@ -34,8 +34,9 @@ func NewReqSocks4(cmd byte, addr string) (*ReqSocks4, error) {
 
 	dstIP := make([]byte, 4)
 
+	//socks4只能传递ipv4地址,ipv6地址和域名使用socks4a的hostname
 	var hostname []byte
-	if ip := net.ParseIP(host); ip != nil {
+	if ip := net.ParseIP(host).To4(); ip != nil {
 		dstIP = ip
 	} else {
 		dstIP[0] = 0
@@ -0,0 +1,356 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	OutboundDirect = "direct"
+	OutboundBlock  = "block"
+)
+
+// routeResolveTimeout 匹配ip条件时解析目标域名的超时
+const routeResolveTimeout = 5 * time.Second
+
+// Router 路由规则,按顺序匹配,第一条匹配的规则决定直连、阻止还是经上游代理连接,没有匹配时直连
+type Router struct {
+	misses uint64 //没有匹配任何规则的次数
+	routes []*route
+}
+
+type route struct {
+	hits uint64
+
+	outbound string
+	upstream upstreamDialer //outbound为上游代理或上游代理组的名称时不为nil
+
+	clients   []*net.IPNet
+	ports     map[int]bool
+	domains   *domainSet
+	ips       []*net.IPNet
+	countries map[string]bool
+	geoip     *geoIP
+}
+
+// RouteStats 路由规则的命中次数,Index为-1时是没有匹配任何规则的次数
+type RouteStats struct {
+	Listener string
+	Index    int
+	Outbound string
+	Hits     uint64
+}
+
+// newRouter geo为各监听共用的GeoIP数据库,有使用GeoIP的路由时才打开
+func newRouter(cfgs []RouteCfg, upstreams map[string]upstreamDialer, geo *geoIPSource) (*Router, error) {
+	var db *geoIP
+	rt := &Router{}
+	for i, c := range cfgs {
+		if len(c.GeoIP) > 0 && db == nil {
+			var err error
+			if db, err = geo.open(); err != nil {
+				return nil, fmt.Errorf("route %d:%w", i, err)
+			}
+		}
+
+		r, err := newRoute(c, upstreams, db)
+		if err != nil {
+			return nil, fmt.Errorf("route %d:%w", i, err)
+		}
+		rt.routes = append(rt.routes, r)
+	}
+	return rt, nil
+}
+
+func newRoute(c RouteCfg, upstreams map[string]upstreamDialer, db *geoIP) (*route, error) {
+	r := &route{outbound: c.Outbound}
+	switch c.Outbound {
+	case OutboundDirect, OutboundBlock:
+	default:
+		r.upstream = upstreams[c.Outbound]
+		if r.upstream == nil {
+			return nil, fmt.Errorf("unknown outbound:%s", c.Outbound)
+		}
+	}
+
+	for _, s := range c.Clients {
+		n, err := parseIPNet(s)
+		if err != nil {
+			return nil, err
+		}
+		r.clients = append(r.clients, n)
+	}
+	for _, s := range c.IPs {
+		n, err := parseIPNet(s)
+		if err != nil {
+			return nil, err
+		}
+		r.ips = append(r.ips, n)
+	}
+
+	if len(c.GeoIP) > 0 {
+		r.geoip = db
+		r.countries = make(map[string]bool, len(c.GeoIP))
+		for _, code := range c.GeoIP {
+			r.countries[strings.ToUpper(code)] = true
+		}
+	}
+
+	if len(c.Ports) > 0 {
+		r.ports = make(map[int]bool, len(c.Ports))
+		for _, port := range c.Ports {
+			r.ports[port] = true
+		}
+	}
+
+	if len(c.Domains)+len(c.DomainKeywords)+len(c.DomainRegexps)+len(c.DomainFiles) > 0 {
+		r.domains = newDomainSet()
+		for _, s := range c.Domains {
+			r.domains.addSuffix(s)
+		}
+		for _, s := range c.DomainKeywords {
+			r.domains.keywords = append(r.domains.keywords, strings.ToLower(s))
+		}
+		for _, s := range c.DomainRegexps {
+			if err := r.domains.addRegexp(s); err != nil {
+				return nil, err
+			}
+		}
+		for _, path := range c.DomainFiles {
+			if err := r.domains.loadFile(path); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return r, nil
+}
+
+// routeTarget 匹配路由的目标,域名只在需要匹配ip条件时解析一次
+type routeTarget struct {
+	host     string //小写的域名,目标为ip时为空
+	ip       net.IP
+	port     int
+	resolve  func(host string) []net.IP
+	resolved []net.IP
+	done     bool
+}
+
+func newRouteTarget(target string, resolve func(host string) []net.IP) *routeTarget {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		host = target
+	}
+	t := &routeTarget{resolve: resolve}
+	t.port, _ = strconv.Atoi(portStr)
+	if t.ip = net.ParseIP(host); t.ip == nil {
+		t.host = strings.ToLower(strings.TrimSuffix(host, "."))
+	}
+	return t
+}
+
+func (p *routeTarget) ips() []net.IP {
+	if p.ip != nil {
+		return []net.IP{p.ip}
+	}
+	if !p.done {
+		p.done = true
+		if p.resolve != nil {
+			p.resolved = p.resolve(p.host)
+		}
+	}
+	return p.resolved
+}
+
+// lookupIPs 匹配路由时解析域名,解析失败时不匹配ip条件
+func lookupIPs(host string) []net.IP {
+	ctx, cancel := context.WithTimeout(context.Background(), routeResolveTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return ips
+}
+
+// match 返回client访问target(host:port)时第一条匹配的路由并计数,没有匹配时返回nil
+func (p *Router) match(client net.IP, target string, resolve func(host string) []net.IP) *route {
+	if p == nil || len(p.routes) == 0 {
+		return nil
+	}
+	r := p.find(client, target, resolve)
+	p.count(r)
+	return r
+}
+
+// find 与match相同但不计数,用于缓存匹配结果后按请求计数
+func (p *Router) find(client net.IP, target string, resolve func(host string) []net.IP) *route {
+	t := newRouteTarget(target, resolve)
+	for _, r := range p.routes {
+		if r.match(client, t) {
+			return r
+		}
+	}
+	return nil
+}
+
+// count 计入一次匹配到r的请求,r为nil时计入没有匹配
+func (p *Router) count(r *route) {
+	if r != nil {
+		atomic.AddUint64(&r.hits, 1)
+	} else {
+		atomic.AddUint64(&p.misses, 1)
+	}
+}
+
+func (p *route) match(client net.IP, t *routeTarget) bool {
+	if len(p.clients) > 0 && !ipNetsContain(p.clients, client) {
+		return false
+	}
+	if p.ports != nil && !p.ports[t.port] {
+		return false
+	}
+
+	if p.domains == nil && len(p.ips) == 0 && p.countries == nil {
+		return true
+	}
+	if t.ip == nil && p.domains != nil && p.domains.match(t.host) {
+		return true
+	}
+	if len(p.ips) == 0 && p.countries == nil {
+		return false
+	}
+
+	for _, ip := range t.ips() {
+		if ipNetsContain(p.ips, ip) {
+			return true
+		}
+		if p.countries != nil && p.countries[p.geoip.country(ip)] {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Router) stats(listener string) []RouteStats {
+	if p == nil || len(p.routes) == 0 {
+		return nil
+	}
+
+	stats := make([]RouteStats, 0, len(p.routes)+1)
+	for i, r := range p.routes {
+		stats = append(stats, RouteStats{Listener: listener, Index: i, Outbound: r.outbound, Hits: atomic.LoadUint64(&r.hits)})
+	}
+	return append(stats, RouteStats{Listener: listener, Index: -1, Outbound: OutboundDirect, Hits: atomic.LoadUint64(&p.misses)})
+}
+
+// domainSet 域名集合,支持完整匹配、后缀匹配、关键字和正则表达式
+type domainSet struct {
+	full     map[string]bool
+	suffixes map[string]bool //后缀匹配包括域名本身
+	keywords []string
+	regexps  []*regexp.Regexp
+}
+
+func newDomainSet() *domainSet {
+	return &domainSet{
+		full:     make(map[string]bool),
+		suffixes: make(map[string]bool),
+	}
+}
+
+func (p *domainSet) addSuffix(s string) {
+	p.suffixes[strings.ToLower(strings.Trim(s, "."))] = true
+}
+
+func (p *domainSet) addRegexp(s string) error {
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return err
+	}
+	p.regexps = append(p.regexps, re)
+	return nil
+}
+
+// add 添加域名列表文件中的一行,full:完整匹配,domain:后缀匹配,keyword:关键字,regexp:正则表达式,没有前缀时为后缀匹配
+func (p *domainSet) add(line string) error {
+	i := strings.Index(line, ":")
+	if i < 0 {
+		p.addSuffix(line)
+		return nil
+	}
+
+	v := line[i+1:]
+	switch line[:i] {
+	case "full":
+		p.full[strings.ToLower(strings.TrimSuffix(v, "."))] = true
+	case "domain":
+		p.addSuffix(v)
+	case "keyword":
+		p.keywords = append(p.keywords, strings.ToLower(v))
+	case "regexp":
+		return p.addRegexp(v)
+	default:
+		return fmt.Errorf("unknown domain type:%s", line[:i])
+	}
+	return nil
+}
+
+// loadFile 读取域名列表文件,每行一个,#开头的行为注释
+func (p *domainSet) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		if err := p.add(line); err != nil {
+			return fmt.Errorf("%s:%d:%w", path, n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (p *domainSet) match(host string) bool {
+	if p.full[host] {
+		return true
+	}
+	for s := host; ; {
+		if p.suffixes[s] {
+			return true
+		}
+		i := strings.IndexByte(s, '.')
+		if i < 0 {
+			break
+		}
+		s = s[i+1:]
+	}
+	for _, k := range p.keywords {
+		if strings.Contains(host, k) {
+			return true
+		}
+	}
+	for _, re := range p.regexps {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,206 @@
+package socks5
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestGeoIP 生成只有一个/8网段的ipv4 mmdb数据库,网段first.0.0.0/8属于country
+func writeTestGeoIP(t *testing.T, first byte, country string) string {
+	const nodeCount = 8
+	var buf []byte
+	for i := uint(0); i < nodeCount; i++ {
+		next := uint32(i + 1)
+		if i == nodeCount-1 {
+			next = nodeCount + 16 //指向数据段偏移0
+		}
+		left, right := uint32(nodeCount), uint32(nodeCount)
+		if first>>(7-i)&1 == 0 {
+			left = next
+		} else {
+			right = next
+		}
+		buf = append(buf, byte(left>>16), byte(left>>8), byte(left), byte(right>>16), byte(right>>8), byte(right))
+	}
+	buf = append(buf, make([]byte, 16)...)
+
+	mmdbString := func(s string) []byte {
+		return append([]byte{0x40 | byte(len(s))}, s...)
+	}
+	//{"country":{"iso_code":country}}
+	buf = append(buf, 0xe1)
+	buf = append(buf, mmdbString("country")...)
+	buf = append(buf, 0xe1)
+	buf = append(buf, mmdbString("iso_code")...)
+	buf = append(buf, mmdbString(country)...)
+
+	buf = append(buf, "\xab\xcd\xefMaxMind.com"...)
+	buf = append(buf, 0xe3)
+	buf = append(buf, mmdbString("node_count")...)
+	buf = append(buf, 0xc1, nodeCount)
+	buf = append(buf, mmdbString("record_size")...)
+	buf = append(buf, 0xa1, 24)
+	buf = append(buf, mmdbString("ip_version")...)
+	buf = append(buf, 0xa1, 4)
+
+	return writeTestFile(t, "country.mmdb", buf)
+}
+
+// writeTestFile 在测试结束后删除的临时目录中写入文件
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	dir, err := ioutil.TempDir("", "ss5route")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGeoIP(t *testing.T) {
+	db, err := openGeoIP(writeTestGeoIP(t, 10, "cn"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := db.country(net.ParseIP("10.1.2.3")); c != "CN" {
+		t.Fatalf("10.1.2.3:%s", c)
+	}
+	if c := db.country(net.ParseIP("11.1.2.3")); c != "" {
+		t.Fatalf("11.1.2.3:%s", c)
+	}
+}
+
+func TestServer_GeoIPShared(t *testing.T) {
+	cfg := ServerCfg{
+		UDPListen: "127.0.0.1:0",
+		GeoIPFile: writeTestGeoIP(t, 10, "CN"),
+		Listeners: []ListenerCfg{
+			{Listen: "127.0.0.1:0", Routes: []RouteCfg{{Outbound: OutboundBlock, GeoIP: []string{"CN"}}}},
+			{Listen: "127.0.0.1:0", Routes: []RouteCfg{{Outbound: OutboundDirect, GeoIP: []string{"CN"}}}},
+		},
+	}
+	s, err := newServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := func(i int) *geoIP {
+		return s.listeners[i].getConf().router.routes[0].geoip
+	}
+
+	//各监听共用一份数据库,重新加载时重新打开
+	first := db(0)
+	if first == nil || db(1) != first {
+		t.Fatal("expect listeners share one GeoIP database")
+	}
+	if err := s.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if db(0) == first || db(1) != db(0) {
+		t.Fatal("expect reload open one new GeoIP database")
+	}
+}
+
+func TestDomainSet(t *testing.T) {
+	list := "# comment\nexample.com\nfull:exact.org\nkeyword:tracker\nregexp:^ads[0-9]+\\.\n\n"
+	path := writeTestFile(t, "domains.txt", []byte(list))
+	ds := newDomainSet()
+	if err := ds.loadFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]bool{
+		"example.com":         true,
+		"www.example.com":     true,
+		"notexample.com":      false,
+		"exact.org":           true,
+		"www.exact.org":       false,
+		"cdn.tracker.net":     true,
+		"ads12.foo.com":       true,
+		"ads.foo.com":         false,
+		"unrelated.test":      false,
+		"deep.a.example.com":  true,
+		"example.com.evil.io": false,
+	}
+	for host, want := range cases {
+		if got := ds.match(host); got != want {
+			t.Fatalf("%s:%v want %v", host, got, want)
+		}
+	}
+
+	if err := ds.add("bad:foo"); err == nil {
+		t.Fatal("expect unknown domain type error")
+	}
+}
+
+func TestRouter_Match(t *testing.T) {
+	set, err := newUpstreamSet([]UpstreamCfg{{Name: "proxy", ClientCfg: ClientCfg{ServerAddr: "127.0.0.1:1"}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ups := set.dialers
+	rt, err := newRouter([]RouteCfg{
+		{Outbound: OutboundBlock, Domains: []string{"ads.example.com"}},
+		{Outbound: "proxy", DomainKeywords: []string{"google"}, Ports: []int{443}},
+		{Outbound: OutboundDirect, Clients: []string{"192.168.0.0/16"}, IPs: []string{"10.0.0.0/8"}},
+		{Outbound: "proxy", GeoIP: []string{"CN"}},
+	}, ups, newGeoIPSource(writeTestGeoIP(t, 10, "CN")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolve := func(host string) []net.IP {
+		if host == "cn.example.org" {
+			return []net.IP{net.ParseIP("10.0.0.1")}
+		}
+		return nil
+	}
+	client := net.ParseIP("127.0.0.1")
+	cases := []struct {
+		client net.IP
+		target string
+		want   string
+	}{
+		{client, "x.ads.example.com:80", OutboundBlock},
+		{client, "www.google.com:443", "proxy"},
+		{client, "www.google.com:80", ""},
+		{net.ParseIP("192.168.1.1"), "10.1.1.1:80", OutboundDirect},
+		{client, "10.1.1.1:80", "proxy"},
+		{client, "cn.example.org:80", "proxy"},
+		{client, "11.1.1.1:80", ""},
+	}
+	for _, c := range cases {
+		var got string
+		if r := rt.match(c.client, c.target, resolve); r != nil {
+			got = r.outbound
+		}
+		if got != c.want {
+			t.Fatalf("%s %s:%s want %s", c.client, c.target, got, c.want)
+		}
+	}
+
+	stats := rt.stats("test")
+	hits := []uint64{1, 1, 1, 2, 2}
+	for i, s := range stats {
+		if s.Hits != hits[i] {
+			t.Fatalf("stats:%+v", stats)
+		}
+	}
+	if stats[4].Index != -1 {
+		t.Fatalf("misses:%+v", stats[4])
+	}
+
+	if _, err := newRouter([]RouteCfg{{Outbound: "unknown"}}, ups, nil); err == nil {
+		t.Fatal("expect unknown outbound error")
+	}
+	if _, err := newRouter([]RouteCfg{{Outbound: "proxy", GeoIP: []string{"CN"}}}, ups, newGeoIPSource("")); err == nil {
+		t.Fatal("expect GeoIPFile required error")
+	}
+}
@@ -0,0 +1,184 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	RuleActionAllow = "allow"
+	RuleActionDeny  = "deny"
+)
+
+// RuleSet 访问规则，按顺序匹配，第一条匹配的规则决定是否允许
+type RuleSet struct {
+	rules []*rule
+}
+
+type rule struct {
+	allow   bool
+	clients []*net.IPNet
+	targets []*net.IPNet
+	domains []string
+	ports   map[int]bool
+
+	idleTimeout    int
+	maxLifetime    int
+	connectTimeout int
+}
+
+func NewRuleSet(cfgs []RuleCfg) (*RuleSet, error) {
+	rs := &RuleSet{}
+	for i, c := range cfgs {
+		r, err := newRule(c)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d:%w", i, err)
+		}
+		rs.rules = append(rs.rules, r)
+	}
+	return rs, nil
+}
+
+func newRule(c RuleCfg) (*rule, error) {
+	r := &rule{
+		idleTimeout:    c.IdleTimeout,
+		maxLifetime:    c.MaxLifetime,
+		connectTimeout: c.ConnectTimeout,
+	}
+
+	switch strings.ToLower(c.Action) {
+	case RuleActionAllow:
+		r.allow = true
+	case RuleActionDeny:
+	default:
+		return nil, fmt.Errorf("unknown action:%s", c.Action)
+	}
+
+	for _, s := range c.Clients {
+		n, err := parseIPNet(s)
+		if err != nil {
+			return nil, err
+		}
+		r.clients = append(r.clients, n)
+	}
+
+	for _, s := range c.Targets {
+		if n, err := parseIPNet(s); err == nil {
+			r.targets = append(r.targets, n)
+		} else {
+			r.domains = append(r.domains, strings.ToLower(strings.TrimPrefix(s, ".")))
+		}
+	}
+
+	if len(c.Ports) > 0 {
+		r.ports = make(map[int]bool, len(c.Ports))
+		for _, port := range c.Ports {
+			r.ports[port] = true
+		}
+	}
+	return r, nil
+}
+
+// parseIPNet 解析CIDR，单个ip视为/32或/128
+func parseIPNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		return n, err
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip:%s", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// Allow 判断client访问target(host:port)是否被允许，没有匹配的规则时允许
+func (p *RuleSet) Allow(client net.Addr, target string) bool {
+	r := p.match(client, target)
+	return r == nil || r.allow
+}
+
+// match 返回第一条匹配的规则，没有匹配时返回nil
+func (p *RuleSet) match(client net.Addr, target string) *rule {
+	if p == nil || len(p.rules) == 0 {
+		return nil
+	}
+
+	clientIP := addrIP(client)
+
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		host = target
+	}
+	port, _ := strconv.Atoi(portStr)
+	targetIP := net.ParseIP(host)
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	for _, r := range p.rules {
+		if r.match(clientIP, host, targetIP, port) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (p *rule) match(clientIP net.IP, host string, targetIP net.IP, port int) bool {
+	if len(p.clients) > 0 && !ipNetsContain(p.clients, clientIP) {
+		return false
+	}
+
+	if p.ports != nil && !p.ports[port] {
+		return false
+	}
+
+	if len(p.targets) == 0 && len(p.domains) == 0 {
+		return true
+	}
+
+	if targetIP != nil {
+		return ipNetsContain(p.targets, targetIP)
+	}
+
+	for _, d := range p.domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+func ipNetsContain(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP 取得地址中的ip，unix socket等没有ip的地址返回nil
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case nil:
+		return nil
+	default:
+		host, _, err := net.SplitHostPort(a.String())
+		if err != nil {
+			return nil
+		}
+		return net.ParseIP(host)
+	}
+}
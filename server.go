@@ -3,15 +3,26 @@ package socks5
 import (
 	"errors"
 	"fmt"
-	"github.com/sirupsen/logrus"
-	"io"
 	"net"
-	"time"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
 )
 
 type Server interface {
 	Run() error
 	SetCustomTcpConnHandler(handler func(conn *net.TCPConn))
+	SetCustomConnHandler(handler func(conn net.Conn))
+	Stats() []ListenerStats
+	RouteStats() []RouteStats
+	Sessions() []SessionInfo
+	KillSession(id uint64) bool
+	KillUserSessions(user string) int
+	Reload(cfg ServerCfg) error
+	SetReloadHandler(handler func() (*ServerCfg, error))
+	SetHooks(hooks Hooks)
+	LookupSession(id uint64) *Session
 }
 
 func NewServer(cfg ServerCfg) (Server, error) {
@@ -19,29 +30,27 @@ func NewServer(cfg ServerCfg) (Server, error) {
 }
 
 type server struct {
-	listener net.Listener
-	cfg      ServerCfg
+	cfg       ServerCfg
+	listeners []*listener
 
-	tcpListenAddr *net.TCPAddr
 	udpListenAddr *net.UDPAddr
+	udpRelay      *udpRelay     //监听共用的udp中继
+	upstreams     *upstreamSet  //路由使用的上游代理和上游代理组
+	tunnels       *tunnelServer //TunnelListen不为空时接受内网实例注册
+	dns           *dnsProxy     //DNS.Listen不为空时开启的dns代理
+	accessLog     *accessLogger
+
+	sessions sync.Map //id->*Session,当前活跃的会话
+	admin    *adminServer
+	reload   func() (*ServerCfg, error)
+	hooks    Hooks
 
 	customTcpConnHandler func(conn *net.TCPConn)
+	customConnHandler    func(conn net.Conn)
 }
 
 func newServer(cfg ServerCfg) (*server, error) {
-	listenAddr := fmt.Sprintf(":%d", cfg.ListenPort)
-
-	tcpAddress := listenAddr
-	if len(cfg.TCPListen) > 0 {
-		tcpAddress = cfg.TCPListen
-	}
-
-	taddr, err := net.ResolveTCPAddr("tcp", tcpAddress)
-	if err != nil {
-		return nil, err
-	}
-
-	udpAddress := listenAddr
+	udpAddress := fmt.Sprintf(":%d", cfg.ListenPort)
 	if len(cfg.UDPListen) > 0 {
 		udpAddress = cfg.UDPListen
 	}
@@ -53,8 +62,45 @@ func newServer(cfg ServerCfg) (*server, error) {
 
 	p := &server{
 		cfg:           cfg,
-		tcpListenAddr: taddr,
 		udpListenAddr: uaddr,
+		accessLog:     newAccessLogger(cfg.AccessLog, cfg.AccessLogMaxMB),
+	}
+
+	if len(cfg.AdminListen) > 0 {
+		if len(cfg.AdminToken) == 0 {
+			return nil, errors.New("AdminToken is required when AdminListen is set")
+		}
+		p.admin = newAdminServer(p, cfg.AdminToken)
+	}
+
+	if len(cfg.TunnelListen) > 0 && len(cfg.TunnelToken) == 0 {
+		return nil, errors.New("TunnelToken is required when TunnelListen is set")
+	}
+
+	lcfgs := cfg.listenerCfgs()
+	if len(lcfgs) == 0 {
+		return nil, errors.New("no listener enabled")
+	}
+
+	p.upstreams, err = newUpstreamSet(cfg.Upstreams, cfg.UpstreamGroups)
+	if err != nil {
+		return nil, err
+	}
+
+	geo := newGeoIPSource(cfg.GeoIPFile)
+	for _, lcfg := range lcfgs {
+		l, err := newListener(p, lcfg, geo)
+		if err != nil {
+			return nil, err
+		}
+		p.listeners = append(p.listeners, l)
+	}
+
+	if len(cfg.DNS.Listen) > 0 {
+		p.dns, err = newDNSProxy(p)
+		if err != nil {
+			return nil, fmt.Errorf("dns:%w", err)
+		}
 	}
 	return p, nil
 }
@@ -64,76 +110,253 @@ func (p *server) Run() error {
 	if err != nil {
 		return err
 	}
-	go p.serve()
-	go runUDPRelayServer(p.udpListenAddr, time.Duration(p.cfg.UDPTimout)*time.Second)
-	return nil
-}
 
-func (p *server) listen() error {
-	l, err := net.ListenTCP("tcp", p.tcpListenAddr)
-	if err != nil {
-		return err
+	for _, l := range p.listeners {
+		go l.run()
+	}
+	if p.udpRelay != nil {
+		go p.udpRelay.run()
+	}
+	if p.admin != nil {
+		go p.admin.serve()
 	}
-	p.listener = l
+	if p.tunnels != nil {
+		go p.tunnels.serve()
+	}
+	if p.dns != nil {
+		p.dns.serve()
+	}
+	p.upstreams.start()
 	return nil
 }
 
-func (p *server) serve() {
-	var tempDelay time.Duration
+func (p *server) listen() (err error) {
+	defer func() {
+		if err != nil {
+			p.close()
+		}
+	}()
+
+	shareUDPRelay := false
+	for _, l := range p.listeners {
+		if err := l.listen(); err != nil {
+			return fmt.Errorf("listener %s:%w", l.name, err)
+		}
+		if l.udpListenAddr == nil {
+			shareUDPRelay = true
+		}
+	}
 
-	for {
-		conn, err := p.listener.Accept()
+	if shareUDPRelay {
+		p.udpRelay, err = listenUDPRelay(p.udpListenAddr, &p.cfg)
 		if err != nil {
-			logrus.WithError(err).Error("HandleListener Accept")
-			if ne, ok := err.(*net.OpError); ok && ne.Temporary() {
-				if tempDelay == 0 {
-					tempDelay = 5 * time.Millisecond
-				} else {
-					tempDelay *= 2
-				}
-				if max := 1 * time.Second; tempDelay > max {
-					tempDelay = max
-				}
-				logrus.Errorf("http: Accept error: %v; retrying in %v", err, tempDelay)
-				time.Sleep(tempDelay)
-				continue
-			}
-			return
+			return err
 		}
+		p.udpRelay.requireAssoc = p.requireUDPAssoc
+	}
 
-		go p.tcpConnHandler(conn)
+	if p.admin != nil {
+		if err := p.admin.listen(p.cfg.AdminListen); err != nil {
+			return fmt.Errorf("admin:%w", err)
+		}
 	}
-}
 
-func (p *server) tcpConnHandler(conn net.Conn) {
-	if p.customTcpConnHandler != nil {
-		p.customTcpConnHandler(conn.(*net.TCPConn))
-		return
+	if len(p.cfg.TunnelListen) > 0 {
+		p.tunnels, err = listenTunnelServer(p.cfg.TunnelListen, p.cfg.TunnelToken)
+		if err != nil {
+			return fmt.Errorf("tunnel:%w", err)
+		}
 	}
 
-	p.defaultTcpConnHandler(conn)
+	if p.dns != nil {
+		if err := p.dns.listen(); err != nil {
+			return fmt.Errorf("dns:%w", err)
+		}
+	}
+	return nil
 }
 
-func (p *server) defaultTcpConnHandler(conn net.Conn) {
-	c := &Conn{
-		conn: conn,
-		cfg: ConnCfg{
-			UserName:          p.cfg.UserName,
-			Password:          p.cfg.Password,
-			TCPTimeout:        int32(p.cfg.TCPTimeout),
-			UDPAdvertisedIP:   p.cfg.UDPAdvertisedIP,
-			UDPAdvertisedPort: p.udpListenAddr.Port,
-		},
+func (p *server) close() {
+	for _, l := range p.listeners {
+		l.close()
+	}
+	if p.udpRelay != nil {
+		p.udpRelay.close()
+	}
+	if p.admin != nil {
+		p.admin.close()
 	}
+	if p.tunnels != nil {
+		p.tunnels.close()
+	}
+	if p.dns != nil {
+		p.dns.close()
+	}
+	p.upstreams.stop()
+}
 
-	err := c.Handle()
-	if err != nil {
-		if !errors.Is(err, io.EOF) {
-			logrus.WithError(err).Debug("conn handle")
+// requireUDPAssoc 使用共用udp中继的监听有一个需要关联时,共用的中继只转发有关联的数据包
+func (p *server) requireUDPAssoc() bool {
+	for _, l := range p.listeners {
+		if l.udpRelay == nil && l.requireUDPAssoc() {
+			return true
 		}
 	}
+	return false
+}
+
+func (p *server) udpRelayPort() int {
+	if p.udpRelay == nil {
+		return p.udpListenAddr.Port
+	}
+	return p.udpRelay.port()
 }
 
+// SetCustomTcpConnHandler 只对tcp监听上的连接生效，需要处理所有类型的连接时使用SetCustomConnHandler
 func (p *server) SetCustomTcpConnHandler(handler func(conn *net.TCPConn)) {
 	p.customTcpConnHandler = handler
 }
+
+func (p *server) SetCustomConnHandler(handler func(conn net.Conn)) {
+	p.customConnHandler = handler
+}
+
+// SetHooks 设置会话生命周期的事件回调,需要在Run之前调用
+func (p *server) SetHooks(hooks Hooks) {
+	p.hooks = hooks
+}
+
+// Stats 返回所有监听的连接统计
+func (p *server) Stats() []ListenerStats {
+	var stats []ListenerStats
+	for _, l := range p.listeners {
+		stats = append(stats, l.stats.snapshot(l.name))
+	}
+	return stats
+}
+
+// RouteStats 返回所有监听路由规则的命中次数,重新加载配置后重新计数
+func (p *server) RouteStats() []RouteStats {
+	var stats []RouteStats
+	for _, l := range p.listeners {
+		stats = append(stats, l.getConf().router.stats(l.name)...)
+	}
+	return stats
+}
+
+func (p *server) addSession(s *Session) {
+	p.sessions.Store(s.ID(), s)
+}
+
+func (p *server) delSession(s *Session) {
+	p.sessions.Delete(s.ID())
+}
+
+// Sessions 返回当前活跃的会话,包括tcp连接和udp关联
+func (p *server) Sessions() []SessionInfo {
+	var infos []SessionInfo
+	p.sessions.Range(func(key, value interface{}) bool {
+		infos = append(infos, value.(*Session).Info())
+		return true
+	})
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+// LookupSession 返回指定id的活跃会话,不存在时返回nil
+func (p *server) LookupSession(id uint64) *Session {
+	v, ok := p.sessions.Load(id)
+	if !ok {
+		return nil
+	}
+	return v.(*Session)
+}
+
+// KillSession 关闭指定id的会话,会话不存在时返回false
+func (p *server) KillSession(id uint64) bool {
+	v, ok := p.sessions.Load(id)
+	if !ok {
+		return false
+	}
+	v.(*Session).Kill()
+	return true
+}
+
+// KillUserSessions 关闭用户的所有会话,返回关闭的数量
+func (p *server) KillUserSessions(user string) int {
+	var n int
+	p.sessions.Range(func(key, value interface{}) bool {
+		s := value.(*Session)
+		if s.User() == user {
+			s.Kill()
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+// SetReloadHandler 设置管理接口重新加载配置时获取新配置的方法,一般为重新读取配置文件
+func (p *server) SetReloadHandler(handler func() (*ServerCfg, error)) {
+	p.reload = handler
+}
+
+// Reload 热加载配置,可以更新监听的鉴权、协议、规则、路由、tls证书、PROXY协议、tcp超时和日志级别,
+// 监听地址、udp中继、访问日志、管理接口和反向隧道的变化需要重启,新配置有错误时不做任何修改
+func (p *server) Reload(cfg ServerCfg) error {
+	lcfgs := cfg.listenerCfgs()
+	if len(lcfgs) != len(p.listeners) {
+		return errors.New("listener count changed, restart required")
+	}
+
+	ups, err := newUpstreamSet(cfg.Upstreams, cfg.UpstreamGroups)
+	if err != nil {
+		return err
+	}
+
+	geo := newGeoIPSource(cfg.GeoIPFile)
+	confs := make([]*listenerConf, len(lcfgs))
+	for i, lcfg := range lcfgs {
+		conf, err := p.listeners[i].checkReload(lcfg, &cfg, ups, geo)
+		if err != nil {
+			return err
+		}
+		confs[i] = conf
+	}
+
+	if cfg.DNS.Listen != p.cfg.DNS.Listen || cfg.DNS.FakeIPRange != p.cfg.DNS.FakeIPRange || cfg.DNS.FakeIPFile != p.cfg.DNS.FakeIPFile {
+		return errors.New("dns listen address or fake ip changed, restart required")
+	}
+	var dnsConf *dnsConf
+	if p.dns != nil {
+		dnsConf, err = newDNSConf(cfg.DNS, &cfg, ups)
+		if err != nil {
+			return fmt.Errorf("dns:%w", err)
+		}
+	}
+
+	var level logrus.Level
+	if len(cfg.LogLevel) > 0 {
+		var err error
+		level, err = logrus.ParseLevel(cfg.LogLevel)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, l := range p.listeners {
+		l.setConf(confs[i])
+	}
+	if p.dns != nil {
+		p.dns.setConf(dnsConf)
+	}
+	ups.start()
+	p.upstreams.stop()
+	p.upstreams = ups
+	if len(cfg.LogLevel) > 0 {
+		logrus.SetLevel(level)
+	}
+	return nil
+}
@@ -1,8 +1,26 @@
 package socks5
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/0990/socks5/pkg/mux"
 )
 
 func TestServer_CreateConfig(t *testing.T) {
@@ -178,3 +196,1362 @@ func Socks4ServerTest(s ServerCfg, c ClientCfg, t *testing.T) {
 
 	Socks4ClientTest(c, t)
 }
+
+func startTestServer(cfg ServerCfg, t *testing.T) string {
+	if cfg.TCPListen == "" {
+		cfg.TCPListen = "127.0.0.1:0"
+	}
+	if cfg.UDPListen == "" {
+		cfg.UDPListen = "127.0.0.1:0"
+	}
+	ss, err := newServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ss.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ss.listeners[0].addr().String()
+}
+
+func httpProxyClient(proxyAddr string, user *url.Userinfo) *http.Client {
+	proxyURL := &url.URL{Scheme: "http", Host: proxyAddr, User: user}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyURL),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+}
+
+func HTTPProxyTest(hc *http.Client, target string, t *testing.T) {
+	resp, err := hc.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || string(b) != "hello" {
+		t.Fatalf("status:%d body:%s", resp.StatusCode, b)
+	}
+}
+
+func TestServer_HTTPForward(t *testing.T) {
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer hs.Close()
+
+	addr := startTestServer(ServerCfg{}, t)
+	hc := httpProxyClient(addr, nil)
+	HTTPProxyTest(hc, hs.URL, t)
+	HTTPProxyTest(hc, hs.URL+"/again", t)
+}
+
+func TestServer_HTTPConnect(t *testing.T) {
+	hs := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer hs.Close()
+
+	addr := startTestServer(ServerCfg{}, t)
+	HTTPProxyTest(httpProxyClient(addr, nil), hs.URL, t)
+}
+
+func TestServer_HTTPProxyAuth(t *testing.T) {
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			t.Error("Proxy-Authorization forwarded to target")
+		}
+		w.Write([]byte("hello"))
+	}))
+	defer hs.Close()
+
+	addr := startTestServer(ServerCfg{UserName: "0990", Password: "123456"}, t)
+	HTTPProxyTest(httpProxyClient(addr, url.UserPassword("0990", "123456")), hs.URL, t)
+
+	resp, err := httpProxyClient(addr, url.UserPassword("0990", "wrong")).Get(hs.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("status:%d", resp.StatusCode)
+	}
+}
+
+func TestServer_HTTPExpectContinue(t *testing.T) {
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Write(b)
+	}))
+	defer hs.Close()
+
+	addr := startTestServer(ServerCfg{}, t)
+	hc := httpProxyClient(addr, nil)
+	hc.Transport.(*http.Transport).ExpectContinueTimeout = 5 * time.Second
+
+	//100 Continue转发给客户端,最终应答之后连接可以继续使用
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodPost, hs.URL, strings.NewReader("hello"))
+		req.Header.Set("Expect", "100-continue")
+		start := time.Now()
+		resp, err := hc.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK || string(b) != "hello" {
+			t.Fatalf("status:%d body:%s %v", resp.StatusCode, b, err)
+		}
+		if time.Since(start) > 3*time.Second {
+			t.Fatal("100 Continue not forwarded")
+		}
+	}
+}
+
+func TestServer_HTTPResponseTimeout(t *testing.T) {
+	//接受连接后不应答的目标
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			go io.Copy(ioutil.Discard, c)
+		}
+	}()
+
+	addr := startTestServer(ServerCfg{TCPTimeout: 1}, t)
+	hc := httpProxyClient(addr, nil)
+	hc.Timeout = 5 * time.Second
+	resp, err := hc.Get("http://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("status:%d", resp.StatusCode)
+	}
+}
+
+func TestServer_UnixListen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ss5unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer hs.Close()
+
+	path := filepath.Join(dir, "ss5.sock")
+	ss, err := newServer(ServerCfg{
+		TCPDisable:     true,
+		UDPListen:      "127.0.0.1:0",
+		UnixListen:     path,
+		UnixListenPerm: "0600",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("perm:%v", fi.Mode().Perm())
+	}
+	//socket在临时目录中设置权限后移动过来,临时目录已删除
+	if fis, err := ioutil.ReadDir(dir); err != nil || len(fis) != 1 {
+		t.Fatalf("dir entries:%d %v", len(fis), err)
+	}
+	if a := ss.listeners[0].addr().String(); a != path {
+		t.Fatalf("addr:%s", a)
+	}
+
+	hc := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := net.Dial("unix", path)
+				if err != nil {
+					return nil, err
+				}
+				sc := NewSocks5Client(ClientCfg{})
+				if _, err := sc.selectAuthMethod(conn); err != nil {
+					return nil, err
+				}
+				bAddr, err := NewAddrByteFromString(addr)
+				if err != nil {
+					return nil, err
+				}
+				if _, err := sc.request(conn, CmdConnect, bAddr); err != nil {
+					return nil, err
+				}
+				return conn, nil
+			},
+		},
+	}
+	HTTPProxyTest(hc, hs.URL, t)
+
+	ss.close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket not removed on close:%v", err)
+	}
+}
+
+func TestServer_Listeners(t *testing.T) {
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer hs.Close()
+
+	ss, err := newServer(ServerCfg{
+		UDPListen: "127.0.0.1:0",
+		Listeners: []ListenerCfg{
+			{
+				Name:      "internal",
+				Listen:    "127.0.0.1:0",
+				Protocols: []string{ProtocolSocks5},
+			},
+			{
+				Name:      "public",
+				Listen:    "127.0.0.1:0",
+				UDPListen: "127.0.0.1:0",
+				UserName:  "0990",
+				Password:  "123456",
+				Rules: []RuleCfg{
+					{Action: RuleActionDeny, Targets: []string{"127.0.0.0/8"}},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.Run(); err != nil {
+		t.Fatal(err)
+	}
+	internal := ss.listeners[0].addr().String()
+	public := ss.listeners[1].addr().String()
+
+	code, err := socks5HTTPGet(NewSocks5Client(ClientCfg{ServerAddr: internal}), hs.URL)
+	if err != nil || code != http.StatusOK {
+		t.Fatalf("internal socks5: code:%d err:%v", code, err)
+	}
+
+	// internal只开启了socks5
+	if _, err := httpProxyClient(internal, nil).Get(hs.URL); err == nil {
+		t.Fatal("expect http proxy disabled on internal listener")
+	}
+
+	// public禁止访问回环地址
+	_, err = socks5HTTPGet(NewSocks5Client(ClientCfg{ServerAddr: public, UserName: "0990", Password: "123456"}), hs.URL)
+	if err == nil {
+		t.Fatal("expect request denied by rule on public listener")
+	}
+
+	if ss.listeners[0].udpAdvertisedPort() == ss.listeners[1].udpAdvertisedPort() {
+		t.Fatal("expect dedicated udp relay on public listener")
+	}
+
+	// 统计在连接处理结束后更新，稍等一下
+	var stats []ListenerStats
+	for i := 0; i < 100; i++ {
+		stats = ss.Stats()
+		if stats[0].Denied == 1 && stats[1].Denied == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats[0].Name != "internal" || stats[0].Denied != 1 || stats[1].Denied != 1 {
+		t.Fatalf("stats:%+v", stats)
+	}
+}
+
+func TestServer_ProxyProtocol(t *testing.T) {
+	// 目标服务读取ss5发出的PROXY头部
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	headers := make(chan *ProxyProtoHeader, 1)
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		h, err := NewProxyProtoHeaderFrom(conn)
+		if err != nil {
+			t.Error(err)
+		}
+		headers <- h
+	}()
+
+	ss, err := newServer(ServerCfg{
+		UDPListen: "127.0.0.1:0",
+		Listeners: []ListenerCfg{
+			{
+				Listen:               "127.0.0.1:0",
+				ProxyProtocol:        true,
+				ProxyProtocolTrusted: []string{"127.0.0.1"},
+				ProxyProtocolOut:     ProxyProtoV2,
+				Rules: []RuleCfg{
+					{Action: RuleActionDeny, Clients: []string{"192.0.2.0/24"}},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.Run(); err != nil {
+		t.Fatal(err)
+	}
+	addr := ss.listeners[0].addr().String()
+
+	connect := func(clientIP string) (*Reply, error) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+
+		h := &ProxyProtoHeader{
+			Version:  ProxyProtoV1,
+			SrcAddr:  &net.TCPAddr{IP: net.ParseIP(clientIP), Port: 40000},
+			DestAddr: conn.RemoteAddr(),
+		}
+		b, _ := h.ToBytes()
+		conn.Write(b)
+
+		sc := NewSocks5Client(ClientCfg{})
+		if _, err := sc.selectAuthMethod(conn); err != nil {
+			return nil, err
+		}
+		bAddr, _ := NewAddrByteFromString(target.Addr().String())
+		return sc.request(conn, CmdConnect, bAddr)
+	}
+
+	if _, err := connect("192.0.2.1"); err == nil {
+		t.Fatal("expect client from PROXY header denied by rule")
+	}
+
+	if _, err := connect("203.0.113.7"); err != nil {
+		t.Fatal(err)
+	}
+	h := <-headers
+	if h.SrcAddr.String() != "203.0.113.7:40000" {
+		t.Fatalf("outbound header:%+v", h)
+	}
+
+	//没有信任列表时不能开启
+	_, err = newServer(ServerCfg{
+		UDPListen: "127.0.0.1:0",
+		Listeners: []ListenerCfg{{Listen: "127.0.0.1:0", ProxyProtocol: true}},
+	})
+	if err == nil {
+		t.Fatal("expect error without ProxyProtocolTrusted")
+	}
+}
+
+func TestServer_ProxyProtocolOutUpstream(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	headers := make(chan *ProxyProtoHeader, 1)
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		h, err := NewProxyProtoHeaderFrom(conn)
+		if err != nil {
+			t.Error(err)
+		}
+		headers <- h
+	}()
+
+	up, err := newServer(ServerCfg{UDPListen: "127.0.0.1:0", Listeners: []ListenerCfg{{Listen: "127.0.0.1:0"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := up.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer up.close()
+
+	ss, err := newServer(ServerCfg{
+		UDPListen: "127.0.0.1:0",
+		Upstreams: []UpstreamCfg{{Name: "up", ClientCfg: ClientCfg{ServerAddr: up.listeners[0].addr().String()}}},
+		Listeners: []ListenerCfg{{Listen: "127.0.0.1:0", ProxyProtocolOut: ProxyProtoV1, Routes: []RouteCfg{{Outbound: "up"}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer ss.close()
+
+	//经上游代理时PROXY头部的目标是请求的目标,不是上游的地址
+	conn, err := NewSocks5Client(ClientCfg{ServerAddr: ss.listeners[0].addr().String()}).Dial("tcp", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	h := <-headers
+	if h.DestAddr.String() != target.Addr().String() {
+		t.Fatalf("outbound header dest:%s want %s", h.DestAddr, target.Addr())
+	}
+
+	if dst := proxyProtoDest(&net.TCPAddr{IP: net.ParseIP("::1")}, "example.com:443"); dst.String() != "[::]:443" {
+		t.Fatalf("domain dest:%s", dst)
+	}
+}
+
+func startTestEchoServer(t *testing.T) (tcpAddr string, udpAddr string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	t.Cleanup(func() {
+		l.Close()
+		pc.Close()
+	})
+	return l.Addr().String(), pc.LocalAddr().String()
+}
+
+func echoTest(conn net.Conn, msg string, t *testing.T) {
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("echo:%s", buf)
+	}
+}
+
+// startTestHalfCloseServer 读到EOF后应答"got:"加上收到的数据
+func startTestHalfCloseServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				data, err := ioutil.ReadAll(conn)
+				if err != nil {
+					return
+				}
+				conn.Write(append([]byte("got:"), data...))
+			}()
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return l.Addr().String()
+}
+
+func halfCloseTest(conn net.Conn, t *testing.T) {
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(conn)
+	if err != nil || string(got) != "got:hello" {
+		t.Fatalf("half close:%s %v", got, err)
+	}
+}
+
+func TestServer_HalfClose(t *testing.T) {
+	target := startTestHalfCloseServer(t)
+	addr := startTestServer(ServerCfg{TCPTimeout: 10}, t)
+
+	sc := NewSocks5Client(ClientCfg{ServerAddr: addr})
+	conn, err := sc.Dial("tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	halfCloseTest(conn, t)
+	conn.Close()
+
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("connect:%v %v", resp, err)
+	}
+	halfCloseTest(conn, t)
+}
+
+type closeHooks struct {
+	NopHooks
+	closed chan SessionInfo
+}
+
+func (p closeHooks) OnClose(s *Session) {
+	p.closed <- s.Info()
+}
+
+func waitClosed(conn net.Conn, t *testing.T) {
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 64)
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Fatal("conn not closed by server")
+			}
+			return
+		}
+	}
+}
+
+func TestServer_Timeouts(t *testing.T) {
+	echo, _ := startTestEchoServer(t)
+	quiet := startTestHalfCloseServer(t)
+	_, echoPort, _ := net.SplitHostPort(echo)
+	_, quietPort, _ := net.SplitHostPort(quiet)
+	ep, _ := strconv.Atoi(echoPort)
+	qp, _ := strconv.Atoi(quietPort)
+
+	ss, err := newServer(ServerCfg{
+		UDPListen: "127.0.0.1:0",
+		Listeners: []ListenerCfg{{
+			Listen:           "127.0.0.1:0",
+			IdleTimeout:      10,
+			HandshakeTimeout: 1,
+			Rules: []RuleCfg{
+				{Action: RuleActionAllow, Ports: []int{ep}, MaxLifetime: 1},
+				{Action: RuleActionAllow, Ports: []int{qp}, IdleTimeout: 1, ConnectTimeout: 1},
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hooks := closeHooks{closed: make(chan SessionInfo, 1)}
+	ss.SetHooks(hooks)
+	if err := ss.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer ss.close()
+	addr := ss.listeners[0].addr().String()
+
+	closed := func() SessionInfo {
+		select {
+		case info := <-hooks.closed:
+			return info
+		case <-time.After(3 * time.Second):
+			t.Fatal("session not closed")
+			return SessionInfo{}
+		}
+	}
+
+	//握手超时
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitClosed(conn, t)
+	conn.Close()
+	if info := closed(); !strings.Contains(info.CloseReason, "timeout") {
+		t.Fatalf("handshake timeout:%+v", info)
+	}
+
+	//规则中的最长持续时间,有数据时也会断开
+	sc := NewSocks5Client(ClientCfg{ServerAddr: addr})
+	conn, err = sc.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	go func(conn net.Conn) {
+		for time.Since(start) < 3*time.Second {
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}(conn)
+	waitClosed(conn, t)
+	conn.Close()
+	if info := closed(); info.CloseReason != CloseReasonLifetime {
+		t.Fatalf("max lifetime:%+v", info)
+	}
+
+	//规则中的空闲超时
+	conn, err = sc.Dial("tcp", quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitClosed(conn, t)
+	conn.Close()
+	if info := closed(); info.CloseReason != CloseReasonIdleTimeout {
+		t.Fatalf("idle timeout:%+v", info)
+	}
+}
+
+func TestServer_AccessLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ss5log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logFile := filepath.Join(dir, "access.log")
+
+	tcpEcho, udpEcho := startTestEchoServer(t)
+	addr := startTestServer(ServerCfg{
+		AccessLog: logFile,
+		UDPTimout: 2,
+		UserName:  "0990",
+		Password:  "123456",
+	}, t)
+
+	sc := NewSocks5Client(ClientCfg{ServerAddr: addr, UserName: "0990", Password: "123456", UDPTimout: 3})
+	conn, err := sc.Dial("tcp", tcpEcho)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoTest(conn, "hello", t)
+	conn.Close()
+
+	uconn, err := sc.Dial("udp", udpEcho)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoTest(uconn, "ping", t)
+	uconn.Close()
+
+	var records []SessionInfo
+	for i := 0; i < 100 && len(records) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		data, _ := ioutil.ReadFile(logFile)
+		records = records[:0]
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var info SessionInfo
+			if json.Unmarshal([]byte(line), &info) == nil {
+				records = append(records, info)
+			}
+		}
+	}
+	if len(records) != 2 {
+		t.Fatalf("records:%+v", records)
+	}
+
+	tcp, udp := records[0], records[1]
+	if tcp.User != "0990" || tcp.Protocol != ProtocolSocks5 || tcp.Command != CommandConnect || tcp.Target != tcpEcho ||
+		tcp.ResolvedIP != "127.0.0.1" || tcp.BytesUp != 5 || tcp.BytesDown != 5 || tcp.CloseReason != CloseReasonClosed {
+		t.Fatalf("tcp record:%+v", tcp)
+	}
+	if udp.Command != CommandUDP || udp.PacketsUp != 1 || udp.PacketsDown != 1 || udp.BytesUp != 4 || udp.BytesDown != 4 {
+		t.Fatalf("udp record:%+v", udp)
+	}
+}
+
+func TestServer_SocketOptions(t *testing.T) {
+	tcpEcho, udpEcho := startTestEchoServer(t)
+
+	noDelay := false
+	sock := SocketCfg{
+		KeepAlive:         30,
+		KeepAliveInterval: 10,
+		KeepAliveCount:    3,
+		NoDelay:           &noDelay,
+		ReadBuffer:        64 * 1024,
+		WriteBuffer:       64 * 1024,
+		UserTimeout:       5000,
+	}
+	addr := startTestServer(ServerCfg{
+		ListenSocket:   sock,
+		DialSocket:     sock,
+		UDPReadBuffer:  256 * 1024,
+		UDPWriteBuffer: 256 * 1024,
+		UDPTimout:      2,
+	}, t)
+
+	sc := NewSocks5Client(ClientCfg{ServerAddr: addr, UDPTimout: 3})
+	conn, err := sc.Dial("tcp", tcpEcho)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoTest(conn, "hello", t)
+	conn.Close()
+
+	uconn, err := sc.Dial("udp", udpEcho)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoTest(uconn, "ping", t)
+	uconn.Close()
+
+	disabled := SocketCfg{KeepAlive: -1}
+	conn, err = disabled.dial(tcpEcho, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoTest(conn, "direct", t)
+	conn.Close()
+}
+
+func TestServer_UDPDualStack(t *testing.T) {
+	if ln, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skip("ipv6 not supported")
+	} else {
+		ln.Close()
+	}
+	_, udpEcho := startTestEchoServer(t)
+
+	ss, err := newServer(ServerCfg{
+		UDPListen: ":0",
+		UDPTimout: 2,
+		Listeners: []ListenerCfg{
+			{Listen: "127.0.0.1:0"},
+			{Listen: "[::1]:0"},
+			{Listen: "127.0.0.1:0", UDPAdvertise: []UDPAdvertiseCfg{{IP: "10.0.0.1", Clients: []string{"10.0.0.0/8"}}, {IP: "127.0.0.1"}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer ss.close()
+
+	//中继监听所有地址时,按tcp连接的地址族告诉客户端中继地址
+	for i, want := range []string{"127.0.0.1", "::1", "127.0.0.1"} {
+		sc := NewSocks5Client(ClientCfg{ServerAddr: ss.listeners[i].addr().String(), UDPTimout: 3})
+		conn, err := sc.Dial("udp", udpEcho)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip := addrIP(conn.RemoteAddr()); !ip.Equal(net.ParseIP(want)) {
+			t.Fatalf("listener %d advertised:%v", i, conn.RemoteAddr())
+		}
+		echoTest(conn, "ping", t)
+		conn.Close()
+	}
+}
+
+// socks4Request 发送socks4 CONNECT请求,返回应答码
+func socks4Request(server string, target string, userId string) (byte, error) {
+	conn, err := net.Dial("tcp", server)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	req, err := NewReqSocks4(CmdConnect, target)
+	if err != nil {
+		return 0, err
+	}
+	req.UserId = []byte(userId)
+	if _, err := conn.Write(req.ToBytes()); err != nil {
+		return 0, err
+	}
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	reply, err := NewReplySocks4From(conn)
+	if err != nil {
+		return 0, err
+	}
+	return reply.CD, nil
+}
+
+func TestServer_Socks4Auth(t *testing.T) {
+	tcpEcho, _ := startTestEchoServer(t)
+
+	ss, err := newServer(ServerCfg{
+		UDPListen: "127.0.0.1:0",
+		Listeners: []ListenerCfg{
+			{Listen: "127.0.0.1:0", UserName: "0990", Password: "123456"},
+			{Listen: "127.0.0.1:0", UserName: "0990", Password: "123456", Socks4Auth: Socks4AuthNone},
+			{Listen: "127.0.0.1:0", Socks4Auth: Socks4AuthUserId, Socks4UserIds: []string{"alice"}},
+			{Listen: "127.0.0.1:0", Socks4Auth: Socks4AuthIdentd},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer ss.close()
+	addr := func(i int) string {
+		return ss.listeners[i].addr().String()
+	}
+
+	//设置了密码时默认禁用socks4
+	if rep, err := socks4Request(addr(0), tcpEcho, "0990"); err != nil || rep != RepSocks4Rejected {
+		t.Fatalf("password listener:%d %v", rep, err)
+	}
+	if rep, err := socks4Request(addr(1), tcpEcho, ""); err != nil || rep != RepSocks4Granted {
+		t.Fatalf("socks4 none:%d %v", rep, err)
+	}
+
+	conn, err := NewSocks4Client(ClientCfg{ServerAddr: addr(2), UserName: "alice"}).Dial("tcp", tcpEcho)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoTest(conn, "hello", t)
+	conn.Close()
+	if rep, err := socks4Request(addr(2), tcpEcho, "bob"); err != nil || rep != RepSocks4InvalidUser {
+		t.Fatalf("userid bob:%d %v", rep, err)
+	}
+
+	identd := startTestIdentd(t, "alice")
+	if rep, err := socks4Request(addr(3), tcpEcho, "alice"); err != nil || rep != RepSocks4Granted {
+		t.Fatalf("identd alice:%d %v", rep, err)
+	}
+	if rep, err := socks4Request(addr(3), tcpEcho, "bob"); err != nil || rep != RepSocks4InvalidUser {
+		t.Fatalf("identd bob:%d %v", rep, err)
+	}
+	identd.Close()
+	if rep, err := socks4Request(addr(3), tcpEcho, "alice"); err != nil || rep != RepSocks4NoIdentd {
+		t.Fatalf("no identd:%d %v", rep, err)
+	}
+
+	if _, err := newServer(ServerCfg{Socks4Auth: Socks4AuthUserId}); err == nil {
+		t.Fatal("expect error without Socks4UserIds")
+	}
+}
+
+// socks5Request 无鉴权发送socks5请求,返回应答码
+func socks5Request(server string, cmd byte, target string) (byte, error) {
+	conn, err := net.Dial("tcp", server)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	conn.Write(NewMethodSelectReq([]byte{MethodNone}).ToBytes())
+	if _, err := NewMethodSelectReplyFrom(conn); err != nil {
+		return 0, err
+	}
+	addr, err := NewAddrByteFromString(target)
+	if err != nil {
+		return 0, err
+	}
+	conn.Write(NewRequest(cmd, addr).ToBytes())
+	reply, err := NewReplyFrom(conn)
+	if err != nil {
+		return 0, err
+	}
+	return reply.Rep, nil
+}
+
+func TestServer_Commands(t *testing.T) {
+	tcpEcho, udpEcho := startTestEchoServer(t)
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer hs.Close()
+
+	ss, err := newServer(ServerCfg{
+		UDPListen: "127.0.0.1:0",
+		Listeners: []ListenerCfg{
+			{Listen: "127.0.0.1:0", Protocols: []string{ProtocolSocks5}, Commands: []string{CommandConnect}},
+			{Listen: "127.0.0.1:0", Commands: []string{CommandUDP, CommandHTTP}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer ss.close()
+	connectOnly := ss.listeners[0].addr().String()
+	noConnect := ss.listeners[1].addr().String()
+
+	if rep, err := socks5Request(connectOnly, CmdConnect, tcpEcho); err != nil || rep != RepSuccess {
+		t.Fatalf("connect:%d %v", rep, err)
+	}
+	if rep, err := socks5Request(connectOnly, CmdUDP, udpEcho); err != nil || rep != RepCmdNotSupported {
+		t.Fatalf("udp:%d %v", rep, err)
+	}
+	if rep, err := socks4Request(connectOnly, tcpEcho, ""); err != nil || rep != RepSocks4Rejected {
+		t.Fatalf("socks4:%d %v", rep, err)
+	}
+
+	if rep, err := socks5Request(noConnect, CmdConnect, tcpEcho); err != nil || rep != RepCmdNotSupported {
+		t.Fatalf("connect disabled:%d %v", rep, err)
+	}
+	if rep, err := socks5Request(noConnect, CmdUDP, udpEcho); err != nil || rep != RepSuccess {
+		t.Fatalf("udp enabled:%d %v", rep, err)
+	}
+	if rep, err := socks4Request(noConnect, tcpEcho, ""); err != nil || rep != RepSocks4Rejected {
+		t.Fatalf("socks4 connect disabled:%d %v", rep, err)
+	}
+	HTTPProxyTest(httpProxyClient(noConnect, nil), hs.URL, t)
+	if _, err := httpProxyClient(noConnect, nil).Get("https://" + tcpEcho); err == nil {
+		t.Fatal("expect http CONNECT disabled")
+	}
+
+	if _, err := newServer(ServerCfg{Commands: []string{"bind"}}); err == nil {
+		t.Fatal("expect unknown command error")
+	}
+}
+
+func TestServer_Routes(t *testing.T) {
+	tcpEcho, udpEcho := startTestEchoServer(t)
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer hs.Close()
+
+	up, err := newServer(ServerCfg{UDPListen: "127.0.0.1:0", UDPTimout: 5, Listeners: []ListenerCfg{{Listen: "127.0.0.1:0"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := up.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer up.close()
+
+	_, tcpPort, _ := net.SplitHostPort(tcpEcho)
+	_, udpPort, _ := net.SplitHostPort(udpEcho)
+	ports := make([]int, 2)
+	ports[0], _ = strconv.Atoi(tcpPort)
+	ports[1], _ = strconv.Atoi(udpPort)
+
+	ss, err := newServer(ServerCfg{
+		UDPListen: "127.0.0.1:0",
+		UDPTimout: 5,
+		Upstreams: []UpstreamCfg{{Name: "up", ClientCfg: ClientCfg{ServerAddr: up.listeners[0].addr().String()}}},
+		Listeners: []ListenerCfg{{
+			Listen: "127.0.0.1:0",
+			Routes: []RouteCfg{
+				{Outbound: OutboundBlock, Domains: []string{"blocked.test"}},
+				{Outbound: "up", Ports: ports},
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer ss.close()
+	client := NewSocks5Client(ClientCfg{ServerAddr: ss.listeners[0].addr().String(), UDPTimout: 3})
+
+	//没有匹配的规则时直连
+	if code, err := socks5HTTPGet(client, hs.URL); err != nil || code != http.StatusOK {
+		t.Fatalf("direct:%d %v", code, err)
+	}
+	if up.Stats()[0].Accepted != 0 {
+		t.Fatalf("upstream used by direct route:%+v", up.Stats())
+	}
+
+	conn, err := client.Dial("tcp", tcpEcho)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoTest(conn, "tcp via upstream", t)
+	conn.Close()
+
+	uc, err := client.Dial("udp", udpEcho)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoTest(uc, "udp via upstream", t)
+	uc.Close()
+	if n := up.Stats()[0].Accepted; n != 2 {
+		t.Fatalf("upstream accepted:%d", n)
+	}
+
+	if rep, err := socks5Request(ss.listeners[0].addr().String(), CmdConnect, "blocked.test:80"); err != nil || rep != RepRuleFailure {
+		t.Fatalf("blocked:%d %v", rep, err)
+	}
+
+	//udp按每个数据包匹配,被阻止的数据包直接丢弃
+	uc, err = client.Dial("udp", "blocked.test:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	uc.Write([]byte("dropped"))
+
+	var stats []RouteStats
+	for i := 0; i < 100; i++ {
+		stats = ss.RouteStats()
+		if stats[0].Hits == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats[0].Hits != 2 || stats[1].Hits != 2 || stats[2].Index != -1 || stats[2].Hits != 1 {
+		t.Fatalf("route stats:%+v", stats)
+	}
+}
+
+func TestServer_UDPRequireAssociation(t *testing.T) {
+	_, udpEcho := startTestEchoServer(t)
+
+	ss, err := newServer(ServerCfg{
+		UDPListen: "127.0.0.1:0",
+		UDPTimout: 5,
+		Listeners: []ListenerCfg{{
+			Listen: "127.0.0.1:0",
+			Rules:  []RuleCfg{{Action: RuleActionAllow, Clients: []string{"127.0.0.1"}}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer ss.close()
+
+	//有规则时没有UDP ASSOCIATE的数据包被丢弃
+	raw, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: ss.udpRelayPort()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	raw.Write(udpDatagram(udpEcho, "no association"))
+	raw.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if _, err := raw.Read(make([]byte, 64)); err == nil {
+		t.Fatal("expect datagram without association dropped")
+	}
+
+	client := NewSocks5Client(ClientCfg{ServerAddr: ss.listeners[0].addr().String(), UDPTimout: 3})
+	uc, err := client.Dial("udp", udpEcho)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	echoTest(uc, "associated", t)
+
+	//控制连接断开后同一地址的数据包不再转发
+	su := uc.(*SocksUDPConn)
+	su.ctrlConn.Close()
+	time.Sleep(200 * time.Millisecond)
+	su.UDPConn.Write(udpDatagram(udpEcho, "after close"))
+	su.UDPConn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if _, err := su.UDPConn.Read(make([]byte, 64)); err == nil {
+		t.Fatal("expect datagram after association closed dropped")
+	}
+}
+
+func TestServer_UDPRules(t *testing.T) {
+	_, allowed := startTestEchoServer(t)
+	_, denied := startTestEchoServer(t)
+	_, deniedPort, _ := net.SplitHostPort(denied)
+	port, _ := strconv.Atoi(deniedPort)
+
+	//白名单式的规则:UDP ASSOCIATE请求中的0.0.0.0:0不参与匹配,每个数据包的目标按规则检查
+	ss, err := newServer(ServerCfg{
+		UDPListen: "127.0.0.1:0",
+		UDPTimout: 5,
+		Listeners: []ListenerCfg{{
+			Listen: "127.0.0.1:0",
+			Rules: []RuleCfg{
+				{Action: RuleActionDeny, Ports: []int{port}},
+				{Action: RuleActionAllow, Targets: []string{"127.0.0.1"}},
+				{Action: RuleActionDeny},
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer ss.close()
+
+	client := NewSocks5Client(ClientCfg{ServerAddr: ss.listeners[0].addr().String(), UDPTimout: 3})
+	uc, err := client.Dial("udp", allowed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	echoTest(uc, "allowed target", t)
+
+	dc, err := client.Dial("udp", denied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dc.Close()
+	dc.Write([]byte("denied"))
+	dc.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if _, err := dc.Read(make([]byte, 64)); err == nil {
+		t.Fatal("expect datagram to denied target dropped")
+	}
+}
+
+// startTestSilentServer 接受tcp连接后不读也不应答
+func startTestSilentServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		mu.Lock()
+		for _, c := range conns {
+			c.Close()
+		}
+		mu.Unlock()
+	})
+	return l.Addr().String()
+}
+
+func TestServer_UDPSlowUpstream(t *testing.T) {
+	_, udpEcho := startTestEchoServer(t)
+	silent := startTestSilentServer(t)
+
+	ss, err := newServer(ServerCfg{
+		UDPListen:  "127.0.0.1:0",
+		UDPTimout:  5,
+		UDPWorkers: 1,
+		Upstreams:  []UpstreamCfg{{Name: "silent", ClientCfg: ClientCfg{ServerAddr: silent}}},
+		Listeners: []ListenerCfg{{
+			Listen:         "127.0.0.1:0",
+			ConnectTimeout: 1,
+			Routes:         []RouteCfg{{Outbound: "silent", Domains: []string{"slow.test"}}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer ss.close()
+	client := NewSocks5Client(ClientCfg{ServerAddr: ss.listeners[0].addr().String(), UDPTimout: 3})
+
+	//经不应答的上游建立关联时,同一工作协程的其它目标和客户端不受影响
+	slow, err := client.Dial("udp", "slow.test:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	slow.Write([]byte("stalled"))
+
+	uc, err := client.Dial("udp", udpEcho)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	start := time.Now()
+	echoTest(uc, "not stalled", t)
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("echo delayed %v by slow upstream", d)
+	}
+
+	//与上游的握手受监听的ConnectTimeout限制,失败后不再保留关联
+	shard := ss.udpRelay.shards[0]
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		pending := 0
+		shard.mu.Lock()
+		for _, c := range shard.clients {
+			c.mu.Lock()
+			pending += len(c.upstreams)
+			c.mu.Unlock()
+		}
+		shard.mu.Unlock()
+		if pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("upstream associate not bounded by ConnectTimeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServer_Mux(t *testing.T) {
+	tcpEcho, udpEcho := startTestEchoServer(t)
+
+	ss, err := newServer(ServerCfg{
+		UDPListen: "127.0.0.1:0",
+		UDPTimout: 5,
+		Listeners: []ListenerCfg{{Listen: "127.0.0.1:0", Mux: true, UserName: "user", Password: "pass"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer ss.close()
+	addr := ss.listeners[0].addr().String()
+
+	client := NewSocks5Client(ClientCfg{ServerAddr: addr, UserName: "user", Password: "pass", UDPTimout: 3, Mux: true})
+	defer client.Close()
+
+	var conns []net.Conn
+	for i := 0; i < 5; i++ {
+		conn, err := client.Dial("tcp", tcpEcho)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	for i, conn := range conns {
+		echoTest(conn, fmt.Sprintf("mux %d", i), t)
+	}
+
+	uc, err := client.Dial("udp", udpEcho)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoTest(uc, "udp over mux", t)
+	uc.Close()
+
+	//一个复用连接加上每个流各算一个连接
+	if n := ss.Stats()[0].Accepted; n != 7 {
+		t.Fatalf("accepted:%d", n)
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	//每个流单独鉴权
+	bad := NewSocks5Client(ClientCfg{ServerAddr: addr, UserName: "user", Password: "wrong", Mux: true})
+	defer bad.Close()
+	if _, err := bad.Dial("tcp", tcpEcho); err == nil {
+		t.Fatal("expect auth failure over mux")
+	}
+
+	//未开启Mux的客户端不能使用mux监听
+	if _, err := socks5Request(addr, CmdConnect, tcpEcho); err == nil {
+		t.Fatal("expect plain client failure on mux listener")
+	}
+}
+
+func TestServer_MuxSpoofedRemote(t *testing.T) {
+	tcpEcho, _ := startTestEchoServer(t)
+
+	ss, err := newServer(ServerCfg{
+		UDPListen: "127.0.0.1:0",
+		Listeners: []ListenerCfg{{
+			Listen: "127.0.0.1:0",
+			Mux:    true,
+			Rules:  []RuleCfg{{Action: "allow", Clients: []string{"10.9.9.9"}}, {Action: "deny"}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer ss.close()
+
+	conn, err := net.Dial("tcp", ss.listeners[0].addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := mux.Client(conn, nil)
+	defer sess.Close()
+
+	//客户端打开流时声明的地址不能绕过按客户端ip的规则
+	s, err := sess.Open("10.9.9.9:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(3 * time.Second))
+	client := NewSocks5Client(ClientCfg{})
+	method, err := client.selectAuthMethod(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.authMethod(s, method); err != nil {
+		t.Fatal(err)
+	}
+	dst, err := NewAddrByteFromString(tcpEcho)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.request(s, CmdConnect, dst); err == nil {
+		t.Fatal("expect spoofed client denied")
+	}
+}
@@ -0,0 +1,277 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	CommandConnect = "connect"
+	CommandUDP     = "udp"
+	CommandHTTP    = "http"
+)
+
+const (
+	CloseReasonClosed      = "closed"
+	CloseReasonIdleTimeout = "idle_timeout"
+	CloseReasonAuthFailed  = "auth_failed"
+	CloseReasonRuleDenied  = "rule_denied"
+	CloseReasonDisabled    = "protocol_disabled"
+	CloseReasonKilled      = "killed"
+	CloseReasonLifetime    = "max_lifetime"
+	CloseReasonHookReject  = "hook_rejected"
+)
+
+var sessionID uint64
+
+// Session 一个客户端连接的会话信息，由各协议的处理过程填写
+type Session struct {
+	id       uint64
+	listener string
+	client   net.Addr
+	start    time.Time
+	closer   io.Closer //客户端连接,kill时关闭
+	hook     Hooks
+
+	mu          sync.Mutex
+	user        string
+	protocol    string
+	command     string
+	target      string
+	resolvedIP  string
+	bindAddr    string
+	reply       int
+	closeReason string
+	forceReason string //被Kill或超过最长持续时间关闭时的原因
+	lifetime    *time.Timer
+	end         time.Time
+	tags        map[string]string
+
+	bytesUp     int64 //客户端->目标
+	bytesDown   int64 //目标->客户端
+	packetsUp   int64
+	packetsDown int64
+}
+
+// SessionInfo 会话信息快照，用于访问日志
+type SessionInfo struct {
+	ID          uint64            `json:"id"`
+	Listener    string            `json:"listener,omitempty"`
+	Client      string            `json:"client"`
+	User        string            `json:"user,omitempty"`
+	Protocol    string            `json:"protocol,omitempty"`
+	Command     string            `json:"cmd,omitempty"`
+	Target      string            `json:"target,omitempty"`
+	ResolvedIP  string            `json:"resolved_ip,omitempty"`
+	BindAddr    string            `json:"bind,omitempty"`
+	Reply       int               `json:"reply"`
+	BytesUp     int64             `json:"bytes_up"`
+	BytesDown   int64             `json:"bytes_down"`
+	PacketsUp   int64             `json:"packets_up,omitempty"`
+	PacketsDown int64             `json:"packets_down,omitempty"`
+	Start       time.Time         `json:"start"`
+	DurationMs  int64             `json:"duration_ms"`
+	CloseReason string            `json:"close_reason,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+}
+
+func newSession(listener string, conn Stream) *Session {
+	return newClientSession(listener, conn.RemoteAddr(), conn)
+}
+
+// newClientSession 创建会话,closer在Kill或超过最长持续时间时关闭
+func newClientSession(listener string, client net.Addr, closer io.Closer) *Session {
+	return &Session{
+		id:       atomic.AddUint64(&sessionID, 1),
+		listener: listener,
+		client:   client,
+		start:    time.Now(),
+		closer:   closer,
+	}
+}
+
+func (p *Session) ID() uint64 {
+	return p.id
+}
+
+func (p *Session) setUser(user string) {
+	p.mu.Lock()
+	p.user = user
+	p.mu.Unlock()
+}
+
+func (p *Session) setProtocol(protocol string) {
+	p.mu.Lock()
+	p.protocol = protocol
+	p.mu.Unlock()
+}
+
+func (p *Session) setRequest(command, target string) {
+	p.mu.Lock()
+	p.command, p.target = command, target
+	p.mu.Unlock()
+}
+
+func (p *Session) setReply(reply int) {
+	p.mu.Lock()
+	p.reply = reply
+	p.mu.Unlock()
+}
+
+// setTarget 记录连接目标成功后的实际ip和本地绑定地址
+func (p *Session) setTarget(s Stream, bindAddr string) {
+	var ip string
+	if rip := addrIP(s.RemoteAddr()); rip != nil {
+		ip = rip.String()
+	}
+	p.mu.Lock()
+	p.resolvedIP, p.bindAddr = ip, bindAddr
+	p.mu.Unlock()
+}
+
+func (p *Session) addUp(bytes int64) {
+	atomic.AddInt64(&p.bytesUp, bytes)
+}
+
+func (p *Session) addDown(bytes int64) {
+	atomic.AddInt64(&p.bytesDown, bytes)
+}
+
+func (p *Session) addPacketUp(bytes int) {
+	atomic.AddInt64(&p.packetsUp, 1)
+	atomic.AddInt64(&p.bytesUp, int64(bytes))
+}
+
+func (p *Session) addPacketDown(bytes int) {
+	atomic.AddInt64(&p.packetsDown, 1)
+	atomic.AddInt64(&p.bytesDown, int64(bytes))
+}
+
+// User 返回会话的用户名，未鉴权时为空
+func (p *Session) User() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.user
+}
+
+// SetTag 给会话添加标注，会出现在访问日志和管理接口中
+func (p *Session) SetTag(key, value string) {
+	p.mu.Lock()
+	if p.tags == nil {
+		p.tags = make(map[string]string)
+	}
+	p.tags[key] = value
+	p.mu.Unlock()
+}
+
+func (p *Session) Tag(key string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.tags[key]
+}
+
+// Kill 关闭客户端连接，udp关联在控制连接关闭后结束
+func (p *Session) Kill() error {
+	return p.forceClose(CloseReasonKilled)
+}
+
+func (p *Session) forceClose(reason string) error {
+	p.mu.Lock()
+	if p.forceReason == "" {
+		p.forceReason = reason
+	}
+	p.mu.Unlock()
+	return p.closer.Close()
+}
+
+// setLifetime 会话从开始起超过d后关闭，d为0时不限制，重复调用时以最后一次为准
+func (p *Session) setLifetime(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.lifetime != nil {
+		p.lifetime.Stop()
+		p.lifetime = nil
+	}
+	if d <= 0 || !p.end.IsZero() {
+		return
+	}
+	p.lifetime = time.AfterFunc(d-time.Since(p.start), func() {
+		p.forceClose(CloseReasonLifetime)
+	})
+}
+
+// finish 会话结束，根据Handle返回的错误记录关闭原因
+func (p *Session) finish(err error) {
+	p.mu.Lock()
+	p.closeReason = closeReason(err)
+	if p.forceReason != "" {
+		p.closeReason = p.forceReason
+	}
+	if p.lifetime != nil {
+		p.lifetime.Stop()
+	}
+	p.end = time.Now()
+	p.mu.Unlock()
+}
+
+func (p *Session) Info() SessionInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	info := SessionInfo{
+		ID:          p.id,
+		Listener:    p.listener,
+		User:        p.user,
+		Protocol:    p.protocol,
+		Command:     p.command,
+		Target:      p.target,
+		ResolvedIP:  p.resolvedIP,
+		BindAddr:    p.bindAddr,
+		Reply:       p.reply,
+		BytesUp:     atomic.LoadInt64(&p.bytesUp),
+		BytesDown:   atomic.LoadInt64(&p.bytesDown),
+		PacketsUp:   atomic.LoadInt64(&p.packetsUp),
+		PacketsDown: atomic.LoadInt64(&p.packetsDown),
+		Start:       p.start,
+		CloseReason: p.closeReason,
+	}
+	if p.client != nil {
+		info.Client = p.client.String()
+	}
+	if len(p.tags) > 0 {
+		info.Tags = make(map[string]string, len(p.tags))
+		for k, v := range p.tags {
+			info.Tags[k] = v
+		}
+	}
+
+	end := p.end
+	if end.IsZero() {
+		end = time.Now()
+	}
+	info.DurationMs = int64(end.Sub(p.start) / time.Millisecond)
+	return info
+}
+
+func closeReason(err error) string {
+	switch {
+	case err == nil, errors.Is(err, io.EOF):
+		return CloseReasonClosed
+	case errors.Is(err, ErrIdleTimeout):
+		return CloseReasonIdleTimeout
+	case errors.Is(err, ErrAuthFailed):
+		return CloseReasonAuthFailed
+	case errors.Is(err, ErrRuleDenied):
+		return CloseReasonRuleDenied
+	case errors.Is(err, ErrProtocolDisabled):
+		return CloseReasonDisabled
+	case errors.Is(err, ErrHookRejected):
+		return CloseReasonHookReject
+	default:
+		return err.Error()
+	}
+}
@@ -0,0 +1,116 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"time"
+)
+
+// tcpFastOpenQueueLen 监听socket开启TCP Fast Open时的队列长度
+const tcpFastOpenQueueLen = 256
+
+func (p *SocketCfg) keepAlive() time.Duration {
+	if p.KeepAlive < 0 {
+		return -1
+	}
+	return time.Duration(p.KeepAlive) * time.Second
+}
+
+// listen 监听tcp地址,FastOpen需要在listen之前设置,其它选项在accept之后由apply设置
+func (p *SocketCfg) listen(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{KeepAlive: p.keepAlive()}
+	if p.FastOpen {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = setTCPFastOpen(fd, tcpFastOpenQueueLen)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		}
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// dial 连接tcp地址,FastOpen需要在connect之前设置
+func (p *SocketCfg) dial(addr string, timeout time.Duration) (net.Conn, error) {
+	d := net.Dialer{Timeout: timeout, KeepAlive: p.keepAlive()}
+	if p.FastOpen {
+		d.Control = func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = setTCPFastOpenConnect(fd)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		}
+	}
+
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		if err := p.apply(tc); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// apply 设置已建立的tcp连接的选项,keepalive的空闲时间由net.ListenConfig和net.Dialer设置
+func (p *SocketCfg) apply(conn *net.TCPConn) error {
+	if p.NoDelay != nil {
+		if err := conn.SetNoDelay(*p.NoDelay); err != nil {
+			return err
+		}
+	}
+	if p.ReadBuffer > 0 {
+		if err := conn.SetReadBuffer(p.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if p.WriteBuffer > 0 {
+		if err := conn.SetWriteBuffer(p.WriteBuffer); err != nil {
+			return err
+		}
+	}
+
+	if p.KeepAlive < 0 || (p.KeepAliveInterval <= 0 && p.KeepAliveCount <= 0 && p.UserTimeout <= 0) {
+		return nil
+	}
+
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		serr = setTCPSockOpts(fd, p)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// applyUDPBuffer 设置udp中继socket的缓冲区大小
+func applyUDPBuffer(conn *net.UDPConn, readBuffer, writeBuffer int) error {
+	if readBuffer > 0 {
+		if err := conn.SetReadBuffer(readBuffer); err != nil {
+			return err
+		}
+	}
+	if writeBuffer > 0 {
+		if err := conn.SetWriteBuffer(writeBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
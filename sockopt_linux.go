@@ -0,0 +1,36 @@
+//go:build linux
+// +build linux
+
+package socks5
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+func setTCPFastOpen(fd uintptr, queueLen int) error {
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN, queueLen)
+}
+
+func setTCPFastOpenConnect(fd uintptr) error {
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+}
+
+// setTCPSockOpts 设置keepalive探测间隔、次数和TCP_USER_TIMEOUT
+func setTCPSockOpts(fd uintptr, cfg *SocketCfg) error {
+	if cfg.KeepAliveInterval > 0 {
+		if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, cfg.KeepAliveInterval); err != nil {
+			return err
+		}
+	}
+	if cfg.KeepAliveCount > 0 {
+		if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPCNT, cfg.KeepAliveCount); err != nil {
+			return err
+		}
+	}
+	if cfg.UserTimeout > 0 {
+		if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, cfg.UserTimeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
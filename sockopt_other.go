@@ -0,0 +1,34 @@
+//go:build !linux
+// +build !linux
+
+package socks5
+
+import (
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 非linux系统不支持的选项只打印一次警告
+var sockOptWarnOnce sync.Once
+
+func warnSockOpt() {
+	sockOptWarnOnce.Do(func() {
+		logrus.Warn("FastOpen, KeepAliveInterval, KeepAliveCount and UserTimeout are only supported on linux")
+	})
+}
+
+func setTCPFastOpen(fd uintptr, queueLen int) error {
+	warnSockOpt()
+	return nil
+}
+
+func setTCPFastOpenConnect(fd uintptr) error {
+	warnSockOpt()
+	return nil
+}
+
+func setTCPSockOpts(fd uintptr, cfg *SocketCfg) error {
+	warnSockOpt()
+	return nil
+}
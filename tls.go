@@ -0,0 +1,104 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+const tlsHandshakeTimeout = 10 * time.Second
+
+// newServerTLSConfig 根据证书配置生成服务端tls配置，配置了TLSClientCAFile时要求并校验客户端证书
+func newServerTLSConfig(cfg ListenerCfg) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("LoadX509KeyPair:%w", err)
+	}
+
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if cfg.TLSClientCAFile != "" {
+		pool, err := loadCertPool(cfg.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsCfg, nil
+}
+
+// newClientTLSConfig 生成客户端tls配置，配置了TLSCertFile时向服务端出示客户端证书
+func newClientTLSConfig(cfg ClientCfg) (*tls.Config, error) {
+	tlsCfg := &tls.Config{
+		ServerName:         cfg.TLSServerName,
+		InsecureSkipVerify: cfg.TLSInsecureSkipVerify,
+	}
+
+	if tlsCfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(cfg.ServerAddr)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.ServerName = host
+	}
+
+	if cfg.TLSCAFile != "" {
+		pool, err := loadCertPool(cfg.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	if cfg.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("LoadX509KeyPair:%w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return tlsCfg, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+	return pool, nil
+}
+
+// tlsHandshake 完成握手，如果客户端出示了经过校验的证书，返回证书的CommonName作为已鉴权的用户名
+func tlsHandshake(conn *tls.Conn, timeout time.Duration) (string, error) {
+	if timeout <= 0 {
+		timeout = tlsHandshakeTimeout
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	err := conn.Handshake()
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		return "", fmt.Errorf("tls handshake:%w", err)
+	}
+
+	state := conn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return "", nil
+	}
+
+	user := state.PeerCertificates[0].Subject.CommonName
+	if user == "" {
+		return "", errors.New("client certificate without CommonName")
+	}
+	return user, nil
+}
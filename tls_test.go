@@ -0,0 +1,155 @@
+package socks5
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCert(cn string, parent *testCert, isCA bool, t *testing.T) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:         isCA,
+
+		BasicConstraintsValid: true,
+	}
+
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+// writeFiles 写入证书和私钥文件，返回文件路径
+func (p *testCert) writeFiles(dir, name string, t *testing.T) (string, string) {
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: p.cert.Raw})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalECPrivateKey(p.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func socks5HTTPGet(sc *socks5client, target string) (int, error) {
+	hc := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return sc.Dial(network, addr)
+			},
+		},
+	}
+	resp, err := hc.Get(target)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func TestServer_TLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ss5tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert("test ca", nil, true, t)
+	caFile, _ := ca.writeFiles(dir, "ca", t)
+	serverCert, serverKey := newTestCert("127.0.0.1", ca, false, t).writeFiles(dir, "server", t)
+	clientCert, clientKey := newTestCert("alice", ca, false, t).writeFiles(dir, "client", t)
+
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer hs.Close()
+
+	ss, err := newServer(ServerCfg{
+		TCPListen:       "127.0.0.1:0",
+		UDPListen:       "127.0.0.1:0",
+		TLSListen:       "127.0.0.1:0",
+		TLSCertFile:     serverCert,
+		TLSKeyFile:      serverKey,
+		TLSClientCAFile: caFile,
+		UserName:        "0990",
+		Password:        "123456",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.Run(); err != nil {
+		t.Fatal(err)
+	}
+	tlsAddr := ss.listeners[1].addr().String()
+
+	// 客户端证书作为鉴权身份，不需要用户名密码
+	code, err := socks5HTTPGet(NewSocks5Client(ClientCfg{
+		ServerAddr:  tlsAddr,
+		TLS:         true,
+		TLSCAFile:   caFile,
+		TLSCertFile: clientCert,
+		TLSKeyFile:  clientKey,
+	}), hs.URL)
+	if err != nil || code != http.StatusOK {
+		t.Fatalf("mutual tls: code:%d err:%v", code, err)
+	}
+
+	// 没有客户端证书时握手失败
+	_, err = socks5HTTPGet(NewSocks5Client(ClientCfg{
+		ServerAddr: tlsAddr,
+		TLS:        true,
+		TLSCAFile:  caFile,
+		UserName:   "0990",
+		Password:   "123456",
+	}), hs.URL)
+	if err == nil {
+		t.Fatal("expect handshake failure without client certificate")
+	}
+}
@@ -0,0 +1,71 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+)
+
+// lookupOriginalDst 读取REDIRECT之前的目标地址,测试时替换
+var lookupOriginalDst = originalDst
+
+// isTransparent 是否为透明代理的监听
+func isTransparent(network string) bool {
+	return network == NetworkRedirect || network == NetworkTProxy
+}
+
+// transparentTarget 返回连接的原始目标,目标为监听地址本身时是直接连接到监听端口,拒绝以免循环
+func (p *listener) transparentTarget(conn net.Conn) (string, error) {
+	var target net.Addr = conn.LocalAddr()
+	if p.cfg.Network == NetworkRedirect {
+		addr, err := lookupOriginalDst(conn)
+		if err != nil {
+			return "", fmt.Errorf("original destination:%w", err)
+		}
+		target = addr
+	}
+	if isListenAddr(target, p.ln.Addr()) {
+		return "", fmt.Errorf("%s:destination is the listener itself", target)
+	}
+	return target.String(), nil
+}
+
+// isListenAddr 判断addr是否为监听地址ln,ln监听所有地址时addr需要是本机的地址,
+// 发往其它主机相同端口的流量不是回环
+func isListenAddr(addr, ln net.Addr) bool {
+	ip, port := addrIPPort(addr)
+	lip, lport := addrIPPort(ln)
+	if port != lport || ip == nil {
+		return false
+	}
+	if lip != nil && !lip.IsUnspecified() {
+		return lip.Equal(ip)
+	}
+	return isLocalIP(ip)
+}
+
+// isLocalIP 判断ip是否为本机的地址,只在端口与监听相同时调用,不缓存以跟随网卡地址的变化
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func addrIPPort(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	}
+	return nil, 0
+}
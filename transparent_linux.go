@@ -0,0 +1,144 @@
+//go:build linux
+// +build linux
+
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// soOriginalDst SO_ORIGINAL_DST和IP6T_SO_ORIGINAL_DST,x/sys/unix中没有定义
+const soOriginalDst = 80
+
+// originalDst 返回iptables REDIRECT之前的目标地址
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("redirect requires tcp conn")
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var addr *net.TCPAddr
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if ip4 := addrIP(conn.LocalAddr()).To4(); ip4 != nil {
+			var mreq *unix.IPv6Mreq
+			//sockaddr_in放在16字节的结构中返回
+			mreq, serr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, soOriginalDst)
+			if serr == nil {
+				b := mreq.Multiaddr
+				addr = &net.TCPAddr{IP: net.IPv4(b[4], b[5], b[6], b[7]), Port: int(binary.BigEndian.Uint16(b[2:4]))}
+			}
+			return
+		}
+		var info *unix.IPv6MTUInfo
+		info, serr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, soOriginalDst)
+		if serr == nil {
+			port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+			addr = &net.TCPAddr{IP: net.IP(info.Addr.Addr[:]), Port: int(binary.BigEndian.Uint16(port[:]))}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if serr != nil {
+		return nil, serr
+	}
+	return addr, nil
+}
+
+// setTransparent 设置IP_TRANSPARENT,ipv6的socket同时设置IPV6_TRANSPARENT,需要CAP_NET_ADMIN
+func setTransparent(network string, fd uintptr) error {
+	if err := unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1); err != nil {
+		return err
+	}
+	if strings.HasSuffix(network, "6") {
+		return unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+	}
+	return nil
+}
+
+func transparentControl(recvOrigDst bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			if serr = setTransparent(network, fd); serr != nil {
+				return
+			}
+			if strings.HasPrefix(network, "udp") {
+				if serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); serr != nil {
+					return
+				}
+			}
+			if !recvOrigDst {
+				return
+			}
+			if serr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1); serr != nil {
+				return
+			}
+			if strings.HasSuffix(network, "6") {
+				serr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, 1)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+}
+
+// listenTransparent 监听TPROXY转发来的tcp连接,连接的本地地址为原始目标
+func listenTransparent(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: transparentControl(false)}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// listenTransparentUDP 监听TPROXY转发来的udp数据包,用readOrigDst从控制消息中读取原始目标
+func listenTransparentUDP(addr string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: transparentControl(true)}
+	conn, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// readOrigDst 从IP_RECVORIGDSTADDR的控制消息中读取数据包的原始目标
+func readOrigDst(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == unix.SOL_IP && m.Header.Type == unix.IP_ORIGDSTADDR && len(m.Data) >= 8:
+			return &net.UDPAddr{IP: net.IPv4(m.Data[4], m.Data[5], m.Data[6], m.Data[7]), Port: int(binary.BigEndian.Uint16(m.Data[2:4]))}, nil
+		case m.Header.Level == unix.SOL_IPV6 && m.Header.Type == unix.IPV6_ORIGDSTADDR && len(m.Data) >= 24:
+			ip := make(net.IP, net.IPv6len)
+			copy(ip, m.Data[8:24])
+			return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(m.Data[2:4]))}, nil
+		}
+	}
+	return nil, errors.New("original destination not found")
+}
+
+// dialTransparentUDP 创建以from为源地址发往to的udp socket,用于以原始目标的地址向客户端发送应答
+func dialTransparentUDP(from *net.UDPAddr, to *net.UDPAddr) (*net.UDPConn, error) {
+	d := net.Dialer{LocalAddr: from, Control: transparentControl(false)}
+	conn, err := d.Dial("udp", to.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
@@ -0,0 +1,67 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestReadOrigDst(t *testing.T) {
+	build := func(level, typ int32, data []byte) []byte {
+		b := make([]byte, unix.CmsgSpace(len(data)))
+		h := (*unix.Cmsghdr)(unsafe.Pointer(&b[0]))
+		h.Level, h.Type = level, typ
+		h.SetLen(unix.CmsgLen(len(data)))
+		copy(b[unix.CmsgLen(0):], data)
+		return b
+	}
+
+	sa4 := make([]byte, unix.SizeofSockaddrInet4)
+	sa4[2], sa4[3] = 0x00, 0x35
+	copy(sa4[4:], []byte{8, 8, 8, 8})
+	addr, err := readOrigDst(build(unix.SOL_IP, unix.IP_ORIGDSTADDR, sa4))
+	if err != nil || addr.String() != "8.8.8.8:53" {
+		t.Fatal(addr, err)
+	}
+
+	sa6 := make([]byte, unix.SizeofSockaddrInet6)
+	sa6[2], sa6[3] = 0x01, 0xbb
+	copy(sa6[8:], net.ParseIP("2001:db8::1"))
+	addr, err = readOrigDst(build(unix.SOL_IPV6, unix.IPV6_ORIGDSTADDR, sa6))
+	if err != nil || addr.String() != "[2001:db8::1]:443" {
+		t.Fatal(addr, err)
+	}
+
+	if _, err := readOrigDst(nil); err == nil {
+		t.Fatal("expect not found")
+	}
+}
+
+func TestServer_TransparentTProxy(t *testing.T) {
+	s, err := newServer(ServerCfg{
+		UDPListen: "127.0.0.1:0",
+		Listeners: []ListenerCfg{{Network: NetworkTProxy, Listen: "127.0.0.1:0"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Run(); err != nil {
+		t.Skip("IP_TRANSPARENT requires CAP_NET_ADMIN:", err)
+	}
+	defer s.close()
+
+	//没有TPROXY规则时连接的本地地址就是监听地址,应拒绝
+	conn, err := net.Dial("tcp", s.listeners[0].addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expect closed")
+	}
+	if s.listeners[0].udpFlows == nil {
+		t.Fatal("expect tproxy udp")
+	}
+}
@@ -0,0 +1,31 @@
+//go:build !linux
+// +build !linux
+
+package socks5
+
+import (
+	"errors"
+	"net"
+)
+
+var errTransparentNotSupported = errors.New("transparent proxy only supported on linux")
+
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, errTransparentNotSupported
+}
+
+func listenTransparent(addr string) (net.Listener, error) {
+	return nil, errTransparentNotSupported
+}
+
+func listenTransparentUDP(addr string) (*net.UDPConn, error) {
+	return nil, errTransparentNotSupported
+}
+
+func readOrigDst(oob []byte) (*net.UDPAddr, error) {
+	return nil, errTransparentNotSupported
+}
+
+func dialTransparentUDP(from *net.UDPAddr, to *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errTransparentNotSupported
+}
@@ -0,0 +1,118 @@
+package socks5
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServer_TransparentRedirect(t *testing.T) {
+	tcpEcho, _ := startTestEchoServer(t)
+
+	//没有iptables时模拟原始目标,为nil时返回连接的本地地址,即直接连接到监听端口
+	var mu sync.Mutex
+	var origDst *net.TCPAddr
+	setOrigDst := func(addr *net.TCPAddr) {
+		mu.Lock()
+		origDst = addr
+		mu.Unlock()
+	}
+	lookupOriginalDst = func(conn net.Conn) (*net.TCPAddr, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if origDst == nil {
+			return conn.LocalAddr().(*net.TCPAddr), nil
+		}
+		return origDst, nil
+	}
+	defer func() {
+		lookupOriginalDst = originalDst
+	}()
+
+	s, err := newServer(ServerCfg{
+		UDPListen: "127.0.0.1:0",
+		Listeners: []ListenerCfg{{
+			Network: NetworkRedirect,
+			Listen:  "127.0.0.1:0",
+			Rules:   []RuleCfg{{Action: "deny", Targets: []string{"10.0.0.0/8"}}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	addr := s.listeners[0].addr().String()
+
+	echoAddr, _ := net.ResolveTCPAddr("tcp", tcpEcho)
+	setOrigDst(echoAddr)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echoTest(conn, "redirect", t)
+
+	sessions := s.Sessions()
+	if len(sessions) != 1 || sessions[0].Protocol != NetworkRedirect || sessions[0].Target != tcpEcho {
+		t.Fatalf("sessions:%+v", sessions)
+	}
+
+	//被规则拒绝和直接连接到监听端口的连接都会被关闭
+	for _, dst := range []*net.TCPAddr{{IP: net.IPv4(10, 0, 0, 1), Port: 80}, nil} {
+		setOrigDst(dst)
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetReadDeadline(time.Now().Add(3 * time.Second))
+		_, err = c.Read(make([]byte, 1))
+		c.Close()
+		if ne, ok := err.(net.Error); err == nil || ok && ne.Timeout() {
+			t.Fatalf("%v expect closed:%v", dst, err)
+		}
+	}
+	if n := s.Stats()[0].Denied; n != 1 {
+		t.Fatalf("denied:%d", n)
+	}
+
+	if _, err := newServer(ServerCfg{Listeners: []ListenerCfg{{Network: NetworkRedirect, Listen: "127.0.0.1:0", Mux: true}}}); err == nil {
+		t.Fatal("expect Mux not supported error")
+	}
+}
+
+func TestIsListenAddr(t *testing.T) {
+	cases := []struct {
+		addr, ln string
+		expect   bool
+	}{
+		{"127.0.0.1:1080", "127.0.0.1:1080", true},
+		{"127.0.0.1:1080", "0.0.0.0:1080", true},
+		{"192.168.1.2:1080", "127.0.0.1:1080", false},
+		{"127.0.0.1:80", "127.0.0.1:1080", false},
+		//监听所有地址时,发往其它主机相同端口的流量不是回环
+		{"192.0.2.1:1080", "0.0.0.0:1080", false},
+	}
+	//本机网卡的地址
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && !n.IP.IsLoopback() && n.IP.To4() != nil {
+				cases = append(cases, struct {
+					addr, ln string
+					expect   bool
+				}{net.JoinHostPort(n.IP.String(), "1080"), "0.0.0.0:1080", true})
+				break
+			}
+		}
+	}
+	for _, c := range cases {
+		addr, _ := net.ResolveTCPAddr("tcp", c.addr)
+		ln, _ := net.ResolveTCPAddr("tcp", c.ln)
+		if isListenAddr(addr, ln) != c.expect {
+			t.Fatalf("%s %s expect %v", c.addr, c.ln, c.expect)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package socks5
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/0990/socks5/pkg/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// 反向隧道:内网实例连接公网实例的TunnelListen地址,用共享密钥互相验证后注册一个名称,
+// 公网实例把Tunnel为此名称的监听上的连接作为一个流经这个连接转发给内网实例处理。
+//
+// 握手:公网实例发送nonce(32),内网实例回复 version(1) | nonce(32) | len(1) | name | mac(32),
+// 公网实例回复 status(1),成功时再回复 mac(32),之后双方在这个连接上使用mux协议,由公网实例打开流。
+// mac为HMAC-SHA256(token, role | 对方的nonce | name),role为"inner"或"relay"
+
+const tunnelVersion = 1
+const tunnelNonceSize = 32
+
+const (
+	tunnelStatusOK byte = iota
+	tunnelStatusAuthFailed
+)
+
+// tunnelHandshakeTimeout 建立隧道连接和握手的超时
+const tunnelHandshakeTimeout = 10 * time.Second
+
+// 内网实例重连公网实例的退避时间
+const (
+	tunnelMinBackoff = time.Second
+	tunnelMaxBackoff = time.Minute
+)
+
+var ErrTunnelAuth = errors.New("tunnel auth failed")
+var errTunnelClosed = errors.New("tunnel closed")
+
+func tunnelMAC(token string, role string, nonce []byte, name string) []byte {
+	h := hmac.New(sha256.New, []byte(token))
+	h.Write([]byte(role))
+	h.Write(nonce)
+	h.Write([]byte(name))
+	return h.Sum(nil)
+}
+
+func tunnelNonce() ([]byte, error) {
+	nonce := make([]byte, tunnelNonceSize)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+// tunnelServer 公网实例上接受内网实例注册的服务
+type tunnelServer struct {
+	token string
+	ln    net.Listener
+
+	mu       sync.Mutex
+	sessions map[string]*mux.Session //名称->内网实例的连接,同名的新连接替换旧连接
+}
+
+func listenTunnelServer(addr string, token string) (*tunnelServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &tunnelServer{token: token, ln: ln, sessions: make(map[string]*mux.Session)}, nil
+}
+
+func (p *tunnelServer) serve() {
+	for {
+		conn, err := p.ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return
+		}
+		go p.handleConn(conn)
+	}
+}
+
+func (p *tunnelServer) handleConn(conn net.Conn) {
+	name, err := p.handshake(conn)
+	if err != nil {
+		conn.Close()
+		logrus.WithError(err).WithField("remote", conn.RemoteAddr().String()).Warn("tunnel handshake")
+		return
+	}
+
+	sess := mux.Server(conn, nil)
+	p.mu.Lock()
+	old := p.sessions[name]
+	p.sessions[name] = sess
+	p.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	logrus.WithFields(logrus.Fields{"tunnel": name, "remote": conn.RemoteAddr().String()}).Info("tunnel registered")
+
+	<-sess.Done()
+	p.mu.Lock()
+	if p.sessions[name] == sess {
+		delete(p.sessions, name)
+	}
+	p.mu.Unlock()
+	logrus.WithError(sess.Err()).WithField("tunnel", name).Info("tunnel closed")
+}
+
+// handshake 验证内网实例并返回注册的名称
+func (p *tunnelServer) handshake(conn net.Conn) (string, error) {
+	conn.SetDeadline(time.Now().Add(tunnelHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	nonce, err := tunnelNonce()
+	if err != nil {
+		return "", err
+	}
+	if _, err := conn.Write(nonce); err != nil {
+		return "", err
+	}
+
+	hdr := make([]byte, 2+tunnelNonceSize)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return "", err
+	}
+	if hdr[0] != tunnelVersion {
+		return "", fmt.Errorf("tunnel version %d not supported", hdr[0])
+	}
+	innerNonce := hdr[1 : 1+tunnelNonceSize]
+	buf := make([]byte, int(hdr[1+tunnelNonceSize])+sha256.Size)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", err
+	}
+	name := string(buf[:len(buf)-sha256.Size])
+	if !hmac.Equal(buf[len(buf)-sha256.Size:], tunnelMAC(p.token, "inner", nonce, name)) {
+		conn.Write([]byte{tunnelStatusAuthFailed})
+		return "", fmt.Errorf("%s:%w", name, ErrTunnelAuth)
+	}
+
+	reply := append([]byte{tunnelStatusOK}, tunnelMAC(p.token, "relay", innerNonce, name)...)
+	if _, err := conn.Write(reply); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// open 在名称为name的内网实例的连接上打开一个流,client作为内网实例看到的客户端地址
+func (p *tunnelServer) open(name string, client net.Addr) (*mux.Stream, error) {
+	if p == nil {
+		return nil, errors.New("TunnelListen not enabled")
+	}
+	p.mu.Lock()
+	sess := p.sessions[name]
+	p.mu.Unlock()
+	if sess == nil {
+		return nil, fmt.Errorf("tunnel %s not registered", name)
+	}
+	return sess.Open(client.String())
+}
+
+func (p *tunnelServer) close() {
+	p.ln.Close()
+	p.mu.Lock()
+	sessions := p.sessions
+	p.sessions = make(map[string]*mux.Session)
+	p.mu.Unlock()
+	for _, sess := range sessions {
+		sess.Close()
+	}
+}
+
+// tunnelListener 内网实例上Network为tunnel的监听,保持到公网实例的连接,断开后退避重连,
+// Accept返回公网实例转发来的连接
+type tunnelListener struct {
+	addr  string
+	name  string
+	token string
+
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+
+	mu   sync.Mutex
+	sess *mux.Session
+}
+
+func listenTunnel(addr string, name string, token string) *tunnelListener {
+	p := &tunnelListener{
+		addr:  addr,
+		name:  name,
+		token: token,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func (p *tunnelListener) run() {
+	backoff := tunnelMinBackoff
+	for {
+		sess, err := p.connect()
+		if err == nil {
+			logrus.WithField("tunnel", p.name).Info("tunnel connected to " + p.addr)
+			backoff = tunnelMinBackoff
+			p.serve(sess)
+			err = sess.Err()
+		}
+
+		//随机化退避时间,避免大量实例同时重连
+		delay := backoff/2 + time.Duration(mrand.Int63n(int64(backoff/2)+1))
+		logrus.WithError(err).WithField("tunnel", p.name).Warnf("tunnel disconnected, retrying in %v", delay)
+		select {
+		case <-time.After(delay):
+		case <-p.done:
+			return
+		}
+		if backoff *= 2; backoff > tunnelMaxBackoff {
+			backoff = tunnelMaxBackoff
+		}
+	}
+}
+
+func (p *tunnelListener) connect() (*mux.Session, error) {
+	conn, err := net.DialTimeout("tcp", p.addr, tunnelHandshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.handshake(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	//服务端已通过认证,信任它打开流时指定的公网客户端地址
+	sess := mux.Client(conn, &mux.Config{TrustRemote: true})
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.done:
+		sess.Close()
+		return nil, errTunnelClosed
+	default:
+	}
+	p.sess = sess
+	return sess, nil
+}
+
+func (p *tunnelListener) handshake(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(tunnelHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	relayNonce := make([]byte, tunnelNonceSize)
+	if _, err := io.ReadFull(conn, relayNonce); err != nil {
+		return err
+	}
+	nonce, err := tunnelNonce()
+	if err != nil {
+		return err
+	}
+
+	hello := append([]byte{tunnelVersion}, nonce...)
+	hello = append(hello, byte(len(p.name)))
+	hello = append(hello, p.name...)
+	hello = append(hello, tunnelMAC(p.token, "inner", relayNonce, p.name)...)
+	if _, err := conn.Write(hello); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 1+sha256.Size)
+	if _, err := io.ReadFull(conn, reply[:1]); err != nil {
+		return err
+	}
+	if reply[0] != tunnelStatusOK {
+		return ErrTunnelAuth
+	}
+	if _, err := io.ReadFull(conn, reply[1:]); err != nil {
+		return err
+	}
+	if !hmac.Equal(reply[1:], tunnelMAC(p.token, "relay", nonce, p.name)) {
+		return fmt.Errorf("relay:%w", ErrTunnelAuth)
+	}
+	return nil
+}
+
+func (p *tunnelListener) serve(sess *mux.Session) {
+	for {
+		s, err := sess.Accept()
+		if err != nil {
+			return
+		}
+		select {
+		case p.conns <- s:
+		case <-p.done:
+			s.Close()
+			return
+		}
+	}
+}
+
+func (p *tunnelListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-p.conns:
+		return conn, nil
+	case <-p.done:
+		return nil, errTunnelClosed
+	}
+}
+
+func (p *tunnelListener) Close() error {
+	p.once.Do(func() {
+		close(p.done)
+		p.mu.Lock()
+		if p.sess != nil {
+			p.sess.Close()
+		}
+		p.mu.Unlock()
+	})
+	return nil
+}
+
+func (p *tunnelListener) Addr() net.Addr {
+	return mux.Addr(p.addr)
+}
@@ -0,0 +1,129 @@
+package socks5
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitTunnel 等待内网实例注册到公网实例
+func waitTunnel(relay *server, name string, t *testing.T) {
+	for i := 0; i < 200; i++ {
+		relay.tunnels.mu.Lock()
+		sess := relay.tunnels.sessions[name]
+		relay.tunnels.mu.Unlock()
+		if sess != nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("tunnel %s not registered", name)
+}
+
+func TestServer_Tunnel(t *testing.T) {
+	tcpEcho, _ := startTestEchoServer(t)
+
+	relay, err := newServer(ServerCfg{
+		UDPListen:    "127.0.0.1:0",
+		TunnelListen: "127.0.0.1:0",
+		TunnelToken:  "secret",
+		Listeners:    []ListenerCfg{{Listen: "127.0.0.1:0", Tunnel: "office"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := relay.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer relay.close()
+	tunnelAddr := relay.tunnels.ln.Addr().String()
+
+	//密钥错误时不能注册
+	bad, err := newServer(ServerCfg{
+		UDPListen: "127.0.0.1:0",
+		Listeners: []ListenerCfg{{Network: NetworkTunnel, Listen: tunnelAddr, TunnelName: "office", TunnelToken: "wrong"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bad.Run(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	bad.close()
+	relay.tunnels.mu.Lock()
+	registered := len(relay.tunnels.sessions)
+	relay.tunnels.mu.Unlock()
+	if registered != 0 {
+		t.Fatal("tunnel registered with wrong token")
+	}
+
+	inner, err := newServer(ServerCfg{
+		UDPListen: "127.0.0.1:0",
+		Listeners: []ListenerCfg{{
+			Network:     NetworkTunnel,
+			Listen:      tunnelAddr,
+			TunnelName:  "office",
+			TunnelToken: "secret",
+			UserName:    "user",
+			Password:    "pass",
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := inner.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer inner.close()
+	waitTunnel(relay, "office", t)
+
+	//鉴权由内网实例处理
+	relayAddr := relay.listeners[0].addr().String()
+	if _, err := NewSocks5Client(ClientCfg{ServerAddr: relayAddr}).Dial("tcp", tcpEcho); err == nil {
+		t.Fatal("expect auth failure through tunnel")
+	}
+
+	client := NewSocks5Client(ClientCfg{ServerAddr: relayAddr, UserName: "user", Password: "pass"})
+	for i := 0; i < 3; i++ {
+		conn, err := client.Dial("tcp", tcpEcho)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		echoTest(conn, "tunnel", t)
+	}
+
+	//内网实例看到的是公网实例上的客户端地址
+	sessions := inner.Sessions()
+	if len(sessions) != 3 {
+		t.Fatalf("inner sessions:%d", len(sessions))
+	}
+	for _, s := range sessions {
+		if !strings.HasPrefix(s.Client, "127.0.0.1:") {
+			t.Fatalf("session client:%s", s.Client)
+		}
+	}
+
+	//隧道断开后内网实例重连
+	relay.tunnels.mu.Lock()
+	sess := relay.tunnels.sessions["office"]
+	relay.tunnels.mu.Unlock()
+	sess.Close()
+	for i := 0; i < 200; i++ {
+		relay.tunnels.mu.Lock()
+		cur := relay.tunnels.sessions["office"]
+		reconnected := cur != nil && cur != sess
+		relay.tunnels.mu.Unlock()
+		if reconnected {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	conn, err := client.Dial("tcp", tcpEcho)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echoTest(conn, "reconnected", t)
+}
@@ -2,134 +2,980 @@ package socks5
 
 import (
 	"errors"
+	"fmt"
 	"github.com/0990/socks5/pkg/pool"
 	"net"
+	"runtime"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv4"
 )
 
-// send: client->relayer->sender->remote
-// receive: client<-relayer<-sender<-remote
-func runUDPRelayServer(listenAddr *net.UDPAddr, timeout time.Duration) {
-	relayer, err := net.ListenUDP("udp", listenAddr)
+// udpBatchSize 中继批量收发时每次最多处理的数据包数
+const udpBatchSize = 32
+
+// udpQueueLen 每个工作协程的数据包队列长度,队列满时丢弃
+const udpQueueLen = 256
+
+// udpHeaderRoom 下行数据包缓冲区前预留的socks5 udp头部空间
+const udpHeaderRoom = 3 + MaxAddrLen
+
+// udpTargetCacheSize 每个客户端缓存的目标地址数,超过后清空重新解析
+const udpTargetCacheSize = 256
+
+// udpResolveTTL 域名目标解析结果的缓存时间
+const udpResolveTTL = time.Minute
+
+// udpPendingLen 每个目标在解析或建立上游关联期间排队的数据包数,满时丢弃
+const udpPendingLen = 16
+
+// udpRetryInterval 目标解析或建立上游关联失败后,重新尝试之前丢弃数据包的时间
+const udpRetryInterval = 5 * time.Second
+
+var errUDPClientClosed = errors.New("udp client closed")
+
+// udpMessage 批量收发的一个数据包
+type udpMessage = ipv4.Message
+
+// udpPacket 中继转发的一个数据包,转发后放回udpRelay.packets复用
+type udpPacket struct {
+	buf     []byte
+	off     int //数据在buf中的起始位置,下行时前面是socks5头部
+	n       int //数据在buf中的结束位置
+	size    int //不包括socks5头部的数据长度,用于统计
+	addr    *net.UDPAddr
+	sock    *udpBatchConn //收到或发送数据包的中继socket
+	session *Session
+}
+
+// send: client->relayer->shard->sender->remote
+// receive: client<-relayer<-shard<-sender<-remote
+// 每个中继socket一个协程批量读取客户端的数据包,按客户端地址分给固定的工作协程,同一客户端的数据包保持顺序
+type udpRelay struct {
+	socks   []*udpBatchConn //监听所有地址时分别监听ipv4和ipv6,应答从收到数据包的socket发出
+	timeout time.Duration
+	assocs  udpAssocTable
+	shards  []*udpShard
+	packets sync.Pool
+	done    chan struct{}
+
+	requireAssoc func() bool //返回true时丢弃没有UDP ASSOCIATE关联的客户端的数据包,为nil时都转发
+}
+
+// listenUDPRelay 监听udp中继,地址为空或0.0.0.0,::时在同一端口分别监听ipv4和ipv6
+func listenUDPRelay(addr *net.UDPAddr, cfg *ServerCfg) (*udpRelay, error) {
+	var conns []*net.UDPConn
+	var err error
+	switch {
+	case addr == nil || addr.IP == nil || addr.IP.IsUnspecified():
+		port := 0
+		if addr != nil {
+			port = addr.Port
+		}
+		conns, err = listenUDPDualStack(port)
+	case addr.IP.To4() != nil:
+		var uc *net.UDPConn
+		uc, err = net.ListenUDP("udp4", addr)
+		conns = []*net.UDPConn{uc}
+	default:
+		var uc *net.UDPConn
+		uc, err = net.ListenUDP("udp6", addr)
+		conns = []*net.UDPConn{uc}
+	}
 	if err != nil {
-		return
+		return nil, err
 	}
-	defer relayer.Close()
-
-	var senders SenderMap
 
-	for {
-		buf := pool.GetBuf(MaxSegmentSize)
+	for _, uc := range conns {
+		if err := applyUDPBuffer(uc, cfg.UDPReadBuffer, cfg.UDPWriteBuffer); err != nil {
+			for _, uc := range conns {
+				uc.Close()
+			}
+			return nil, err
+		}
+	}
+	return newUDPRelay(conns, time.Duration(cfg.UDPTimout)*time.Second, cfg.UDPWorkers), nil
+}
 
-		n, addr, err := relayer.ReadFrom(buf)
+// listenUDPDualStack 在同一端口分别监听ipv4和ipv6,每个socket只有一种地址族,可以批量发送。
+// port为0时ipv6使用ipv4分配的端口,端口被占用时重新分配,系统不支持ipv6时只监听ipv4
+func listenUDPDualStack(port int) ([]*net.UDPConn, error) {
+	for i := 0; ; i++ {
+		uc4, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: port})
 		if err != nil {
-			continue
+			return nil, err
 		}
-		saddr := addr.String()
-		sender, exist := senders.Get(saddr)
-		if !exist {
-			sender, err = net.ListenPacket("udp", "")
-			if err != nil {
+
+		uc6, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6unspecified, Port: uc4.LocalAddr().(*net.UDPAddr).Port})
+		if err == nil {
+			return []*net.UDPConn{uc4, uc6}, nil
+		}
+		if errors.Is(err, syscall.EADDRINUSE) {
+			uc4.Close()
+			if port == 0 && i < 3 {
 				continue
 			}
-			senders.Add(addr.String(), sender)
+			return nil, err
+		}
 
-			go func() {
-				relayToClient(sender, relayer, addr, timeout)
-				if sender := senders.Del(saddr); sender != nil {
-					sender.Close()
-				}
-			}()
+		logrus.WithError(err).Warn("udp relay listen ipv6, only ipv4 is served")
+		return []*net.UDPConn{uc4}, nil
+	}
+}
+
+// newUDPRelay workers为工作协程数,为0时使用CPU数
+func newUDPRelay(conns []*net.UDPConn, timeout time.Duration, workers int) *udpRelay {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	p := &udpRelay{
+		timeout: timeout,
+		shards:  make([]*udpShard, workers),
+		done:    make(chan struct{}),
+	}
+	for _, uc := range conns {
+		p.socks = append(p.socks, newUDPBatchConn(uc))
+	}
+	p.packets.New = func() interface{} {
+		return &udpPacket{buf: make([]byte, MaxSegmentSize)}
+	}
+	for i := range p.shards {
+		p.shards[i] = &udpShard{
+			relay:   p,
+			queue:   make(chan *udpPacket, udpQueueLen),
+			replies: make(chan *udpPacket, udpQueueLen),
+			clients: make(map[udpClientKey]*udpClient),
 		}
+	}
+	return p
+}
+
+func (p *udpRelay) port() int {
+	return p.socks[0].conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// listenIP 中继只监听一个ip时返回这个ip,监听所有地址时返回nil
+func (p *udpRelay) listenIP() net.IP {
+	if len(p.socks) != 1 {
+		return nil
+	}
+	ip := p.socks[0].conn.LocalAddr().(*net.UDPAddr).IP
+	if ip.IsUnspecified() {
+		return nil
+	}
+	return ip
+}
+
+func (p *udpRelay) close() error {
+	var err error
+	for _, sock := range p.socks {
+		if e := sock.conn.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (p *udpRelay) getPacket() *udpPacket {
+	return p.packets.Get().(*udpPacket)
+}
 
-		err = relayToRemote(sender, buf[0:n])
+func (p *udpRelay) putPacket(pkt *udpPacket) {
+	pkt.addr, pkt.sock, pkt.session = nil, nil, nil
+	p.packets.Put(pkt)
+}
+
+// shard 按客户端地址选择工作协程
+func (p *udpRelay) shard(addr *net.UDPAddr) *udpShard {
+	h := uint32(2166136261)
+	for _, b := range addr.IP.To16() {
+		h = (h ^ uint32(b)) * 16777619
+	}
+	h = (h ^ uint32(addr.Port)) * 16777619
+	return p.shards[h%uint32(len(p.shards))]
+}
+
+func (p *udpRelay) run() {
+	for _, s := range p.shards {
+		go s.run()
+		go s.write()
+	}
+
+	var wg sync.WaitGroup
+	for _, sock := range p.socks {
+		wg.Add(1)
+		go func(sock *udpBatchConn) {
+			defer wg.Done()
+			p.read(sock)
+		}(sock)
+	}
+	wg.Wait()
+	close(p.done)
+}
+
+func (p *udpRelay) read(sock *udpBatchConn) {
+	defer sock.conn.Close()
+
+	// 读取用的缓冲区在数据包交给工作协程后替换为新的
+	pkts := make([]*udpPacket, udpBatchSize)
+	msgs := make([]udpMessage, udpBatchSize)
+	for i := range msgs {
+		pkts[i] = p.getPacket()
+		msgs[i].Buffers = [][]byte{pkts[i].buf}
+	}
+
+	for {
+		n, err := sock.readBatch(msgs)
 		if err != nil {
-			continue
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+
+		for i := 0; i < n; i++ {
+			addr, ok := msgs[i].Addr.(*net.UDPAddr)
+			if !ok {
+				continue
+			}
+			pkt := pkts[i]
+			pkt.off, pkt.n, pkt.addr, pkt.sock = 0, msgs[i].N, addr, sock
+			p.shard(addr).push(pkt)
+
+			pkts[i] = p.getPacket()
+			msgs[i].Buffers[0] = pkts[i].buf
+		}
+	}
+}
+
+// udpShard 一个工作协程负责的客户端,客户端由工作协程创建,由客户端的下行协程超时后删除
+type udpShard struct {
+	relay   *udpRelay
+	queue   chan *udpPacket //客户端发来的数据包
+	replies chan *udpPacket //发往客户端的数据包
+
+	mu      sync.Mutex
+	clients map[udpClientKey]*udpClient
+}
+
+// udpClientKey 客户端地址,用作map的key时不需要转成字符串
+type udpClientKey struct {
+	ip   [net.IPv6len]byte
+	port int
+}
+
+func newUDPClientKey(addr *net.UDPAddr) udpClientKey {
+	key := udpClientKey{port: addr.Port}
+	copy(key.ip[:], addr.IP.To16())
+	return key
+}
+
+func (p *udpShard) push(pkt *udpPacket) {
+	select {
+	case p.queue <- pkt:
+	default:
+		// 工作协程处理不过来时丢弃,不阻塞其它工作协程的客户端
+		p.relay.putPacket(pkt)
+	}
+}
+
+func (p *udpShard) run() {
+	defer func() {
+		p.mu.Lock()
+		for _, c := range p.clients {
+			c.close()
+		}
+		p.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case pkt := <-p.queue:
+			if c := p.client(pkt); c != nil {
+				c.relayToRemote(pkt.buf[:pkt.n])
+			}
+			p.relay.putPacket(pkt)
+		case <-p.relay.done:
+			return
 		}
 	}
 }
 
-func relayToRemote(sender net.PacketConn, datagram []byte) error {
-	d, err := NewUDPDatagramFromBytes(datagram)
+func (p *udpShard) client(pkt *udpPacket) *udpClient {
+	key := newUDPClientKey(pkt.addr)
+	p.mu.Lock()
+	c := p.clients[key]
+	p.mu.Unlock()
+	//关联已结束的客户端正在关闭,重新查找关联
+	if c != nil && !c.assocEnded() {
+		return c
+	}
+
+	a := p.relay.assocs.find(pkt.addr)
+	if a == nil && p.relay.requireAssoc != nil && p.relay.requireAssoc() {
+		return nil
+	}
+
+	sender, err := net.ListenUDP("udp", nil)
 	if err != nil {
-		return err
+		return nil
 	}
-	if d.Frag != 0x00 {
-		return ErrUDPFrag
+	c = &udpClient{
+		shard:   p,
+		addr:    pkt.addr,
+		sock:    pkt.sock,
+		sender:  sender,
+		targets: make(map[string]*udpTarget),
+		done:    make(chan struct{}),
+	}
+	if a != nil {
+		c.assoc = a
+		c.session = a.session
+		c.rules = a.rules
+		c.timeout = a.timeout
+		if a.router != nil && len(a.router.routes) > 0 {
+			c.router = a.router
+		}
+	}
+	p.mu.Lock()
+	p.clients[key] = c
+	p.mu.Unlock()
+
+	//关联结束(控制连接断开或会话被Kill)时关闭客户端,不再转发
+	if a != nil {
+		go func() {
+			select {
+			case <-a.done:
+				c.close()
+			case <-c.done:
+			}
+		}()
+	}
+
+	go func() {
+		c.relayToClient()
+		p.mu.Lock()
+		if p.clients[key] == c {
+			delete(p.clients, key)
+		}
+		p.mu.Unlock()
+		c.close()
+	}()
+	return c
+}
+
+// write 合并各客户端的下行数据包,批量发往客户端
+func (p *udpShard) write() {
+	pkts := make([]*udpPacket, 0, udpBatchSize)
+	msgs := make([]udpMessage, udpBatchSize)
+	for i := range msgs {
+		msgs[i].Buffers = make([][]byte, 1)
+	}
+
+	for {
+		select {
+		case pkt := <-p.replies:
+			pkts = append(pkts[:0], pkt)
+		case <-p.relay.done:
+			return
+		}
+	more:
+		for len(pkts) < udpBatchSize {
+			select {
+			case pkt := <-p.replies:
+				pkts = append(pkts, pkt)
+			default:
+				break more
+			}
+		}
+
+		for i, pkt := range pkts {
+			msgs[i].Buffers[0] = pkt.buf[pkt.off:pkt.n]
+			msgs[i].Addr = pkt.addr
+		}
+		// 连续的发往同一socket的数据包一起发送
+		for start := 0; start < len(pkts); {
+			end := start + 1
+			for end < len(pkts) && pkts[end].sock == pkts[start].sock {
+				end++
+			}
+			sent, err := pkts[start].sock.writeBatch(msgs[start:end])
+			if err != nil {
+				logrus.WithError(err).Debug("udp relay write")
+			}
+			for _, pkt := range pkts[start : start+sent] {
+				if pkt.session != nil {
+					pkt.session.addPacketDown(pkt.size)
+				}
+			}
+			start = end
+		}
+		for i, pkt := range pkts {
+			msgs[i].Addr = nil
+			p.relay.putPacket(pkt)
+		}
+	}
+}
+
+// udpClient 一个客户端地址对应的sender,上行由工作协程写入,下行由独立的协程读取
+type udpClient struct {
+	shard   *udpShard
+	addr    *net.UDPAddr
+	sock    *udpBatchConn //客户端发来数据包的中继socket
+	sender  *net.UDPConn
+	session *Session
+	rules   *RuleSet        //关联所在监听的访问规则,按每个目标检查
+	timeout time.Duration   //与上游代理建立udp关联的超时,没有关联时不经上游转发
+	router  *Router         //关联所在监听的路由规则,没有规则时为nil
+	assoc   *udpAssociation //没有关联时为nil
+	done    chan struct{}   //关闭客户端后关闭
+
+	targets map[string]*udpTarget //只在工作协程中访问,key为socks5地址
+	lastUp  int64                 //最近一次上行的时间(UnixNano)
+
+	mu        sync.Mutex
+	upstreams map[upstreamDialer]*udpUpstream //经上游代理转发时与上游的udp关联
+	closed    bool
+}
+
+// udpTarget 目标地址和路由结果。第一次使用或过期时在独立的协程中解析域名、匹配路由和建立上游关联,
+// 不阻塞工作协程中的其它目标,期间的数据包排队,准备好后按顺序发送
+type udpTarget struct {
+	str    string
+	domain bool
+	stale  int32 //发往上游关联失败后置1,下一个数据包重新准备
+
+	mu      sync.Mutex
+	ready   bool
+	pending []udpPending
+
+	//准备好之后不再修改
+	err    error        //准备失败时丢弃数据包,udpRetryInterval后重新准备
+	addr   *net.UDPAddr //直连时的目标地址
+	route  *route
+	up     *udpUpstream //经上游代理转发时的udp关联
+	expire time.Time    //为0时不过期
+}
+
+// udpPending 目标准备期间排队的数据包,hdr为socks5头部长度
+type udpPending struct {
+	datagram []byte
+	hdr      int
+}
+
+// target 返回缓存的目标,没有或已过期时创建并开始准备
+func (p *udpClient) target(addr AddrByte) *udpTarget {
+	if t, ok := p.targets[string(addr)]; ok && !t.expired() {
+		return t
+	}
+
+	t := &udpTarget{str: addr.String(), domain: addr[0] == ATypDomainname}
+	if len(p.targets) >= udpTargetCacheSize {
+		p.targets = make(map[string]*udpTarget)
 	}
+	p.targets[string(addr)] = t
+	go p.prepare(t)
+	return t
+}
+
+func (p *udpTarget) expired() bool {
+	if atomic.LoadInt32(&p.stale) == 1 {
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.ready && !p.expire.IsZero() && !time.Now().Before(p.expire)
+}
 
-	udpTargetAddr := d.Address()
+// prepare 检查访问规则并匹配路由,直连时解析目标地址,经上游代理时取得或建立关联,然后发送排队的数据包
+func (p *udpClient) prepare(t *udpTarget) {
+	var addr *net.UDPAddr
+	var resolveErr error
+	resolve := func() (*net.UDPAddr, error) {
+		if addr == nil && resolveErr == nil {
+			addr, resolveErr = net.ResolveUDPAddr("udp", t.str)
+		}
+		return addr, resolveErr
+	}
+
+	//与tcp相同,匹配的规则可以覆盖连接超时
+	var r *route
+	rule := p.rules.match(p.addr, t.str)
+	allowed := rule == nil || rule.allow
+	timeout := p.timeout
+	if rule != nil && rule.connectTimeout > 0 {
+		timeout = time.Duration(rule.connectTimeout) * time.Second
+	}
+	if allowed && p.router != nil {
+		r = p.router.find(p.addr.IP, t.str, func(string) []net.IP {
+			if addr, err := resolve(); err == nil {
+				return []net.IP{addr.IP}
+			}
+			return nil
+		})
+	}
 
-	tgtUDPAddr, err := net.ResolveUDPAddr("udp", udpTargetAddr)
+	var up *udpUpstream
+	var err error
+	switch {
+	case !allowed:
+		err = fmt.Errorf("%s:%w", t.str, ErrRuleDenied)
+	case r != nil && r.outbound == OutboundBlock:
+	case r != nil && r.upstream != nil:
+		up, err = p.upstream(r.upstream, t.str, timeout)
+	default:
+		_, err = resolve()
+	}
+	if err != nil {
+		logrus.WithError(err).Debug("udp target:", t.str)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.err, t.addr, t.route, t.up = err, addr, r, up
+	switch {
+	case err != nil:
+		t.expire = time.Now().Add(udpRetryInterval)
+	case t.domain:
+		t.expire = time.Now().Add(udpResolveTTL)
+	}
+	t.ready = true
+
+	//持有锁发送,保证排队的数据包在工作协程之后发送的数据包之前
+	for _, pd := range t.pending {
+		p.send(t, pd.datagram, pd.hdr)
+	}
+	t.pending = nil
+}
+
+func (p *udpClient) relayToRemote(datagram []byte) error {
+	if len(datagram) < 4 {
+		return ErrBadRequest
+	}
+	if datagram[2] != 0x00 {
+		return ErrUDPFrag
+	}
+	addr, err := NewAddrByteFromByte(datagram[3:])
 	if err != nil {
 		return err
 	}
+	hdr := 3 + len(addr)
 
-	logrus.Debug("udp req:", udpTargetAddr)
+	t := p.target(addr)
+	if logrus.IsLevelEnabled(logrus.DebugLevel) {
+		logrus.Debug("udp req:", t.str)
+	}
+
+	t.mu.Lock()
+	if !t.ready {
+		defer t.mu.Unlock()
+		if len(t.pending) >= udpPendingLen {
+			return fmt.Errorf("%s:udp target not ready", t.str)
+		}
+		t.pending = append(t.pending, udpPending{datagram: append([]byte(nil), datagram...), hdr: hdr})
+		return nil
+	}
+	t.mu.Unlock()
+	return p.send(t, datagram, hdr)
+}
+
+// send 按目标准备好的路由发送一个数据包,hdr为datagram中socks5头部的长度
+func (p *udpClient) send(t *udpTarget, datagram []byte, hdr int) error {
+	if t.err != nil {
+		return t.err
+	}
+	if p.router != nil {
+		p.router.count(t.route)
+	}
+	if t.route != nil && t.route.outbound == OutboundBlock {
+		return fmt.Errorf("%s:blocked by route:%w", t.str, ErrRuleDenied)
+	}
+
+	data := datagram[hdr:]
+	session := p.session
+	if session != nil && session.hasHooks() {
+		if err := session.onUDPPacket(true, t.str, len(data)); err != nil {
+			return hookError(err)
+		}
+	}
 
-	_, err = sender.WriteTo(d.Data, tgtUDPAddr)
+	atomic.StoreInt64(&p.lastUp, time.Now().UnixNano())
+	var err error
+	if t.up != nil {
+		//上游中继需要socks5头部,原样发送
+		if _, err = t.up.conn.Write(datagram); err != nil {
+			atomic.StoreInt32(&t.stale, 1)
+		}
+	} else {
+		_, err = p.sender.WriteToUDP(data, t.addr)
+	}
+	if err == nil && session != nil {
+		session.addPacketUp(len(data))
+	}
 	return err
 }
 
-func relayToClient(receiver net.PacketConn, relayer net.PacketConn, clientAddr net.Addr, timeout time.Duration) error {
-	buf := pool.GetBuf(MaxSegmentSize)
-	defer pool.PutBuf(buf)
+// udpUpstream 客户端经一个上游代理转发时的udp关联
+type udpUpstream struct {
+	ready chan struct{} //关联建立或失败后关闭
+	err   error
+	ctrl  net.Conn
+	conn  *net.UDPConn
+}
+
+// upstream 返回客户端经上游代理转发的udp关联,没有时建立,同一上游的目标共用一个关联
+func (p *udpClient) upstream(up upstreamDialer, target string, timeout time.Duration) (*udpUpstream, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, errUDPClientClosed
+	}
+	if u := p.upstreams[up]; u != nil {
+		p.mu.Unlock()
+		<-u.ready
+		if u.err != nil {
+			return nil, u.err
+		}
+		return u, nil
+	}
+	u := &udpUpstream{ready: make(chan struct{})}
+	if p.upstreams == nil {
+		p.upstreams = make(map[upstreamDialer]*udpUpstream)
+	}
+	p.upstreams[up] = u
+	p.mu.Unlock()
+
+	u.ctrl, u.conn, u.err = up.associate(p.addr, target, timeout)
+	close(u.ready)
+
+	p.mu.Lock()
+	closed := p.closed
+	if (u.err != nil || closed) && p.upstreams[up] == u {
+		delete(p.upstreams, up)
+	}
+	p.mu.Unlock()
+	if u.err != nil {
+		return nil, u.err
+	}
+	if closed {
+		u.close()
+		return nil, errUDPClientClosed
+	}
+
+	go func() {
+		p.relayFromUpstream(u)
+		p.mu.Lock()
+		if p.upstreams[up] == u {
+			delete(p.upstreams, up)
+		}
+		p.mu.Unlock()
+		u.close()
+	}()
+	return u, nil
+}
+
+// relayFromUpstream 上游中继发来的数据包已有socks5头部,原样交给工作协程发往客户端
+func (p *udpClient) relayFromUpstream(u *udpUpstream) error {
+	relay := p.shard.relay
+	pkt := relay.getPacket()
+	defer func() {
+		relay.putPacket(pkt)
+	}()
 
 	for {
-		receiver.SetReadDeadline(time.Now().Add(timeout))
-		n, addr, err := receiver.ReadFrom(buf)
+		u.conn.SetReadDeadline(time.Now().Add(relay.timeout))
+		n, err := u.conn.Read(pkt.buf)
 		if err != nil {
 			return err
 		}
-
-		bAddr, err := NewAddrByteFromString(addr.String())
+		if n < 4 || pkt.buf[2] != 0x00 {
+			continue
+		}
+		addr, err := NewAddrByteFromByte(pkt.buf[3:n])
 		if err != nil {
-			return err
+			continue
 		}
+		size := n - 3 - len(addr)
 
-		_, err = relayer.WriteTo(NewUDPDatagram(bAddr, buf[:n]).ToBytes(), clientAddr)
+		session := p.session
+		if session != nil && session.hasHooks() && session.onUDPPacket(false, addr.String(), size) != nil {
+			continue
+		}
+
+		pkt.off, pkt.n, pkt.size = 0, n, size
+		pkt.addr, pkt.sock, pkt.session = p.addr, p.sock, session
+
+		select {
+		case p.shard.replies <- pkt:
+		case <-relay.done:
+			return nil
+		}
+		pkt = relay.getPacket()
+	}
+}
+
+func (p *udpUpstream) close() {
+	p.ctrl.Close()
+	p.conn.Close()
+}
+
+// assocEnded 客户端所属的UDP ASSOCIATE关联已结束
+func (p *udpClient) assocEnded() bool {
+	if p.assoc == nil {
+		return false
+	}
+	select {
+	case <-p.assoc.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// close 客户端超时或关联结束后关闭sender和与上游的udp关联,正在建立的关联在建立后关闭
+func (p *udpClient) close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	ups := p.upstreams
+	p.upstreams = nil
+	p.mu.Unlock()
+
+	close(p.done)
+	p.sender.Close()
+	for _, u := range ups {
+		select {
+		case <-u.ready:
+			if u.err == nil {
+				u.close()
+			}
+		default:
+		}
+	}
+}
+
+// relayToClient 读取目标发来的数据包,在缓冲区预留的空间中填写socks5头部后交给工作协程发送。
+// 两个方向都超过timeout没有数据时结束
+func (p *udpClient) relayToClient() error {
+	relay := p.shard.relay
+	pkt := relay.getPacket()
+	defer func() {
+		relay.putPacket(pkt)
+	}()
+
+	for {
+		p.sender.SetReadDeadline(time.Now().Add(relay.timeout))
+		n, addr, err := p.sender.ReadFromUDP(pkt.buf[udpHeaderRoom:])
 		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				last := atomic.LoadInt64(&p.lastUp)
+				if time.Since(time.Unix(0, last)) < relay.timeout {
+					continue
+				}
+			}
 			return err
 		}
+
+		session := p.session
+		if session != nil && session.hasHooks() && session.onUDPPacket(false, addr.String(), n) != nil {
+			continue
+		}
+
+		pkt.off = udpHeaderRoom - udpHeaderLen(addr)
+		pkt.n = udpHeaderRoom + n
+		pkt.size = n
+		putUDPHeader(pkt.buf[pkt.off:udpHeaderRoom], addr)
+		pkt.addr, pkt.sock, pkt.session = p.addr, p.sock, session
+
+		select {
+		case p.shard.replies <- pkt:
+		case <-relay.done:
+			return nil
+		}
+		pkt = relay.getPacket()
 	}
 }
 
-type SenderMap struct {
-	sync.Map
+// udpHeaderLen 来源地址为addr时socks5 udp头部的长度
+func udpHeaderLen(addr *net.UDPAddr) int {
+	if addr.IP.To4() != nil {
+		return 3 + 1 + net.IPv4len + PortLen
+	}
+	return 3 + 1 + net.IPv6len + PortLen
 }
 
-func (p *SenderMap) Add(key string, conn net.PacketConn) {
-	p.Map.Store(key, conn)
+// putUDPHeader 在b中填写socks5 udp头部,b的长度为udpHeaderLen(addr)
+func putUDPHeader(b []byte, addr *net.UDPAddr) {
+	b[0], b[1], b[2] = 0, 0, 0
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		b[3] = ATypIPV4
+		copy(b[4:], ip4)
+	} else {
+		b[3] = ATypIPV6
+		copy(b[4:], addr.IP.To16())
+	}
+	b[len(b)-2], b[len(b)-1] = byte(addr.Port>>8), byte(addr.Port)
 }
 
-func (p *SenderMap) Del(key string) net.PacketConn {
-	if conn, exist := p.Get(key); exist {
-		p.Map.Delete(key)
-		return conn
+// udpAdvertise 解析后的UDPAdvertiseCfg
+type udpAdvertise struct {
+	ip      net.IP
+	clients []*net.IPNet
+}
+
+func newUDPAdvertise(cfgs []UDPAdvertiseCfg) ([]udpAdvertise, error) {
+	var advs []udpAdvertise
+	for _, c := range cfgs {
+		ip := net.ParseIP(c.IP)
+		if ip == nil {
+			return nil, fmt.Errorf("UDPAdvertise invalid ip:%s", c.IP)
+		}
+		adv := udpAdvertise{ip: normalizeIP(ip)}
+		for _, s := range c.Clients {
+			n, err := parseIPNet(s)
+			if err != nil {
+				return nil, fmt.Errorf("UDPAdvertise %w", err)
+			}
+			adv.clients = append(adv.clients, n)
+		}
+		advs = append(advs, adv)
 	}
+	return advs, nil
+}
 
-	return nil
+// selectUDPAdvertise 返回第一个匹配客户端且与客户端地址族相同的广告地址,
+// 都不同时返回第一个匹配客户端的,没有匹配时返回nil
+func selectUDPAdvertise(advs []udpAdvertise, client net.IP) net.IP {
+	var first net.IP
+	for _, adv := range advs {
+		if len(adv.clients) > 0 && !ipNetsContain(adv.clients, client) {
+			continue
+		}
+		if client == nil || (adv.ip.To4() != nil) == (client.To4() != nil) {
+			return adv.ip
+		}
+		if first == nil {
+			first = adv.ip
+		}
+	}
+	return first
+}
+
+// normalizeIP ipv4映射的ipv6地址转为4字节的ipv4地址
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// udpAssociation 一个UDP ASSOCIATE请求，用于把中继收到的数据包对应到会话
+type udpAssociation struct {
+	session *Session
+	rules   *RuleSet
+	router  *Router
+	timeout time.Duration //与上游代理建立udp关联的超时
+	ip      string
+	port    int           //客户端声明的或第一个数据包的源端口,0表示还未确定
+	done    chan struct{} //关联删除后关闭,使用关联的中继客户端随之关闭
+}
+
+type udpAssocTable struct {
+	mu     sync.Mutex
+	assocs map[string][]*udpAssociation //key为客户端ip
+}
+
+// add 注册一个关联，cfg为UDP ASSOCIATE所在监听的配置，clientAddr为tcp控制连接的客户端地址，port为请求中声明的udp源端口
+func (p *udpAssocTable) add(session *Session, cfg *ConnCfg, clientAddr net.Addr, port int) *udpAssociation {
+	ip := addrIP(clientAddr)
+	if ip == nil {
+		return nil
+	}
+
+	a := &udpAssociation{
+		session: session,
+		rules:   cfg.Rules,
+		router:  cfg.Routes,
+		timeout: cfg.connectTimeout(),
+		ip:      ip.String(),
+		port:    port,
+		done:    make(chan struct{}),
+	}
+	p.mu.Lock()
+	if p.assocs == nil {
+		p.assocs = make(map[string][]*udpAssociation)
+	}
+	p.assocs[a.ip] = append(p.assocs[a.ip], a)
+	p.mu.Unlock()
+	return a
 }
 
-func (p *SenderMap) Get(key string) (net.PacketConn, bool) {
-	v, exist := p.Load(key)
-	if !exist {
-		return nil, false
+func (p *udpAssocTable) del(a *udpAssociation) {
+	if a == nil {
+		return
 	}
 
-	return v.(net.PacketConn), true
+	//从表中删除后再通知,之后的数据包不会再找到这个关联
+	defer close(a.done)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	list := p.assocs[a.ip]
+	for i, v := range list {
+		if v == a {
+			list = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(p.assocs, a.ip)
+	} else {
+		p.assocs[a.ip] = list
+	}
+}
+
+// find 查找数据包来源对应的关联，优先匹配端口，其次使用最近一个还未确定端口的关联并确定其端口
+func (p *udpAssocTable) find(addr *net.UDPAddr) *udpAssociation {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	list := p.assocs[addr.IP.String()]
+	for _, a := range list {
+		if a.port == addr.Port {
+			return a
+		}
+	}
+	for i := len(list) - 1; i >= 0; i-- {
+		if list[i].port == 0 {
+			list[i].port = addr.Port
+			return list[i]
+		}
+	}
+	return nil
 }
 
 type SocksUDPConn struct {
 	*net.UDPConn
+	ctrlConn     net.Conn //UDP ASSOCIATE的tcp连接,关闭后服务端结束udp关联
 	dstAddr      AddrByte
 	timeout      time.Duration
 	readDeadline time.Time
 }
 
+func (p *SocksUDPConn) Close() error {
+	if p.ctrlConn != nil {
+		p.ctrlConn.Close()
+	}
+	return p.UDPConn.Close()
+}
+
 func (p *SocksUDPConn) SetReadDeadline(t time.Time) error {
 	p.readDeadline = t
 	return nil
@@ -0,0 +1,68 @@
+//go:build linux
+// +build linux
+
+package socks5
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// udpBatchConn linux下使用recvmmsg/sendmmsg批量收发
+type udpBatchConn struct {
+	conn *net.UDPConn
+	pc   interface {
+		ReadBatch(ms []ipv4.Message, flags int) (int, error)
+		WriteBatch(ms []ipv4.Message, flags int) (int, error)
+	}
+	ipv4 bool //AF_INET socket
+}
+
+func newUDPBatchConn(conn *net.UDPConn) *udpBatchConn {
+	p := &udpBatchConn{conn: conn}
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		p.ipv4 = true
+		p.pc = ipv4.NewPacketConn(conn)
+	} else {
+		p.pc = ipv6.NewPacketConn(conn)
+	}
+	return p
+}
+
+func (p *udpBatchConn) readBatch(ms []udpMessage) (int, error) {
+	return p.pc.ReadBatch(ms, 0)
+}
+
+// writeBatch 返回按顺序发送成功的数据包数
+func (p *udpBatchConn) writeBatch(ms []udpMessage) (int, error) {
+	sent := 0
+	for sent < len(ms) {
+		i := sent
+		for i < len(ms) && p.batchable(ms[i].Addr) {
+			i++
+		}
+
+		if i == sent {
+			// 双栈socket发往ipv4地址时需要使用映射的ipv6地址,x/net不支持,单独发送
+			if _, err := p.conn.WriteTo(ms[i].Buffers[0], ms[i].Addr); err != nil {
+				return sent, err
+			}
+			sent++
+			continue
+		}
+
+		n, err := p.pc.WriteBatch(ms[sent:i], 0)
+		sent += n
+		if err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+func (p *udpBatchConn) batchable(addr net.Addr) bool {
+	a, ok := addr.(*net.UDPAddr)
+	return ok && p.ipv4 == (a.IP.To4() != nil)
+}
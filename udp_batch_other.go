@@ -0,0 +1,36 @@
+//go:build !linux
+// +build !linux
+
+package socks5
+
+import (
+	"net"
+)
+
+// udpBatchConn 不支持recvmmsg/sendmmsg的系统每次收发一个数据包
+type udpBatchConn struct {
+	conn *net.UDPConn
+}
+
+func newUDPBatchConn(conn *net.UDPConn) *udpBatchConn {
+	return &udpBatchConn{conn: conn}
+}
+
+func (p *udpBatchConn) readBatch(ms []udpMessage) (int, error) {
+	n, addr, err := p.conn.ReadFromUDP(ms[0].Buffers[0])
+	if err != nil {
+		return 0, err
+	}
+	ms[0].N, ms[0].Addr = n, addr
+	return 1, nil
+}
+
+// writeBatch 返回按顺序发送成功的数据包数
+func (p *udpBatchConn) writeBatch(ms []udpMessage) (int, error) {
+	for i := range ms {
+		if _, err := p.conn.WriteTo(ms[i].Buffers[0], ms[i].Addr); err != nil {
+			return i, err
+		}
+	}
+	return len(ms), nil
+}
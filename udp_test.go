@@ -0,0 +1,244 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startTestUDPRelay 在loopback上启动udp中继和udp回显服务
+func startTestUDPRelay(t testing.TB, workers int) (relayAddr *net.UDPAddr, echoAddr *net.UDPAddr) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		go func() {
+			buf := make([]byte, MaxSegmentSize)
+			for {
+				n, addr, err := echo.ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+				echo.WriteToUDP(buf[:n], addr)
+			}
+		}()
+	}
+
+	relay, err := listenUDPRelay(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, &ServerCfg{UDPTimout: 5, UDPWorkers: workers})
+	if err != nil {
+		echo.Close()
+		t.Fatal(err)
+	}
+	go relay.run()
+
+	t.Cleanup(func() {
+		relay.close()
+		echo.Close()
+	})
+	return relay.socks[0].conn.LocalAddr().(*net.UDPAddr), echo.LocalAddr().(*net.UDPAddr)
+}
+
+func udpDatagram(target string, data string) []byte {
+	addr, _ := NewAddrByteFromString(target)
+	return NewUDPDatagram(addr, []byte(data)).ToBytes()
+}
+
+func TestUDPRelay_Clients(t *testing.T) {
+	relayAddr, echoAddr := startTestUDPRelay(t, 2)
+	targets := []string{echoAddr.String(), fmt.Sprintf("localhost:%d", echoAddr.Port)}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := net.DialUDP("udp", nil, relayAddr)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+
+			//同一客户端的数据包按顺序转发
+			buf := make([]byte, MaxSegmentSize)
+			for j := 0; j < 50; j++ {
+				msg := fmt.Sprintf("client%d-%d", i, j)
+				conn.Write(udpDatagram(targets[i%len(targets)], msg))
+				conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+				n, err := conn.Read(buf)
+				if err != nil {
+					errs <- err
+					return
+				}
+				d, err := NewUDPDatagramFromBytes(buf[:n])
+				if err != nil || string(d.Data) != msg || d.Address() != echoAddr.String() {
+					errs <- fmt.Errorf("reply:%v %v", d, err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestUDPRelay_Header(t *testing.T) {
+	for _, s := range []string{"10.0.0.1:53", "[2001:db8::1]:8080"} {
+		addr, _ := net.ResolveUDPAddr("udp", s)
+		b := make([]byte, udpHeaderLen(addr))
+		putUDPHeader(b, addr)
+		d, err := NewUDPDatagramFromBytes(b)
+		if err != nil || d.Address() != s || len(d.Data) != 0 {
+			t.Fatalf("header %s:%v %v", s, d, err)
+		}
+	}
+}
+
+// BenchmarkUDPRelay 多个客户端经过中继和回显服务往返,报告每秒往返的数据包数
+func BenchmarkUDPRelay(b *testing.B) {
+	for _, clients := range []int{1, 8, 64} {
+		b.Run(fmt.Sprintf("clients=%d", clients), func(b *testing.B) {
+			benchmarkUDPRelay(b, clients)
+		})
+	}
+}
+
+func benchmarkUDPRelay(b *testing.B, clients int) {
+	relayAddr, echoAddr := startTestUDPRelay(b, 0)
+	datagram := udpDatagram(echoAddr.String(), string(make([]byte, 512)))
+
+	// 每个客户端一次发送window个数据包再读取应答,丢失的数据包在读超时后不再等待
+	const window = 16
+	var received int64
+	var wg sync.WaitGroup
+	b.SetBytes(int64(len(datagram)))
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < clients; i++ {
+		n := b.N / clients
+		if i < b.N%clients {
+			n++
+		}
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			conn, err := net.DialUDP("udp", nil, relayAddr)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			defer conn.Close()
+
+			buf := make([]byte, MaxSegmentSize)
+			for n > 0 {
+				w := window
+				if n < w {
+					w = n
+				}
+				n -= w
+				for j := 0; j < w; j++ {
+					conn.Write(datagram)
+				}
+				conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+				for j := 0; j < w; j++ {
+					if _, err := conn.Read(buf); err != nil {
+						break
+					}
+					atomic.AddInt64(&received, 1)
+				}
+			}
+		}(n)
+	}
+	wg.Wait()
+	b.StopTimer()
+
+	elapsed := time.Since(start).Seconds()
+	b.ReportMetric(float64(received)/elapsed, "pkts/s")
+	b.ReportMetric(float64(b.N-int(received))/float64(b.N)*100, "%loss")
+}
+
+func TestUDPRelay_DualStack(t *testing.T) {
+	relay, err := listenUDPRelay(&net.UDPAddr{}, &ServerCfg{UDPTimout: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go relay.run()
+	defer relay.close()
+
+	if relay.listenIP() != nil {
+		t.Fatalf("listen ip:%v", relay.listenIP())
+	}
+	if len(relay.socks) == 1 {
+		t.Skip("ipv6 not supported")
+	}
+
+	_, echoAddr := startTestUDPRelay(t, 1)
+	for _, ip := range []string{"127.0.0.1", "::1"} {
+		conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP(ip), Port: relay.port()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write(udpDatagram(echoAddr.String(), ip))
+		buf := make([]byte, MaxSegmentSize)
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		n, err := conn.Read(buf)
+		conn.Close()
+		if err != nil {
+			t.Fatalf("%s:%v", ip, err)
+		}
+		if d, err := NewUDPDatagramFromBytes(buf[:n]); err != nil || string(d.Data) != ip {
+			t.Fatalf("%s reply:%v %v", ip, d, err)
+		}
+	}
+}
+
+func TestSelectUDPAdvertise(t *testing.T) {
+	advs, err := newUDPAdvertise([]UDPAdvertiseCfg{
+		{IP: "192.168.1.10", Clients: []string{"192.168.1.0/24"}},
+		{IP: "203.0.113.10"},
+		{IP: "2001:db8::10"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]string{
+		"192.168.1.20":        "192.168.1.10",
+		"::ffff:192.168.1.20": "192.168.1.10",
+		"10.0.0.1":            "203.0.113.10",
+		"2001:db8:1::1":       "2001:db8::10",
+		"::ffff:10.0.0.1":     "203.0.113.10",
+		"fe80::1":             "2001:db8::10",
+	}
+	for client, want := range cases {
+		if got := selectUDPAdvertise(advs, net.ParseIP(client)); got.String() != want {
+			t.Fatalf("client %s:%v want %s", client, got, want)
+		}
+	}
+	//unix socket客户端没有ip,只匹配没有限制客户端的地址
+	if got := selectUDPAdvertise(advs, nil); got.String() != "203.0.113.10" {
+		t.Fatalf("unix client:%v", got)
+	}
+
+	//只有ipv4的广告地址时ipv6客户端也使用它
+	if got := selectUDPAdvertise(advs[1:2], net.ParseIP("::1")); got.String() != "203.0.113.10" {
+		t.Fatalf("fallback:%v", got)
+	}
+
+	if _, err := newUDPAdvertise([]UDPAdvertiseCfg{{IP: "bad"}}); err == nil {
+		t.Fatal("expect invalid ip error")
+	}
+
+	addr, err := NewAddrByteFromString("[::ffff:10.0.0.1]:1080")
+	if err != nil || addr[0] != ATypIPV4 || addr.String() != "10.0.0.1:1080" {
+		t.Fatalf("mapped addr:%v %v", addr, err)
+	}
+}
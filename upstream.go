@@ -0,0 +1,197 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	UpstreamTypeSocks5 = "socks5"
+	UpstreamTypeSocks4 = "socks4"
+)
+
+// upstreamDialer 路由选择的上游代理或上游代理组,client用于按客户端选择组成员
+type upstreamDialer interface {
+	dial(client net.Addr, addr string, timeout time.Duration) (Stream, byte, string, error)
+	associate(client net.Addr, target string, timeout time.Duration) (net.Conn, *net.UDPConn, error)
+}
+
+// upstreamSet 配置中的所有上游代理和上游代理组,由server创建,重新加载配置时整体替换
+type upstreamSet struct {
+	dialers   map[string]upstreamDialer
+	upstreams []*upstream
+	groups    []*upstreamGroup
+}
+
+func newUpstreamSet(cfgs []UpstreamCfg, groupCfgs []UpstreamGroupCfg) (*upstreamSet, error) {
+	ups := make(map[string]*upstream, len(cfgs))
+	set := &upstreamSet{dialers: make(map[string]upstreamDialer, len(cfgs)+len(groupCfgs))}
+	for _, c := range cfgs {
+		if err := set.checkName(c.Name); err != nil {
+			return nil, err
+		}
+		if len(c.ServerAddr) == 0 {
+			return nil, fmt.Errorf("upstream %s:ServerAddr is required", c.Name)
+		}
+
+		typ := strings.ToLower(c.Type)
+		switch typ {
+		case "":
+			typ = UpstreamTypeSocks5
+		case UpstreamTypeSocks5, UpstreamTypeSocks4:
+		default:
+			return nil, fmt.Errorf("upstream %s:unknown type:%s", c.Name, c.Type)
+		}
+		if c.Mux && typ != UpstreamTypeSocks5 {
+			return nil, fmt.Errorf("upstream %s:Mux requires socks5", c.Name)
+		}
+
+		up := &upstream{name: c.Name, typ: typ, cfg: c.ClientCfg}
+		if typ == UpstreamTypeSocks5 {
+			up.client = NewSocks5Client(c.ClientCfg)
+		}
+		ups[c.Name] = up
+		set.upstreams = append(set.upstreams, up)
+		set.dialers[c.Name] = ups[c.Name]
+	}
+
+	for _, c := range groupCfgs {
+		if err := set.checkName(c.Name); err != nil {
+			return nil, err
+		}
+		g, err := newUpstreamGroup(c, ups)
+		if err != nil {
+			return nil, fmt.Errorf("upstream group %s:%w", c.Name, err)
+		}
+		set.groups = append(set.groups, g)
+		set.dialers[c.Name] = g
+	}
+	return set, nil
+}
+
+func (p *upstreamSet) checkName(name string) error {
+	switch name {
+	case "":
+		return errors.New("upstream name is required")
+	case OutboundDirect, OutboundBlock:
+		return fmt.Errorf("upstream name %s is reserved", name)
+	}
+	if _, ok := p.dialers[name]; ok {
+		return fmt.Errorf("duplicate upstream:%s", name)
+	}
+	return nil
+}
+
+// start 开始上游代理组的健康检查
+func (p *upstreamSet) start() {
+	for _, g := range p.groups {
+		g.start()
+	}
+}
+
+// stop 停止健康检查并关闭复用的连接,经复用连接建立的连接结束后才关闭
+func (p *upstreamSet) stop() {
+	for _, g := range p.groups {
+		g.stop()
+	}
+	for _, up := range p.upstreams {
+		if up.client != nil {
+			up.client.Close()
+		}
+	}
+}
+
+// upstream 一个上游代理
+type upstream struct {
+	name   string
+	typ    string
+	cfg    ClientCfg
+	client *socks5client //socks5上游的客户端,开启Mux时复用到上游的连接
+}
+
+// dial 经上游代理连接目标,返回的应答码和绑定地址与defaultDialTarget相同
+func (p *upstream) dial(client net.Addr, addr string, timeout time.Duration) (Stream, byte, string, error) {
+	var conn net.Conn
+	var err error
+	if p.typ == UpstreamTypeSocks4 {
+		conn, err = NewSocks4Client(p.cfg).DialTimeout("tcp", addr, timeout)
+	} else {
+		conn, err = p.client.DialTimeout("tcp", addr, timeout)
+	}
+	if err != nil {
+		return nil, upstreamRep(err), "", fmt.Errorf("upstream %s:%w", p.name, err)
+	}
+	return conn.(Stream), RepSuccess, conn.LocalAddr().String(), nil
+}
+
+// upstreamRep 上游返回失败应答时透传其应答码,socks4的拒绝没有细分原因,作为一般失败;
+// 连接或握手上游失败时返回RepHostUnreachable
+func upstreamRep(err error) byte {
+	var re *ReplyError
+	if !errors.As(err, &re) {
+		return RepHostUnreachable
+	}
+	if re.Ver != VerSocks5 {
+		return RepServerFailure
+	}
+	return re.Rep
+}
+
+// associate 向上游代理发起UDP ASSOCIATE,返回控制连接和连接到上游中继的udp socket,
+// 发往上游中继的数据包和客户端发来的格式相同,可以原样转发
+func (p *upstream) associate(client net.Addr, target string, timeout time.Duration) (net.Conn, *net.UDPConn, error) {
+	if p.typ != UpstreamTypeSocks5 {
+		return nil, nil, fmt.Errorf("upstream %s:%s not support udp", p.name, p.typ)
+	}
+
+	conn, err := p.client.dialServer(timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	uc, err := p.handshakeUDP(conn, timeout)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("upstream %s:%w", p.name, err)
+	}
+	return conn, uc, nil
+}
+
+func (p *upstream) handshakeUDP(conn net.Conn, timeout time.Duration) (*net.UDPConn, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	client := p.client
+	method, err := client.selectAuthMethod(conn)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.authMethod(conn, method); err != nil {
+		return nil, err
+	}
+	reply, err := client.request(conn, CmdUDP, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	relay, err := net.ResolveUDPAddr("udp", reply.Address())
+	if err != nil {
+		return nil, err
+	}
+	//上游应答的中继地址为0.0.0.0时使用上游的服务地址
+	if relay.IP == nil || relay.IP.IsUnspecified() {
+		host, _, err := net.SplitHostPort(p.cfg.ServerAddr)
+		if err != nil {
+			return nil, err
+		}
+		ip, err := net.ResolveIPAddr("ip", host)
+		if err != nil {
+			return nil, err
+		}
+		relay.IP = ip.IP
+	}
+	return net.DialUDP("udp", nil, relay)
+}
@@ -0,0 +1,300 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	StrategyRoundRobin = "round-robin"
+	StrategyLeastConn  = "least-conn"
+	StrategyLatency    = "latency"
+	StrategyHashClient = "hash-client"
+	StrategyHashTarget = "hash-target"
+)
+
+// DefaultHealthCheckInterval 上游代理组健康检查的默认间隔,秒
+const DefaultHealthCheckInterval = 30
+
+// healthCheckTimeout 一次健康检查的超时
+const healthCheckTimeout = 5 * time.Second
+
+// hashReplicas 一致性哈希中每个成员的虚拟节点数
+const hashReplicas = 64
+
+// upstreamGroup 上游代理组,按策略排列成员,连接失败时依次尝试下一个成员。
+// 失败的成员在下一次健康检查成功前排在健康的成员之后
+type upstreamGroup struct {
+	name     string
+	strategy string
+	members  []*groupMember
+	ring     []hashNode //一致性哈希环,按hash排序
+
+	checkTarget string        //健康检查时经成员连接的目标,为空时只连接成员
+	interval    time.Duration //健康检查间隔,为0时不检查
+
+	next uint32 //轮询的位置
+	done chan struct{}
+	once sync.Once
+}
+
+type groupMember struct {
+	conns     int64 //经此成员的活跃tcp连接数
+	latency   int64 //最近一次健康检查的延迟,纳秒,未检查时为math.MaxInt64
+	downUntil int64 //连接或健康检查失败后到此时间(UnixNano)前视为不可用
+
+	upstream *upstream
+}
+
+type hashNode struct {
+	hash   uint32
+	member *groupMember
+}
+
+func newUpstreamGroup(c UpstreamGroupCfg, ups map[string]*upstream) (*upstreamGroup, error) {
+	if len(c.Upstreams) == 0 {
+		return nil, errors.New("Upstreams is required")
+	}
+
+	g := &upstreamGroup{
+		name:        c.Name,
+		strategy:    c.Strategy,
+		checkTarget: c.HealthCheckTarget,
+		done:        make(chan struct{}),
+	}
+	switch c.Strategy {
+	case "":
+		g.strategy = StrategyRoundRobin
+	case StrategyRoundRobin, StrategyLeastConn, StrategyLatency, StrategyHashClient, StrategyHashTarget:
+	default:
+		return nil, fmt.Errorf("unknown strategy:%s", c.Strategy)
+	}
+
+	switch {
+	case c.HealthCheckInterval == 0:
+		g.interval = DefaultHealthCheckInterval * time.Second
+	case c.HealthCheckInterval > 0:
+		g.interval = time.Duration(c.HealthCheckInterval) * time.Second
+	}
+
+	for _, name := range c.Upstreams {
+		up := ups[name]
+		if up == nil {
+			return nil, fmt.Errorf("unknown upstream:%s", name)
+		}
+		m := &groupMember{upstream: up, latency: math.MaxInt64}
+		g.members = append(g.members, m)
+		for i := 0; i < hashReplicas; i++ {
+			g.ring = append(g.ring, hashNode{hash: hashString(name + "#" + strconv.Itoa(i)), member: m})
+		}
+	}
+	sort.Slice(g.ring, func(i, j int) bool {
+		return g.ring[i].hash < g.ring[j].hash
+	})
+	return g, nil
+}
+
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// order 按策略返回尝试成员的顺序,不可用的成员排在最后
+func (p *upstreamGroup) order(client net.Addr, target string) []*groupMember {
+	members := make([]*groupMember, 0, len(p.members))
+	switch p.strategy {
+	case StrategyHashClient, StrategyHashTarget:
+		var key string
+		if p.strategy == StrategyHashClient {
+			if ip := addrIP(client); ip != nil {
+				key = ip.String()
+			}
+		} else if host, _, err := net.SplitHostPort(target); err == nil {
+			key = host
+		} else {
+			key = target
+		}
+		members = p.ringWalk(hashString(key), members)
+	default:
+		start := int(atomic.AddUint32(&p.next, 1)) % len(p.members)
+		members = append(members, p.members[start:]...)
+		members = append(members, p.members[:start]...)
+	}
+
+	switch p.strategy {
+	case StrategyLeastConn:
+		sort.SliceStable(members, func(i, j int) bool {
+			return atomic.LoadInt64(&members[i].conns) < atomic.LoadInt64(&members[j].conns)
+		})
+	case StrategyLatency:
+		sort.SliceStable(members, func(i, j int) bool {
+			return atomic.LoadInt64(&members[i].latency) < atomic.LoadInt64(&members[j].latency)
+		})
+	}
+
+	now := time.Now().UnixNano()
+	sort.SliceStable(members, func(i, j int) bool {
+		return members[i].available(now) && !members[j].available(now)
+	})
+	return members
+}
+
+// ringWalk 从hash的位置顺时针遍历哈希环,成员不可用时由环上的下一个成员接替
+func (p *upstreamGroup) ringWalk(hash uint32, members []*groupMember) []*groupMember {
+	i := sort.Search(len(p.ring), func(i int) bool {
+		return p.ring[i].hash >= hash
+	})
+	seen := make(map[*groupMember]bool, len(p.members))
+	for n := 0; n < len(p.ring) && len(members) < len(p.members); n++ {
+		m := p.ring[(i+n)%len(p.ring)].member
+		if !seen[m] {
+			seen[m] = true
+			members = append(members, m)
+		}
+	}
+	return members
+}
+
+func (p *groupMember) available(now int64) bool {
+	return atomic.LoadInt64(&p.downUntil) <= now
+}
+
+// fail 标记成员不可用,开启健康检查时直到检查成功,否则等待一个默认检查间隔后重试
+func (p *upstreamGroup) fail(m *groupMember, err error) {
+	until := int64(math.MaxInt64)
+	if p.interval == 0 {
+		until = time.Now().Add(DefaultHealthCheckInterval * time.Second).UnixNano()
+	}
+	atomic.StoreInt64(&m.downUntil, until)
+	logrus.WithError(err).WithField("group", p.name).Warn("upstream unavailable")
+}
+
+// isReplyError 上游返回了失败应答,说明上游本身可用,失败的是目标,不切换成员也不标记不可用
+func isReplyError(err error) bool {
+	var re *ReplyError
+	return errors.As(err, &re)
+}
+
+func (p *upstreamGroup) dial(client net.Addr, addr string, timeout time.Duration) (Stream, byte, string, error) {
+	var rep byte
+	var err error
+	for _, m := range p.order(client, addr) {
+		var s Stream
+		var bindAddr string
+		s, rep, bindAddr, err = m.upstream.dial(client, addr, timeout)
+		if err == nil {
+			atomic.AddInt64(&m.conns, 1)
+			return &trackedConn{Stream: s, release: func() { atomic.AddInt64(&m.conns, -1) }}, rep, bindAddr, nil
+		}
+		if isReplyError(err) {
+			return nil, rep, "", err
+		}
+		p.fail(m, err)
+	}
+	return nil, rep, "", err
+}
+
+func (p *upstreamGroup) associate(client net.Addr, target string, timeout time.Duration) (net.Conn, *net.UDPConn, error) {
+	err := fmt.Errorf("upstream group %s:no member supports udp", p.name)
+	for _, m := range p.order(client, target) {
+		if m.upstream.typ != UpstreamTypeSocks5 {
+			continue
+		}
+		var ctrl net.Conn
+		var conn *net.UDPConn
+		ctrl, conn, err = m.upstream.associate(client, target, timeout)
+		if err == nil {
+			return ctrl, conn, nil
+		}
+		if isReplyError(err) {
+			return nil, nil, err
+		}
+		p.fail(m, err)
+	}
+	return nil, nil, err
+}
+
+func (p *upstreamGroup) start() {
+	if p.interval > 0 {
+		go p.healthCheck()
+	}
+}
+
+func (p *upstreamGroup) stop() {
+	p.once.Do(func() {
+		close(p.done)
+	})
+}
+
+// healthCheck 定期检查所有成员,记录延迟并恢复检查成功的成员
+func (p *upstreamGroup) healthCheck() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		var wg sync.WaitGroup
+		for _, m := range p.members {
+			wg.Add(1)
+			go func(m *groupMember) {
+				defer wg.Done()
+				p.check(m)
+			}(m)
+		}
+		wg.Wait()
+
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *upstreamGroup) check(m *groupMember) {
+	start := time.Now()
+	var err error
+	if len(p.checkTarget) > 0 {
+		var s Stream
+		if s, _, _, err = m.upstream.dial(nil, p.checkTarget, healthCheckTimeout); err == nil {
+			s.Close()
+		}
+	} else {
+		var conn net.Conn
+		if conn, err = net.DialTimeout("tcp", m.upstream.cfg.ServerAddr, healthCheckTimeout); err == nil {
+			conn.Close()
+		}
+	}
+
+	if err != nil {
+		atomic.StoreInt64(&m.latency, math.MaxInt64)
+		if m.available(time.Now().UnixNano()) {
+			p.fail(m, err)
+		}
+		return
+	}
+	atomic.StoreInt64(&m.latency, int64(time.Since(start)))
+	atomic.StoreInt64(&m.downUntil, 0)
+}
+
+// trackedConn 经上游代理组建立的连接,关闭时减少成员的活跃连接数
+type trackedConn struct {
+	Stream
+	once    sync.Once
+	release func()
+}
+
+func (p *trackedConn) Close() error {
+	p.once.Do(p.release)
+	return p.Stream.Close()
+}
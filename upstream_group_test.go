@@ -0,0 +1,199 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestUpstreamGroup(t *testing.T, strategy string, addrs ...string) *upstreamGroup {
+	var cfgs []UpstreamCfg
+	var names []string
+	for i, addr := range addrs {
+		name := fmt.Sprintf("up%d", i)
+		cfgs = append(cfgs, UpstreamCfg{Name: name, ClientCfg: ClientCfg{ServerAddr: addr}})
+		names = append(names, name)
+	}
+	set, err := newUpstreamSet(cfgs, []UpstreamGroupCfg{{Name: "group", Upstreams: names, Strategy: strategy, HealthCheckInterval: -1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return set.groups[0]
+}
+
+func TestUpstreamGroup_Order(t *testing.T) {
+	client := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+
+	g := newTestUpstreamGroup(t, StrategyRoundRobin, "127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3")
+	first := g.order(client, "example.com:80")[0]
+	if second := g.order(client, "example.com:80")[0]; second == first {
+		t.Fatal("round-robin returned the same member twice")
+	}
+
+	g = newTestUpstreamGroup(t, StrategyLeastConn, "127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3")
+	g.members[0].conns, g.members[1].conns, g.members[2].conns = 3, 1, 2
+	if m := g.order(client, "example.com:80"); m[0] != g.members[1] || m[1] != g.members[2] {
+		t.Fatal("least-conn order")
+	}
+
+	g = newTestUpstreamGroup(t, StrategyLatency, "127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3")
+	g.members[2].latency = int64(time.Millisecond)
+	if m := g.order(client, "example.com:80"); m[0] != g.members[2] {
+		t.Fatal("latency order")
+	}
+
+	//一致性哈希:同一客户端总是选择同一成员,成员不可用时只有它的客户端换到其它成员
+	g = newTestUpstreamGroup(t, StrategyHashClient, "127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3")
+	picks := make(map[string]*groupMember)
+	used := make(map[*groupMember]bool)
+	for i := 0; i < 100; i++ {
+		c := &net.TCPAddr{IP: net.IPv4(10, 0, byte(i), 1), Port: 1000 + i}
+		picks[c.IP.String()] = g.order(c, "")[0]
+		if again := g.order(&net.TCPAddr{IP: c.IP, Port: 2000}, "")[0]; again != picks[c.IP.String()] {
+			t.Fatal("hash-client not stable")
+		}
+		used[picks[c.IP.String()]] = true
+	}
+	if len(used) != 3 {
+		t.Fatalf("hash-client used %d members", len(used))
+	}
+
+	down := g.members[0]
+	g.fail(down, fmt.Errorf("test"))
+	for ip, m := range picks {
+		got := g.order(&net.TCPAddr{IP: net.ParseIP(ip)}, "")
+		if got[0] == down || got[len(got)-1] != down {
+			t.Fatal("unavailable member not moved last")
+		}
+		if m != down && got[0] != m {
+			t.Fatalf("client %s moved from a healthy member", ip)
+		}
+	}
+
+	g = newTestUpstreamGroup(t, StrategyHashTarget, "127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3")
+	if g.order(client, "example.com:80")[0] != g.order(nil, "example.com:443")[0] {
+		t.Fatal("hash-target should ignore client and port")
+	}
+}
+
+func TestUpstreamGroup_Failover(t *testing.T) {
+	tcpEcho, _ := startTestEchoServer(t)
+
+	up, err := newServer(ServerCfg{UDPListen: "127.0.0.1:0", Listeners: []ListenerCfg{{Listen: "127.0.0.1:0"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := up.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer up.close()
+
+	//关闭的监听作为不可用的成员
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := l.Addr().String()
+	l.Close()
+
+	g := newTestUpstreamGroup(t, StrategyLeastConn, dead, up.listeners[0].addr().String())
+	var conns []Stream
+	for i := 0; i < 3; i++ {
+		s, rep, _, err := g.dial(nil, tcpEcho, time.Second)
+		if err != nil || rep != RepSuccess {
+			t.Fatalf("dial %d:%d %v", i, rep, err)
+		}
+		conns = append(conns, s)
+	}
+	echoTest(conns[0].(*trackedConn).Stream.(net.Conn), "failover", t)
+
+	if g.members[0].available(time.Now().UnixNano()) {
+		t.Fatal("dead member still available")
+	}
+	if n := g.members[1].conns; n != 3 {
+		t.Fatalf("conns:%d", n)
+	}
+	for _, s := range conns {
+		s.Close()
+		s.Close()
+	}
+	if n := g.members[1].conns; n != 0 {
+		t.Fatalf("conns after close:%d", n)
+	}
+
+	//健康检查恢复可以连接的成员并记录延迟
+	g.fail(g.members[1], fmt.Errorf("test"))
+	g.check(g.members[1])
+	g.check(g.members[0])
+	if !g.members[1].available(time.Now().UnixNano()) || g.members[1].latency <= 0 || g.members[0].available(time.Now().UnixNano()) {
+		t.Fatalf("health check:%+v %+v", g.members[0], g.members[1])
+	}
+
+	if _, err := newUpstreamSet(nil, []UpstreamGroupCfg{{Name: "g", Upstreams: []string{"missing"}}}); err == nil {
+		t.Fatal("expect unknown upstream error")
+	}
+}
+
+func TestUpstreamGroup_SilentMember(t *testing.T) {
+	tcpEcho, _ := startTestEchoServer(t)
+
+	up, err := newServer(ServerCfg{UDPListen: "127.0.0.1:0", Listeners: []ListenerCfg{{Listen: "127.0.0.1:0"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := up.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer up.close()
+
+	//接受连接但不应答的成员,握手超时后切换到下一个成员
+	g := newTestUpstreamGroup(t, StrategyLeastConn, startTestSilentServer(t), up.listeners[0].addr().String())
+	g.members[1].conns = 1
+	start := time.Now()
+	s, rep, _, err := g.dial(nil, tcpEcho, 500*time.Millisecond)
+	if err != nil || rep != RepSuccess {
+		t.Fatalf("dial:%d %v", rep, err)
+	}
+	defer s.Close()
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("failover took %v", d)
+	}
+	if g.members[0].available(time.Now().UnixNano()) {
+		t.Fatal("silent member still available")
+	}
+}
+
+func TestUpstreamGroup_TargetFailure(t *testing.T) {
+	up, err := newServer(ServerCfg{UDPListen: "127.0.0.1:0", Listeners: []ListenerCfg{{Listen: "127.0.0.1:0"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := up.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer up.close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	l.Close()
+
+	//上游可用但目标拒绝连接:透传上游的应答码,不标记成员不可用,也不尝试下一个成员
+	g := newTestUpstreamGroup(t, StrategyLeastConn, up.listeners[0].addr().String(), startTestSilentServer(t))
+	g.members[1].conns = 1
+	start := time.Now()
+	_, rep, _, err := g.dial(nil, closed, time.Second)
+	if err == nil || rep != RepConnectionRefused {
+		t.Fatalf("dial:%d %v", rep, err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("target failure took %v", d)
+	}
+	now := time.Now().UnixNano()
+	if !g.members[0].available(now) || !g.members[1].available(now) {
+		t.Fatal("member marked unavailable on target failure")
+	}
+}